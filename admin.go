@@ -0,0 +1,423 @@
+package eth_multi_transactions
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+// adminError is an error of a request to the admin API, with the status it is answered with.
+type adminError struct {
+	status int
+	err    error
+}
+
+func (e *adminError) Error() string { return e.err.Error() }
+func (e *adminError) Unwrap() error { return e.err }
+
+func badRequest(err error) error { return &adminError{status: http.StatusBadRequest, err: err} }
+
+// AdminHandler serves the admin API of a running worker over the db views of its chains,
+// the chain of a request being given by its chain query parameter. Every request carries
+// the bearer token of a known identity:
+//
+//	GET    /plans                      latest version of every plan
+//	GET    /plans/<name>               latest version of a plan, or the one given by ?version=
+//	PUT    /plans/<name>               store a new version of a plan
+//	DELETE /plans/<name>               delete a plan
+//	PUT    /withdrawals/<id>/priority  change the priority of a pending withdrawal
+//	POST   /withdrawals/<id>/approve   approve a withdrawal awaiting approval
+//	POST   /withdrawals/<id>/reject    reject a withdrawal awaiting approval
+//	POST   /batches/<id>/approve       approve every withdrawal of a batch awaiting approval
+//	POST   /batches/<id>/reject        reject every withdrawal of a batch awaiting approval
+//	GET    /approval-policy            approval policy of the chain
+//	PUT    /approval-policy            replace the approval policy of the chain
+//	GET    /audit                      every approval and rejection
+//
+// The identity of the bearer token is the approver of approvals and rejections and is
+// recorded with changes of the approval policy. Rejections take a body like {"reason":"..."}.
+type AdminHandler struct {
+	views  map[string]*WdDB  // chain name => db view
+	tokens map[string]string // identity => bearer token
+}
+
+// NewAdminHandler serves views to the holders of tokens, see LoadAdminTokens.
+func NewAdminHandler(views map[string]*WdDB, tokens map[string]string) *AdminHandler {
+	return &AdminHandler{views: views, tokens: tokens}
+}
+
+func (h *AdminHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var (
+		ans interface{}
+		err error
+	)
+	if caller, ok := h.authenticate(r); ok {
+		ans, err = h.serve(r, caller)
+	} else {
+		err = &adminError{status: http.StatusUnauthorized, err: errors.New("unknown bearer token")}
+	}
+
+	status := http.StatusOK
+	var adminErr *adminError
+	switch {
+	case errors.As(err, &adminErr):
+		status = adminErr.status
+	case errors.Is(err, leveldb.ErrNotFound):
+		status = http.StatusNotFound
+	case err != nil:
+		status = http.StatusInternalServerError
+	}
+	if err != nil {
+		logger.Warn("admin request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+		ans = map[string]string{"error": err.Error()}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(ans); err != nil {
+		logger.Error("failed to write admin response", "err", err)
+	}
+}
+
+// authenticate returns the identity of the bearer token of r, comparing it with every
+// known token in constant time.
+func (h *AdminHandler) authenticate(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return "", false
+	}
+
+	var caller string
+	for identity, t := range h.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			caller = identity
+		}
+	}
+	return caller, caller != ""
+}
+
+func (h *AdminHandler) serve(r *http.Request, caller string) (interface{}, error) {
+	chain := r.URL.Query().Get("chain")
+	db, ok := h.views[chain]
+	if !ok {
+		return nil, &adminError{status: http.StatusNotFound, err: fmt.Errorf("unknown chain %q", chain)}
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "plans" && r.Method == http.MethodGet:
+		return db.ListPlans()
+	case len(parts) == 2 && parts[0] == "plans":
+		return h.servePlan(r, db, parts[1], caller)
+	case len(parts) == 3 && parts[0] == "withdrawals" && parts[2] == "priority" && r.Method == http.MethodPut:
+		return h.servePriority(r, db, parts[1], caller)
+	case len(parts) == 3 && (parts[0] == "withdrawals" || parts[0] == "batches") && r.Method == http.MethodPost:
+		return h.serveReview(r, db, parts[0], parts[1], parts[2], caller)
+	case len(parts) == 1 && parts[0] == "approval-policy":
+		return h.serveApprovalPolicy(r, db, caller)
+	case len(parts) == 1 && parts[0] == "audit" && r.Method == http.MethodGet:
+		return db.AuditLog()
+	}
+	return nil, &adminError{status: http.StatusNotFound, err: fmt.Errorf("no route for %s %s", r.Method, r.URL.Path)}
+}
+
+func (h *AdminHandler) servePlan(r *http.Request, db *WdDB, name, caller string) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		if v := r.URL.Query().Get("version"); v != "" {
+			version, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil, badRequest(err)
+			}
+			return db.GetPlanVersion(name, version)
+		}
+		return db.GetPlan(name)
+	case http.MethodPut:
+		var p Plan
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			return nil, badRequest(err)
+		}
+		p.Name = name
+		if _, _, err := p.Parse(); err != nil {
+			return nil, badRequest(err)
+		}
+		if err := db.PutPlan(&p); err != nil {
+			return nil, err
+		}
+		logger.Info("plan stored", "chain", db.Chain(), "plan", name, "version", p.Version, "by", caller)
+		return &p, nil
+	case http.MethodDelete:
+		if err := db.DeletePlan(name); err != nil {
+			return nil, err
+		}
+		logger.Info("plan deleted", "chain", db.Chain(), "plan", name, "by", caller)
+		return map[string]string{}, nil
+	}
+	return nil, &adminError{status: http.StatusMethodNotAllowed, err: fmt.Errorf("method %s not allowed", r.Method)}
+}
+
+func (h *AdminHandler) servePriority(r *http.Request, db *WdDB, rawId, caller string) (interface{}, error) {
+	id, err := strconv.ParseUint(rawId, 10, 64)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	var body struct {
+		Priority uint64 `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, badRequest(err)
+	}
+
+	if err := db.SetPriority(id, body.Priority); errors.Is(err, ErrNotPending) {
+		return nil, &adminError{status: http.StatusConflict, err: err}
+	} else if err != nil {
+		return nil, err
+	}
+	logger.Info("priority changed", "chain", db.Chain(), "id", id, "priority", body.Priority, "by", caller)
+	return db.GetWdObjById(id)
+}
+
+func (h *AdminHandler) serveReview(r *http.Request, db *WdDB, kind, rawId, action, caller string) (interface{}, error) {
+	id, err := strconv.ParseUint(rawId, 10, 64)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	var body struct {
+		Approver string `json:"approver"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, badRequest(err)
+	}
+	if body.Approver != "" {
+		// approvals count per approver, which must not be whoever the caller claims to be
+		return nil, badRequest(errors.New("the approver is the identity of the bearer token, not given in the body"))
+	}
+
+	switch {
+	case kind == "withdrawals" && action == ActionApprove:
+		err = db.Approve(id, caller)
+	case kind == "withdrawals" && action == ActionReject:
+		err = db.Reject(id, caller, body.Reason)
+	case kind == "batches" && action == ActionApprove:
+		err = db.ApproveBatch(id, caller)
+	case kind == "batches" && action == ActionReject:
+		err = db.RejectBatch(id, caller, body.Reason)
+	default:
+		return nil, &adminError{status: http.StatusNotFound, err: fmt.Errorf("no route for %s %s", r.Method, r.URL.Path)}
+	}
+	if errors.Is(err, ErrNotAwaitingApproval) || errors.Is(err, ErrAlreadyApproved) {
+		return nil, &adminError{status: http.StatusConflict, err: err}
+	} else if err != nil {
+		return nil, err
+	}
+	logger.Info("withdrawal reviewed", "chain", db.Chain(), "kind", kind, "id", id, "action", action, "approver", caller)
+
+	if kind == "batches" {
+		return map[string]string{}, nil
+	}
+	return db.GetWdObjById(id)
+}
+
+func (h *AdminHandler) serveApprovalPolicy(r *http.Request, db *WdDB, caller string) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		return db.GetApprovalPolicy()
+	case http.MethodPut:
+		var p ApprovalPolicy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			return nil, badRequest(err)
+		}
+		if err := p.Validate(); err != nil {
+			return nil, badRequest(err)
+		}
+		if err := db.SetApprovalPolicy(&p, caller); err != nil {
+			return nil, err
+		}
+		logger.Info("approval policy changed", "chain", db.Chain(), "rules", len(p.Rules), "by", caller)
+		return &p, nil
+	}
+	return nil, &adminError{status: http.StatusMethodNotAllowed, err: fmt.Errorf("method %s not allowed", r.Method)}
+}
+
+// LoadAdminTokens reads a JSON object mapping the identities allowed to call the admin API
+// to their bearer tokens.
+func LoadAdminTokens(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens map[string]string
+	if err := json.Unmarshal(raw, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no admin token in %s", path)
+	}
+	seen := make(map[string]string)
+	for identity, token := range tokens {
+		if identity == "" || token == "" {
+			return nil, fmt.Errorf("empty identity or token in %s", path)
+		}
+		if other, ok := seen[token]; ok {
+			return nil, fmt.Errorf("identities %q and %q share a token", other, identity)
+		}
+		seen[token] = identity
+	}
+	return tokens, nil
+}
+
+// LoadAdminToken reads the bearer token of an AdminClient from path.
+func LoadAdminToken(path string) (string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		return "", fmt.Errorf("no admin token in %s", path)
+	}
+	return token, nil
+}
+
+// AdminAddr returns the address the admin API listens on for addr, an address without a
+// host, like :8090, meaning the loopback interface only.
+func AdminAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// a bare port
+		host, port = "", addr
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// AdminClient calls the admin API of a running worker.
+type AdminClient struct {
+	URL   string // of the API, like http://127.0.0.1:8090, or the address it listens on
+	Chain string
+	Token string // bearer token of the caller
+}
+
+func (c *AdminClient) ListPlans() ([]*Plan, error) {
+	var ans []*Plan
+	return ans, c.call(http.MethodGet, "/plans", nil, nil, &ans)
+}
+
+func (c *AdminClient) GetPlan(name string) (*Plan, error) {
+	var ans Plan
+	return &ans, c.call(http.MethodGet, "/plans/"+url.PathEscape(name), nil, nil, &ans)
+}
+
+func (c *AdminClient) PutPlan(p *Plan) error {
+	return c.call(http.MethodPut, "/plans/"+url.PathEscape(p.Name), nil, p, p)
+}
+
+func (c *AdminClient) DeletePlan(name string) error {
+	return c.call(http.MethodDelete, "/plans/"+url.PathEscape(name), nil, nil, nil)
+}
+
+func (c *AdminClient) SetPriority(id uint64, priority uint64) error {
+	body := map[string]uint64{"priority": priority}
+	return c.call(http.MethodPut, "/withdrawals/"+strconv.FormatUint(id, 10)+"/priority", nil, body, nil)
+}
+
+// Approve approves withdrawal id as the identity of the token of c.
+func (c *AdminClient) Approve(id uint64) error {
+	return c.review("/withdrawals/", id, ActionApprove, "")
+}
+
+func (c *AdminClient) Reject(id uint64, reason string) error {
+	return c.review("/withdrawals/", id, ActionReject, reason)
+}
+
+func (c *AdminClient) ApproveBatch(id uint64) error {
+	return c.review("/batches/", id, ActionApprove, "")
+}
+
+func (c *AdminClient) RejectBatch(id uint64, reason string) error {
+	return c.review("/batches/", id, ActionReject, reason)
+}
+
+func (c *AdminClient) review(kind string, id uint64, action, reason string) error {
+	body := map[string]string{"reason": reason}
+	return c.call(http.MethodPost, kind+strconv.FormatUint(id, 10)+"/"+action, nil, body, nil)
+}
+
+func (c *AdminClient) GetApprovalPolicy() (*ApprovalPolicy, error) {
+	var ans ApprovalPolicy
+	return &ans, c.call(http.MethodGet, "/approval-policy", nil, nil, &ans)
+}
+
+func (c *AdminClient) SetApprovalPolicy(p *ApprovalPolicy) error {
+	return c.call(http.MethodPut, "/approval-policy", nil, p, nil)
+}
+
+func (c *AdminClient) AuditLog() ([]*AuditEntry, error) {
+	var ans []*AuditEntry
+	return ans, c.call(http.MethodGet, "/audit", nil, nil, &ans)
+}
+
+func (c *AdminClient) call(method, path string, query url.Values, body, ans interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("chain", c.Chain)
+
+	var in io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(raw)
+	}
+
+	base := strings.TrimRight(c.URL, "/")
+	if !strings.Contains(base, "://") {
+		base = "http://" + AdminAddr(base)
+	}
+	req, err := http.NewRequest(method, base+path+"?"+query.Encode(), in)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+			return fmt.Errorf("admin api: %s", resp.Status)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s", leveldb.ErrNotFound, e.Error)
+		}
+		return fmt.Errorf("admin api: %s", e.Error)
+	}
+	if ans == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(ans)
+}
@@ -0,0 +1,91 @@
+package eth_multi_transactions
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+func TestAdminHandler_Plans(t *testing.T) {
+	logger.Init(logger.DebugLevel)
+	db := newTestDB(t)
+	server := httptest.NewServer(NewAdminHandler(map[string]*WdDB{"": db}, map[string]string{"alice": "alice-token"}))
+	defer server.Close()
+
+	client := &AdminClient{URL: server.URL, Token: "alice-token"}
+	p := testPlan("a", 1)
+	require.NoError(t, client.PutPlan(p))
+	assert.Equal(t, uint64(1), p.Version)
+
+	stored, err := db.GetPlan("a")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stored.Version)
+
+	got, err := client.GetPlan("a")
+	require.NoError(t, err)
+	assert.Equal(t, "@daily", got.Schedule)
+
+	assert.Error(t, client.PutPlan(&Plan{Name: "b", Schedule: "@daily"}))
+
+	plans, err := client.ListPlans()
+	require.NoError(t, err)
+	assert.Len(t, plans, 1)
+
+	require.NoError(t, client.DeletePlan("a"))
+	_, err = client.GetPlan("a")
+	assert.True(t, errors.Is(err, leveldb.ErrNotFound))
+
+	_, err = (&AdminClient{URL: server.URL, Chain: "unknown", Token: "alice-token"}).ListPlans()
+	assert.Error(t, err)
+}
+
+func TestAdminHandler_Auth(t *testing.T) {
+	logger.Init(logger.DebugLevel)
+	db := newTestDB(t)
+	server := httptest.NewServer(NewAdminHandler(map[string]*WdDB{"": db}, map[string]string{"alice": "alice-token"}))
+	defer server.Close()
+
+	for _, token := range []string{"", "bob-token", "alice"} {
+		err := (&AdminClient{URL: server.URL, Token: token}).PutPlan(testPlan("a", 1))
+		assert.Error(t, err, token)
+	}
+	plans, err := db.ListPlans()
+	require.NoError(t, err)
+	assert.Empty(t, plans)
+
+	_, err = (&AdminClient{URL: server.URL, Token: "alice-token"}).ListPlans()
+	assert.NoError(t, err)
+}
+
+func TestLoadAdminTokens(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "tokens.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	tokens, err := LoadAdminTokens(write(`{"alice": "a", "bob": "b"}`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"alice": "a", "bob": "b"}, tokens)
+
+	for _, content := range []string{`{}`, `{"alice": ""}`, `{"alice": "a", "bob": "a"}`, `[]`} {
+		_, err := LoadAdminTokens(write(content))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestAdminAddr(t *testing.T) {
+	assert.Equal(t, "127.0.0.1:8090", AdminAddr(":8090"))
+	assert.Equal(t, "127.0.0.1:8090", AdminAddr("8090"))
+	assert.Equal(t, "0.0.0.0:8090", AdminAddr("0.0.0.0:8090"))
+	assert.Equal(t, "[::1]:8090", AdminAddr("[::1]:8090"))
+}
@@ -0,0 +1,398 @@
+package eth_multi_transactions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	ErrNotAwaitingApproval = errors.New("withdrawal is not awaiting approval")
+	ErrAlreadyApproved     = errors.New("withdrawal already approved by this approver")
+)
+
+// actions of the audit log
+const (
+	ActionApprove = "approve"
+	ActionReject  = "reject"
+	ActionPolicy  = "policy" // a change of the approval policy
+)
+
+// ApprovalRule requires Approvers distinct approvals of the withdrawals of Token above an
+// amount.
+type ApprovalRule struct {
+	Token     string   `json:"token,omitempty"` // empty for ether
+	Above     *big.Int `json:"above"`           // in wei or token units, 0 for every withdrawal
+	Approvers uint64   `json:"approvers"`
+}
+
+// ApprovalPolicy decides which withdrawals of a chain await approval when inserted, those
+// matching no rule being paid without. A withdrawal matching several rules needs the most
+// approvals any of them requires.
+type ApprovalPolicy struct {
+	Rules []ApprovalRule `json:"rules"`
+}
+
+func (p *ApprovalPolicy) Validate() error {
+	for i, r := range p.Rules {
+		switch {
+		case r.Token != "" && !common.IsHexAddress(r.Token):
+			return fmt.Errorf("approval rule %d: invalid token: %s", i, r.Token)
+		case r.Above == nil || r.Above.Sign() < 0:
+			return fmt.Errorf("approval rule %d: invalid amount", i)
+		case r.Approvers == 0:
+			return fmt.Errorf("approval rule %d: no approvers", i)
+		}
+	}
+	return nil
+}
+
+// Required returns the number of distinct approvals a withdrawal of amount of token needs.
+func (p *ApprovalPolicy) Required(token string, amount *big.Int) uint64 {
+	var ans uint64
+	for _, r := range p.Rules {
+		if sameToken(r.Token, token) && amount.Cmp(r.Above) > 0 && r.Approvers > ans {
+			ans = r.Approvers
+		}
+	}
+	return ans
+}
+
+func (w *WdDB) approvalPolicyKey() []byte {
+	return w.prefixed([]byte("kv-approvalpolicy"))
+}
+
+// SetApprovalPolicy checks p and applies it to the withdrawals inserted from now on, an
+// empty policy having every withdrawal paid without approval. The change is recorded in
+// the audit log as made by by.
+func (w *WdDB) SetApprovalPolicy(p *ApprovalPolicy, by string) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if by == "" {
+		return errors.New("no identity changing the approval policy")
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return w.review(func(tx *leveldb.Transaction, now uint64) error {
+		if len(p.Rules) == 0 {
+			if err := tx.Delete(w.approvalPolicyKey(), nil); err != nil {
+				return err
+			}
+		} else if err := tx.Put(w.approvalPolicyKey(), raw, nil); err != nil {
+			return err
+		}
+		return w.putAuditEntry(tx, &AuditEntry{Approver: by, Action: ActionPolicy, Reason: string(raw), Time: now})
+	})
+}
+
+// GetApprovalPolicy returns the approval policy of the chain, empty if none was set.
+func (w *WdDB) GetApprovalPolicy() (*ApprovalPolicy, error) {
+	raw, err := w.getOptional(w.approvalPolicyKey())
+	if err != nil {
+		return nil, err
+	}
+	return parseApprovalPolicy(raw)
+}
+
+func (w *WdDB) approvalPolicy(tx *leveldb.Transaction) (*ApprovalPolicy, error) {
+	raw, err := tx.Get(w.approvalPolicyKey(), nil)
+	if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+		return nil, err
+	}
+	return parseApprovalPolicy(raw)
+}
+
+func parseApprovalPolicy(raw []byte) (*ApprovalPolicy, error) {
+	var p ApprovalPolicy
+	if len(raw) == 0 {
+		return &p, nil
+	}
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// AuditEntry is an approval or rejection of a withdrawal, or a change of the approval policy.
+type AuditEntry struct {
+	Id         uint64
+	Withdrawal uint64 // 0 for a change of the approval policy
+	Approver   string
+	Action     string // ActionApprove, ActionReject or ActionPolicy
+	Reason     string // of a rejection, the new policy as JSON for ActionPolicy
+	Time       uint64
+}
+
+// approvedKey returns the key recording that approver approved withdrawal id, or the
+// prefix of those of every approver if empty.
+func (w *WdDB) approvedKey(id uint64, approver string) []byte {
+	return append(w.key("approvedby-", id), "/"+approver...)
+}
+
+// Approve records the approval of withdrawal id by approver, releasing the withdrawal to be
+// paid once approved by as many distinct approvers as it requires. It fails with
+// ErrNotAwaitingApproval if the withdrawal does not await approval, and with
+// ErrAlreadyApproved if approver approved it already.
+func (w *WdDB) Approve(id uint64, approver string) error {
+	return w.review(func(tx *leveldb.Transaction, now uint64) error {
+		return w.approve(tx, id, approver, now)
+	})
+}
+
+// Reject moves withdrawal id from StatusAwaitingApproval to StatusRejected, recording who
+// rejected it and why. It fails with ErrNotAwaitingApproval if the withdrawal does not
+// await approval.
+func (w *WdDB) Reject(id uint64, approver, reason string) error {
+	return w.review(func(tx *leveldb.Transaction, now uint64) error {
+		return w.reject(tx, id, approver, reason, now)
+	})
+}
+
+// ApproveBatch approves every withdrawal of payout batch id awaiting approval as Approve
+// does, all or none. It fails with ErrNotAwaitingApproval if none awaits approval.
+func (w *WdDB) ApproveBatch(id uint64, approver string) error {
+	return w.reviewBatch(id, func(tx *leveldb.Transaction, wd, now uint64) error {
+		return w.approve(tx, wd, approver, now)
+	})
+}
+
+// RejectBatch rejects every withdrawal of payout batch id awaiting approval as Reject does,
+// all or none. It fails with ErrNotAwaitingApproval if none awaits approval.
+func (w *WdDB) RejectBatch(id uint64, approver, reason string) error {
+	return w.reviewBatch(id, func(tx *leveldb.Transaction, wd, now uint64) error {
+		return w.reject(tx, wd, approver, reason, now)
+	})
+}
+
+func (w *WdDB) review(f func(tx *leveldb.Transaction, now uint64) error) error {
+	tx, err := w.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+	if err := f(tx, uint64(time.Now().Unix())); err != nil {
+		tx.Discard()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (w *WdDB) reviewBatch(id uint64, f func(tx *leveldb.Transaction, wd, now uint64) error) error {
+	return w.review(func(tx *leveldb.Transaction, now uint64) error {
+		ids, err := w.batchAwaitingApproval(tx, id)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("%w, batch: %v", ErrNotAwaitingApproval, id)
+		}
+		for _, wd := range ids {
+			if err := f(tx, wd, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// batchAwaitingApproval returns the withdrawals of payout batch id awaiting approval.
+func (w *WdDB) batchAwaitingApproval(tx *leveldb.Transaction, id uint64) ([]uint64, error) {
+	prefix := w.prefixed([]byte("batch-"))
+	itr := tx.NewIterator(util.BytesPrefix(prefix), nil)
+	defer itr.Release()
+
+	var ans []uint64
+	for itr.Next() {
+		if batch, _ := FromBigEndianBytes(itr.Value()); batch != id {
+			continue
+		}
+		wd, err := FromBigEndianBytes(itr.Key()[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		if status, err := w.txStatus(tx, wd); err != nil {
+			return nil, err
+		} else if status == StatusAwaitingApproval {
+			ans = append(ans, wd)
+		}
+	}
+	return ans, itr.Error()
+}
+
+func (w *WdDB) txStatus(tx *leveldb.Transaction, id uint64) (uint64, error) {
+	v, err := tx.Get(w.StatusKey(id), nil)
+	if err != nil {
+		return 0, err
+	}
+	return FromBigEndianBytes(v)
+}
+
+func (w *WdDB) checkAwaitingApproval(tx *leveldb.Transaction, id uint64, approver string) error {
+	if approver == "" {
+		return errors.New("no approver")
+	}
+	status, err := w.txStatus(tx, id)
+	if err != nil {
+		return err
+	}
+	if status != StatusAwaitingApproval {
+		return fmt.Errorf("%w, id: %v status: %v", ErrNotAwaitingApproval, id, status)
+	}
+	return nil
+}
+
+func (w *WdDB) approve(tx *leveldb.Transaction, id uint64, approver string, now uint64) error {
+	if err := w.checkAwaitingApproval(tx, id, approver); err != nil {
+		return err
+	}
+
+	key := w.approvedKey(id, approver)
+	if ok, err := tx.Has(key, nil); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("%w, id: %v approver: %s", ErrAlreadyApproved, id, approver)
+	}
+	if err := tx.Put(key, ToBigEndianBytes(now), nil); err != nil {
+		return err
+	}
+	if err := w.putAuditEntry(tx, &AuditEntry{Withdrawal: id, Approver: approver, Action: ActionApprove, Time: now}); err != nil {
+		return err
+	}
+
+	var required uint64
+	if v, err := tx.Get(w.key("approvers-", id), nil); err == nil {
+		required, _ = FromBigEndianBytes(v)
+	} else if !errors.Is(err, leveldb.ErrNotFound) {
+		return err
+	}
+
+	itr := tx.NewIterator(util.BytesPrefix(w.approvedKey(id, "")), nil)
+	var approvals uint64
+	for itr.Next() {
+		approvals++
+	}
+	itr.Release()
+	if err := itr.Error(); err != nil {
+		return err
+	}
+
+	if approvals >= required {
+		if err := tx.Put(w.StatusKey(id), ToBigEndianBytes(StatusInit), nil); err != nil {
+			return err
+		}
+	}
+	return tx.Put(w.key("modified-", id), ToBigEndianBytes(now), nil)
+}
+
+func (w *WdDB) reject(tx *leveldb.Transaction, id uint64, approver, reason string, now uint64) error {
+	if err := w.checkAwaitingApproval(tx, id, approver); err != nil {
+		return err
+	}
+
+	if err := w.putAuditEntry(tx, &AuditEntry{Withdrawal: id, Approver: approver, Action: ActionReject, Reason: reason, Time: now}); err != nil {
+		return err
+	}
+	if err := tx.Put(w.StatusKey(id), ToBigEndianBytes(StatusRejected), nil); err != nil {
+		return err
+	}
+	if err := tx.Put(w.key("reason-", id), []byte("rejected by "+approver+": "+reason), nil); err != nil {
+		return err
+	}
+	return tx.Put(w.key("modified-", id), ToBigEndianBytes(now), nil)
+}
+
+func (w *WdDB) putAuditEntry(tx *leveldb.Transaction, e *AuditEntry) error {
+	id, err := w.nextId(tx, "kv-auditid")
+	if err != nil {
+		return err
+	}
+	e.Id = id
+
+	if err := tx.Put(w.key("auditwd-", id), ToBigEndianBytes(e.Withdrawal), nil); err != nil {
+		return err
+	}
+	if err := tx.Put(w.key("auditby-", id), []byte(e.Approver), nil); err != nil {
+		return err
+	}
+	if err := tx.Put(w.key("auditaction-", id), []byte(e.Action), nil); err != nil {
+		return err
+	}
+	if err := tx.Put(w.key("auditreason-", id), []byte(e.Reason), nil); err != nil {
+		return err
+	}
+	return tx.Put(w.key("audittime-", id), ToBigEndianBytes(e.Time), nil)
+}
+
+// AuditLog returns every approval and rejection of a withdrawal and every change of the
+// approval policy, oldest first.
+func (w *WdDB) AuditLog() ([]*AuditEntry, error) {
+	prefix := w.prefixed([]byte("auditwd-"))
+	itr := w.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer itr.Release()
+
+	var ids []uint64
+	for itr.Next() {
+		id, err := FromBigEndianBytes(itr.Key()[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+
+	ans := make([]*AuditEntry, 0, len(ids))
+	for _, id := range ids {
+		e, err := w.getAuditEntry(id)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, e)
+	}
+	return ans, nil
+}
+
+func (w *WdDB) getAuditEntry(id uint64) (*AuditEntry, error) {
+	ans := AuditEntry{Id: id}
+
+	if v, err := w.db.Get(w.key("auditwd-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Withdrawal, _ = FromBigEndianBytes(v)
+	}
+
+	if v, err := w.db.Get(w.key("auditby-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Approver = string(v)
+	}
+
+	if v, err := w.db.Get(w.key("auditaction-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Action = string(v)
+	}
+
+	if v, err := w.db.Get(w.key("auditreason-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Reason = string(v)
+	}
+
+	if v, err := w.db.Get(w.key("audittime-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Time, _ = FromBigEndianBytes(v)
+	}
+	return &ans, nil
+}
@@ -0,0 +1,156 @@
+package eth_multi_transactions
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+func testApprovalPolicy() *ApprovalPolicy {
+	return &ApprovalPolicy{Rules: []ApprovalRule{
+		{Above: big.NewInt(10), Approvers: 1},
+		{Above: big.NewInt(100), Approvers: 2},
+	}}
+}
+
+func TestApprovalPolicy_Required(t *testing.T) {
+	p := testApprovalPolicy()
+	assert.Equal(t, uint64(0), p.Required("", big.NewInt(10)))
+	assert.Equal(t, uint64(1), p.Required("", big.NewInt(11)))
+	assert.Equal(t, uint64(2), p.Required("", big.NewInt(101)))
+	assert.Equal(t, uint64(0), p.Required("0x000000000000000000000000000000000000c001", big.NewInt(101)))
+
+	// tokens match whatever the case of their addresses
+	p.Rules = append(p.Rules, ApprovalRule{Token: "0x000000000000000000000000000000000000c0de", Above: big.NewInt(0), Approvers: 3})
+	assert.Equal(t, uint64(3), p.Required("0x000000000000000000000000000000000000C0DE", big.NewInt(1)))
+
+	assert.Error(t, (&ApprovalPolicy{Rules: []ApprovalRule{{Above: big.NewInt(1)}}}).Validate())
+	assert.Error(t, (&ApprovalPolicy{Rules: []ApprovalRule{{Approvers: 1}}}).Validate())
+}
+
+func TestWdDB_Approve(t *testing.T) {
+	db := newTestDB(t)
+	require.NoError(t, db.SetApprovalPolicy(testApprovalPolicy(), "admin"))
+
+	now := uint64(time.Now().Unix())
+	objs := []*DbWithdrawalObj{
+		{Address: "0x0000000000000000000000000000000000001001", Amount: big.NewInt(5), Created: now, Modified: now},
+		{Address: "0x0000000000000000000000000000000000001002", Amount: big.NewInt(500), Created: now, Modified: now},
+		{Address: "0x0000000000000000000000000000000000001003", Amount: big.NewInt(50), Created: now, Modified: now},
+	}
+	require.NoError(t, db.BatchInsert(objs))
+	assert.Equal(t, StatusInit, objs[0].Status)
+	assert.Equal(t, StatusAwaitingApproval, objs[1].Status)
+
+	due, _, err := db.GetDueRecordsId(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{objs[0].Id}, due)
+
+	// two distinct approvers release the large withdrawal
+	require.NoError(t, db.Approve(objs[1].Id, "alice"))
+	assert.ErrorIs(t, db.Approve(objs[1].Id, "alice"), ErrAlreadyApproved)
+	obj, err := db.GetWdObjById(objs[1].Id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusAwaitingApproval, obj.Status)
+	assert.Equal(t, uint64(2), obj.Approvers)
+
+	require.NoError(t, db.Approve(objs[1].Id, "bob"))
+	obj, err = db.GetWdObjById(objs[1].Id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusInit, obj.Status)
+	assert.ErrorIs(t, db.Approve(objs[1].Id, "carol"), ErrNotAwaitingApproval)
+
+	require.NoError(t, db.Reject(objs[2].Id, "carol", "unknown recipient"))
+	obj, err = db.GetWdObjById(objs[2].Id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusRejected, obj.Status)
+	assert.Contains(t, obj.Reason, "unknown recipient")
+
+	log, err := db.AuditLog()
+	require.NoError(t, err)
+	require.Len(t, log, 4)
+	assert.Equal(t, ActionPolicy, log[0].Action)
+	assert.Equal(t, "admin", log[0].Approver)
+	assert.Contains(t, log[0].Reason, `"approvers":2`)
+	assert.Equal(t, []string{"alice", "bob", "carol"}, []string{log[1].Approver, log[2].Approver, log[3].Approver})
+	assert.Equal(t, ActionReject, log[3].Action)
+	assert.Equal(t, objs[2].Id, log[3].Withdrawal)
+	assert.NotZero(t, log[3].Time)
+
+	assert.Error(t, db.SetApprovalPolicy(&ApprovalPolicy{}, ""))
+}
+
+func TestWdDB_ApproveBatch(t *testing.T) {
+	db := newTestDB(t)
+	require.NoError(t, db.SetApprovalPolicy(&ApprovalPolicy{Rules: []ApprovalRule{{Above: big.NewInt(0), Approvers: 1}}}, "admin"))
+
+	now := uint64(time.Now().Unix())
+	b := &PayoutBatch{Total: big.NewInt(3), Leftover: big.NewInt(0), Created: now}
+	objs := []*DbWithdrawalObj{
+		{Address: "0x0000000000000000000000000000000000001001", Amount: big.NewInt(1), Created: now, Modified: now},
+		{Address: "0x0000000000000000000000000000000000001002", Amount: big.NewInt(2), Created: now, Modified: now},
+	}
+	require.NoError(t, db.InsertBatch(b, objs))
+
+	assert.ErrorIs(t, db.RejectBatch(b.Id+1, "alice", ""), ErrNotAwaitingApproval)
+	require.NoError(t, db.ApproveBatch(b.Id, "alice"))
+	for _, o := range objs {
+		obj, err := db.GetWdObjById(o.Id)
+		require.NoError(t, err)
+		assert.Equal(t, StatusInit, obj.Status)
+	}
+	assert.ErrorIs(t, db.ApproveBatch(b.Id, "bob"), ErrNotAwaitingApproval)
+
+	// clearing the policy pays new withdrawals without approval
+	require.NoError(t, db.SetApprovalPolicy(&ApprovalPolicy{}, "admin"))
+	obj := &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001003", Amount: big.NewInt(3), Created: now, Modified: now}
+	require.NoError(t, db.BatchInsert([]*DbWithdrawalObj{obj}))
+	assert.Equal(t, StatusInit, obj.Status)
+}
+
+func TestAdminHandler_Approvals(t *testing.T) {
+	logger.Init(logger.DebugLevel)
+	db := newTestDB(t)
+	tokens := map[string]string{"alice": "alice-token", "bob": "bob-token"}
+	server := httptest.NewServer(NewAdminHandler(map[string]*WdDB{"": db}, tokens))
+	defer server.Close()
+
+	client := &AdminClient{URL: server.URL, Token: "alice-token"}
+	require.NoError(t, client.SetApprovalPolicy(testApprovalPolicy()))
+	policy, err := client.GetApprovalPolicy()
+	require.NoError(t, err)
+	assert.Len(t, policy.Rules, 2)
+
+	now := uint64(time.Now().Unix())
+	obj := &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001001", Amount: big.NewInt(50), Created: now, Modified: now}
+	require.NoError(t, db.BatchInsert([]*DbWithdrawalObj{obj}))
+
+	// the approver is who the token belongs to, never who the body claims
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/withdrawals/%d/approve", server.URL, obj.Id), strings.NewReader(`{"approver":"bob"}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer alice-token")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	require.NoError(t, client.Approve(obj.Id))
+	assert.Error(t, (&AdminClient{URL: server.URL, Token: "bob-token"}).Reject(obj.Id, "too late"))
+
+	log, err := client.AuditLog()
+	require.NoError(t, err)
+	require.Len(t, log, 2)
+	assert.Equal(t, ActionPolicy, log[0].Action)
+	assert.Equal(t, "alice", log[0].Approver)
+	assert.Equal(t, ActionApprove, log[1].Action)
+	assert.Equal(t, "alice", log[1].Approver)
+}
@@ -0,0 +1,245 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+// BalancePolicy decides what a worker does when the pending queue exceeds the balance
+// of the sender.
+type BalancePolicy int
+
+const (
+	// BalanceAlert logs the shortfall and pays as before, each payout failing on its own
+	BalanceAlert BalancePolicy = iota
+	// BalanceRefuse pays nothing until the balance covers the whole queue
+	BalanceRefuse
+	// BalancePartial pays the queue in order up to the balance and holds the rest
+	BalancePartial
+)
+
+var ErrInsufficientBalance = errors.New("insufficient balance for the pending queue")
+
+// gas payouts are assumed to take when estimating their fees
+const (
+	tokenTransferGas = 65000
+	approveGas       = 50000
+	disperseCallGas  = 30000 // of a disperse call besides its recipients
+	disperseEtherGas = 10000 // per recipient of a disperse call paying ether
+	disperseTokenGas = 35000 // per recipient of a disperse call paying a token
+)
+
+func ParseBalancePolicy(s string) (BalancePolicy, error) {
+	switch s {
+	case "alert":
+		return BalanceAlert, nil
+	case "refuse":
+		return BalanceRefuse, nil
+	case "partial":
+		return BalancePartial, nil
+	}
+	return 0, fmt.Errorf("unknown balance policy: %s", s)
+}
+
+// Shortfall is a token, empty for ether, the pending queue needs more of than the sender has.
+type Shortfall struct {
+	Token   string
+	Need    *big.Int
+	Balance *big.Int
+}
+
+func (s Shortfall) String() string {
+	token := s.Token
+	if token == "" {
+		token = "ether"
+	}
+	return fmt.Sprintf("%s need: %v balance: %v", token, s.Need, s.Balance)
+}
+
+// checkBalance compares the amounts of the pending withdrawals ids plus their estimated
+// fees with the balances of the sender, and returns the withdrawals to pay now according
+// to BalancePolicy. Withdrawals in flight but not mined yet are counted as spent.
+func (w *Worker) checkBalance(ctx context.Context, ids []uint64) ([]uint64, error) {
+	suggested, err := w.ethc.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gasPrice, err := w.Policy.Fee.Apply(suggested)
+	if err != nil {
+		return nil, err
+	}
+
+	balances := make(map[string]*big.Int) // token => balance of the sender
+	left := make(map[string]*big.Int)     // token => balance not yet spent
+	need := make(map[string]*big.Int)     // token => cost of the whole queue
+	load := func(token string) error {
+		if _, ok := balances[token]; ok {
+			return nil
+		}
+		v, err := w.currentBalance(ctx, token)
+		if err != nil {
+			return err
+		}
+		balances[token], left[token], need[token] = v, big.NewInt(0).Set(v), big.NewInt(0)
+		return nil
+	}
+
+	// cost of paying obj in each token, its fee being paid in ether
+	costOf := func(obj *DbWithdrawalObj) (map[string]*big.Int, error) {
+		gas := uint64(params.TxGas)
+		if obj.Token != "" {
+			gas = tokenTransferGas
+		}
+		cost := map[string]*big.Int{"": big.NewInt(0).Mul(gasPrice, big.NewInt(0).SetUint64(gas))}
+		if obj.Token == "" {
+			cost[""].Add(cost[""], obj.Amount)
+		} else {
+			cost[obj.Token] = obj.Amount
+		}
+
+		for token, c := range cost {
+			if err := load(token); err != nil {
+				return nil, err
+			}
+			need[token].Add(need[token], c)
+		}
+		return cost, nil
+	}
+	fits := func(cost map[string]*big.Int) bool {
+		for token, c := range cost {
+			if left[token].Cmp(c) < 0 {
+				return false
+			}
+		}
+		return true
+	}
+	take := func(cost map[string]*big.Int) {
+		for token, c := range cost {
+			left[token].Sub(left[token], c)
+		}
+	}
+
+	inFlight, err := w.db.GetRecordsIdByStatus(StatusProcessing)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range inFlight {
+		obj, err := w.db.GetWdObjById(id)
+		if err != nil {
+			return nil, err
+		}
+		if obj.BlockHash != "" {
+			// mined, already off the balance
+			continue
+		}
+		cost, err := costOf(obj)
+		if err != nil {
+			return nil, err
+		}
+		take(cost)
+	}
+
+	var (
+		pay  []uint64
+		held = make(map[string]bool) // tokens whose queue stopped
+	)
+	for _, id := range ids {
+		obj, err := w.db.GetWdObjById(id)
+		if err != nil {
+			return nil, err
+		}
+		cost, err := costOf(obj)
+		if err != nil {
+			return nil, err
+		}
+		// a withdrawal never overtakes an earlier one of its token left unpaid
+		if held[obj.Token] || !fits(cost) {
+			held[obj.Token] = true
+			continue
+		}
+		take(cost)
+		pay = append(pay, id)
+	}
+
+	if len(pay) == len(ids) {
+		return ids, nil
+	}
+
+	var shortfalls []Shortfall
+	for token, n := range need {
+		if n.Cmp(balances[token]) > 0 {
+			shortfalls = append(shortfalls, Shortfall{Token: token, Need: n, Balance: balances[token]})
+		}
+	}
+
+	switch w.BalancePolicy {
+	case BalanceRefuse:
+		return nil, fmt.Errorf("%w: %v", ErrInsufficientBalance, shortfalls)
+	case BalancePartial:
+		logger.Warn("paying the queue up to the balance", "chain", w.db.Chain(), "pay", len(pay), "hold", len(ids)-len(pay), "shortfall", shortfalls)
+		return pay, nil
+	default:
+		logger.Error("balance does not cover the pending queue", "chain", w.db.Chain(), "shortfall", shortfalls)
+		return ids, nil
+	}
+}
+
+// PayoutGas returns the gas limits of the transactions paying recipients of token the way
+// the worker pays them: a transfer each, or disperse calls of up to BatchSize recipients
+// after the approval of a token.
+func (w *Worker) PayoutGas(token string, recipients int) (uint64, error) {
+	if recipients <= 0 {
+		return 0, nil
+	}
+
+	if w.Disperse == nil {
+		gas := uint64(params.TxGas)
+		if token != "" {
+			gas = tokenTransferGas
+		}
+		limit, err := w.Policy.Gas.Apply(gas)
+		return limit * uint64(recipients), err
+	}
+
+	total := uint64(0)
+	perRecipient := uint64(disperseEtherGas)
+	if token != "" {
+		limit, err := w.Policy.Gas.Apply(approveGas)
+		if err != nil {
+			return 0, err
+		}
+		total += limit
+		perRecipient = disperseTokenGas
+	}
+
+	batchSize := w.BatchSize
+	if batchSize <= 0 {
+		batchSize = recipients
+	}
+	for left := recipients; left > 0; left -= batchSize {
+		n := left
+		if n > batchSize {
+			n = batchSize
+		}
+		limit, err := w.Policy.Gas.Apply(disperseCallGas + perRecipient*uint64(n))
+		if err != nil {
+			return 0, err
+		}
+		total += limit
+	}
+	return total, nil
+}
+
+func (w *Worker) currentBalance(ctx context.Context, token string) (*big.Int, error) {
+	if token == "" {
+		return w.ethc.BalanceAt(ctx, w.fromAddr, nil)
+	}
+	return TokenBalance(ctx, w.ethc, common.HexToAddress(token), w.fromAddr)
+}
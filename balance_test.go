@@ -0,0 +1,68 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorker_BalancePolicy(t *testing.T) {
+	ether := func(n int64) *big.Int { return big.NewInt(0).Mul(big.NewInt(n), Ether) }
+	queue := func() []*DbWithdrawalObj {
+		// the test account holds 1000 ether
+		return []*DbWithdrawalObj{
+			{Address: "0x000000000000000000000000000000000000b001", Amount: ether(400)},
+			{Address: "0x000000000000000000000000000000000000b002", Amount: ether(700)},
+			{Address: "0x000000000000000000000000000000000000b003", Amount: big.NewInt(1)},
+		}
+	}
+
+	t.Run("refuse", func(t *testing.T) {
+		w, db, _ := newTestWorker(t)
+		w.BalancePolicy = BalanceRefuse
+		insertTestWithdrawals(t, db, queue()...)
+
+		err := w.Dispatch(context.Background())
+		assert.True(t, errors.Is(err, ErrInsufficientBalance), "unexpected error: %v", err)
+
+		pending, err := db.GetUnhandledRecordsId()
+		require.NoError(t, err)
+		assert.Len(t, pending, 3)
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		w, db, client := newTestWorker(t)
+		w.BalancePolicy = BalancePartial
+		ids := insertTestWithdrawals(t, db, queue()...)
+
+		require.NoError(t, w.Dispatch(context.Background()))
+
+		// the small withdrawal does not overtake the one held before it
+		pending, err := db.GetUnhandledRecordsId()
+		require.NoError(t, err)
+		assert.Equal(t, ids[1:], pending)
+
+		// the one in flight still counts once it is settled
+		trackUntilSettled(t, w, client)
+		require.NoError(t, w.Dispatch(context.Background()))
+		pending, err = db.GetUnhandledRecordsId()
+		require.NoError(t, err)
+		assert.Equal(t, ids[1:], pending)
+	})
+
+	t.Run("alert", func(t *testing.T) {
+		w, db, _ := newTestWorker(t)
+		ids := insertTestWithdrawals(t, db, queue()...)
+
+		// pays as far as it goes, the send of the second withdrawal failing
+		assert.Error(t, w.Dispatch(context.Background()))
+
+		obj, err := db.GetWdObjById(ids[0])
+		require.NoError(t, err)
+		assert.Equal(t, StatusProcessing, obj.Status)
+	})
+}
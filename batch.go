@@ -0,0 +1,227 @@
+package eth_multi_transactions
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var ErrNotConserved = errors.New("withdrawals and leftover do not add up to the total")
+
+// PayoutBatch is one split of an amount into withdrawals.
+type PayoutBatch struct {
+	Id       uint64
+	Token    string   // split, empty for ether
+	Total    *big.Int // amount split
+	Leftover *big.Int // wei no withdrawal took, kept by the sender
+	Reserve  *big.Int // kept back for network fees before splitting, nil if unknown
+	Accrued  *big.Int // shares below the minimum payout of their recipient, owed to them later
+	Released *big.Int // accrued by earlier batches and paid by this one
+	Schedule string   // that generated the batch, empty if generated by hand
+	Period   uint64   // start of the period of the schedule the batch is for
+	Plan     string   // that generated the batch, empty if none
+	Version  uint64   // of the plan used
+	Created  uint64
+}
+
+// InsertBatch records b and its withdrawals objs atomically, after checking that their
+// amounts and the leftover add up to the total exactly. It sets the ids of b and objs.
+func (w *WdDB) InsertBatch(b *PayoutBatch, objs []*DbWithdrawalObj) error {
+	tx, err := w.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	id, err := w.insertBatch(tx, b, objs)
+	if err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	b.Id = id
+	return nil
+}
+
+func (w *WdDB) insertBatch(tx *leveldb.Transaction, b *PayoutBatch, objs []*DbWithdrawalObj) (uint64, error) {
+	if err := w.checkConserved(b, objs); err != nil {
+		return 0, err
+	}
+	if b.Schedule != "" {
+		if err := w.claimPeriod(tx, b); err != nil {
+			return 0, err
+		}
+	}
+
+	id, err := w.nextId(tx, "kv-batchid")
+	if err != nil {
+		return 0, err
+	}
+	if err := w.putBatch(tx, id, b); err != nil {
+		return 0, err
+	}
+
+	for _, o := range objs {
+		o.Batch = id
+	}
+	return id, w.insert(tx, objs)
+}
+
+// checkConserved checks that every wei of the batch total is paid by objs, left over, or
+// moved to or from the dust of recipients.
+func (w *WdDB) checkConserved(b *PayoutBatch, objs []*DbWithdrawalObj) error {
+	sum := big.NewInt(0).Set(b.Leftover)
+	if b.Accrued != nil {
+		sum.Add(sum, b.Accrued)
+	}
+	if b.Released != nil {
+		sum.Sub(sum, b.Released)
+	}
+	for _, o := range objs {
+		if o.Amount.Sign() < 0 {
+			return fmt.Errorf("negative amount for %s", o.Address)
+		}
+		if o.Chain != w.chain {
+			return fmt.Errorf("withdrawal for chain %q in a batch of chain %q", o.Chain, w.chain)
+		}
+		sum.Add(sum, o.Amount)
+	}
+	if b.Leftover.Sign() < 0 || sum.Cmp(b.Total) != 0 {
+		return fmt.Errorf("%w, total: %v withdrawals and leftover: %v", ErrNotConserved, b.Total, sum)
+	}
+	return nil
+}
+
+// nextId increases the counter of the db view and returns its new value, 1 for a new counter.
+func (w *WdDB) nextId(tx *leveldb.Transaction, counter string) (uint64, error) {
+	key := w.prefixed([]byte(counter))
+
+	id := uint64(0)
+	if v, err := tx.Get(key, nil); err == nil {
+		id, _ = FromBigEndianBytes(v)
+	} else if !errors.Is(err, leveldb.ErrNotFound) {
+		return 0, err
+	}
+
+	id += 1
+	return id, tx.Put(key, ToBigEndianBytes(id), nil)
+}
+
+func (w *WdDB) putBatch(tx *leveldb.Transaction, id uint64, b *PayoutBatch) error {
+	if err := tx.Put(w.key("batchtotal-", id), b.Total.Bytes(), nil); err != nil {
+		return err
+	}
+	if err := tx.Put(w.key("batchleftover-", id), b.Leftover.Bytes(), nil); err != nil {
+		return err
+	}
+	if b.Reserve != nil {
+		if err := tx.Put(w.key("batchreserve-", id), b.Reserve.Bytes(), nil); err != nil {
+			return err
+		}
+	}
+	if b.Token != "" {
+		if err := tx.Put(w.key("batchtoken-", id), []byte(b.Token), nil); err != nil {
+			return err
+		}
+	}
+	if b.Schedule != "" {
+		if err := tx.Put(w.key("batchschedule-", id), []byte(b.Schedule), nil); err != nil {
+			return err
+		}
+		if err := tx.Put(w.key("batchperiod-", id), ToBigEndianBytes(b.Period), nil); err != nil {
+			return err
+		}
+	}
+	if b.Plan != "" {
+		if err := tx.Put(w.key("batchplan-", id), []byte(b.Plan), nil); err != nil {
+			return err
+		}
+		if err := tx.Put(w.key("batchplanversion-", id), ToBigEndianBytes(b.Version), nil); err != nil {
+			return err
+		}
+	}
+	if b.Accrued != nil {
+		if err := tx.Put(w.key("batchaccrued-", id), b.Accrued.Bytes(), nil); err != nil {
+			return err
+		}
+	}
+	if b.Released != nil {
+		if err := tx.Put(w.key("batchreleased-", id), b.Released.Bytes(), nil); err != nil {
+			return err
+		}
+	}
+	return tx.Put(w.key("batchcreated-", id), ToBigEndianBytes(b.Created), nil)
+}
+
+func (w *WdDB) GetBatch(id uint64) (*PayoutBatch, error) {
+	ans := PayoutBatch{Id: id}
+
+	if v, err := w.db.Get(w.key("batchtotal-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Total = big.NewInt(0).SetBytes(v)
+	}
+
+	if v, err := w.db.Get(w.key("batchleftover-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Leftover = big.NewInt(0).SetBytes(v)
+	}
+
+	if v, err := w.getOptional(w.key("batchreserve-", id)); err != nil {
+		return nil, err
+	} else if v != nil {
+		ans.Reserve = big.NewInt(0).SetBytes(v)
+	}
+
+	if v, err := w.getOptional(w.key("batchtoken-", id)); err != nil {
+		return nil, err
+	} else {
+		ans.Token = string(v)
+	}
+
+	if v, err := w.getOptional(w.key("batchschedule-", id)); err != nil {
+		return nil, err
+	} else if v != nil {
+		ans.Schedule = string(v)
+		if v, err := w.db.Get(w.key("batchperiod-", id), nil); err != nil {
+			return nil, err
+		} else {
+			ans.Period, _ = FromBigEndianBytes(v)
+		}
+	}
+
+	if v, err := w.getOptional(w.key("batchplan-", id)); err != nil {
+		return nil, err
+	} else if v != nil {
+		ans.Plan = string(v)
+		if v, err := w.db.Get(w.key("batchplanversion-", id), nil); err != nil {
+			return nil, err
+		} else {
+			ans.Version, _ = FromBigEndianBytes(v)
+		}
+	}
+
+	if v, err := w.getOptional(w.key("batchaccrued-", id)); err != nil {
+		return nil, err
+	} else if v != nil {
+		ans.Accrued = big.NewInt(0).SetBytes(v)
+	}
+
+	if v, err := w.getOptional(w.key("batchreleased-", id)); err != nil {
+		return nil, err
+	} else if v != nil {
+		ans.Released = big.NewInt(0).SetBytes(v)
+	}
+
+	if v, err := w.db.Get(w.key("batchcreated-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Created, _ = FromBigEndianBytes(v)
+	}
+	return &ans, nil
+}
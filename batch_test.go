@@ -0,0 +1,56 @@
+package eth_multi_transactions
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWdDB_InsertBatch(t *testing.T) {
+	db := newTestDB(t)
+
+	objs := []*DbWithdrawalObj{
+		{Address: "a", Amount: big.NewInt(4)},
+		{Address: "b", Amount: big.NewInt(3)},
+	}
+	err := db.InsertBatch(&PayoutBatch{Total: big.NewInt(10), Leftover: big.NewInt(2)}, objs)
+	assert.True(t, errors.Is(err, ErrNotConserved))
+	ids, err := db.GetRecordsId()
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+
+	b := &PayoutBatch{Total: big.NewInt(10), Leftover: big.NewInt(3), Reserve: big.NewInt(5), Created: 7}
+	require.NoError(t, db.InsertBatch(b, objs))
+	assert.Equal(t, uint64(1), b.Id)
+
+	got, err := db.GetBatch(b.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "10", got.Total.String())
+	assert.Equal(t, "3", got.Leftover.String())
+	assert.Equal(t, "5", got.Reserve.String())
+	assert.Equal(t, uint64(7), got.Created)
+
+	for _, o := range objs {
+		obj, err := db.GetWdObjById(o.Id)
+		require.NoError(t, err)
+		assert.Equal(t, b.Id, obj.Batch)
+		assert.Equal(t, o.Amount.String(), obj.Amount.String())
+	}
+
+	// withdrawals inserted one by one belong to no batch
+	single := &DbWithdrawalObj{Address: "c", Amount: big.NewInt(1)}
+	require.NoError(t, db.BatchInsert([]*DbWithdrawalObj{single}))
+	obj, err := db.GetWdObjById(single.Id)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), obj.Batch)
+
+	b2 := &PayoutBatch{Total: big.NewInt(0), Leftover: big.NewInt(0)}
+	require.NoError(t, db.InsertBatch(b2, nil))
+	assert.Equal(t, uint64(2), b2.Id)
+	got, err = db.GetBatch(b2.Id)
+	require.NoError(t, err)
+	assert.Nil(t, got.Reserve)
+}
@@ -0,0 +1,216 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+// nodes reject a replacement unless its fee is at least 10% above the original
+var replacementBump = big.NewInt(115) // percent
+
+// CancelWithdrawal replaces the broadcast transaction of withdrawal id with a zero-value
+// self-transfer at the same nonce and a higher gas price. The withdrawal, with every other
+// one paid by the same disperse call, stays in StatusCancelling until ResolveCancellation
+// sees either transaction mined. The cancellation is recorded before it is broadcast, and
+// the withdrawals go back to StatusProcessing only if the node surely rejected it. It
+// returns the cancellation.
+func CancelWithdrawal(
+	ctx context.Context,
+	db *WdDB,
+	ethc ChainClient,
+	id uint64,
+	fromAddr common.Address,
+	prvKey *ecdsa.PrivateKey,
+	chainID *big.Int,
+	policy FeePolicy,
+) (*types.Transaction, error) {
+	obj, err := db.GetWdObjById(id)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Status != StatusProcessing || obj.Hash == "" {
+		return nil, fmt.Errorf("withdrawal is not broadcast, id: %v status: %v", id, obj.Status)
+	}
+
+	ids, err := db.sharingTransaction(obj.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed []uint64
+	revert := func() {
+		for _, id := range claimed {
+			if err := db.SetCancelTransaction(id, "", nil); err != nil {
+				logger.Error("failed to clear cancel hash", "err", err, "id", id)
+			}
+			if err := db.CompareAndSwapStatus(db.StatusKey(id), StatusCancelling, StatusProcessing); err != nil {
+				logger.Error("failed to CAS status", "err", err, "id", id)
+			}
+		}
+	}
+	for _, id := range ids {
+		if err := db.CompareAndSwapStatus(db.StatusKey(id), StatusProcessing, StatusCancelling); err != nil {
+			revert()
+			return nil, err
+		}
+		claimed = append(claimed, id)
+	}
+
+	tx, err := SignCancelTransaction(ctx, obj, ethc, fromAddr, prvKey, chainID, policy)
+	if err != nil {
+		revert()
+		return nil, err
+	}
+
+	// persist before broadcasting so that the tracker can send it again once dropped
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		revert()
+		return nil, err
+	}
+	for _, id := range ids {
+		if err := db.SetCancelTransaction(id, tx.Hash().Hex(), raw); err != nil {
+			revert()
+			return nil, err
+		}
+	}
+
+	if err := broadcast(ctx, ethc, tx); err != nil {
+		if rejected(ctx, ethc, tx, err) {
+			revert()
+			return nil, err
+		}
+		logger.Warn("broadcast outcome unknown, tracking the cancellation", "err", err, "id", id, "txid", tx.Hash().Hex())
+		return nil, err
+	}
+	return tx, nil
+}
+
+// SignCancelTransaction signs the zero-value self-transfer replacing the transaction of obj,
+// priced by policy and at least replacementBump percent of the original. It fails when
+// the node would only take a replacement priced above the max of policy.
+func SignCancelTransaction(
+	ctx context.Context,
+	obj *DbWithdrawalObj,
+	ethc ChainClient,
+	fromAddr common.Address,
+	prvKey *ecdsa.PrivateKey,
+	chainID *big.Int,
+	policy FeePolicy,
+) (*types.Transaction, error) {
+	suggested, err := ethc.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gasPrice, err := policy.Apply(suggested)
+	if err != nil {
+		return nil, err
+	}
+
+	original, isPending, err := ethc.TransactionByHash(ctx, common.HexToHash(obj.Hash))
+	switch {
+	case errors.Is(err, ethereum.NotFound):
+		// dropped from the pool, the nonce may still be taken later
+	case err != nil:
+		return nil, err
+	case !isPending:
+		return nil, fmt.Errorf("transaction already mined, txid: %s", obj.Hash)
+	default:
+		bumped := big.NewInt(0).Mul(original.GasPrice(), replacementBump)
+		bumped.Div(bumped, big.NewInt(100))
+		if policy.Max != nil && bumped.Cmp(policy.Max) > 0 {
+			return nil, fmt.Errorf("replacement gas price above max, price: %v max: %v", bumped, policy.Max)
+		}
+		if bumped.Cmp(gasPrice) > 0 {
+			gasPrice = bumped
+		}
+	}
+
+	logger.Info("cancel", "nonce", obj.Nonce, "gasprice", gasPrice, "txid", obj.Hash)
+	tx := types.NewTx(&types.LegacyTx{
+		Nonce:    obj.Nonce,
+		To:       &fromAddr,
+		Value:    big.NewInt(0),
+		Gas:      21000,
+		GasPrice: gasPrice,
+		Data:     []byte{},
+	})
+
+	return types.SignTx(tx, types.LatestSignerForChainID(chainID), prvKey)
+}
+
+// ResolveCancellation checks which of the two transactions sharing the nonce of withdrawal
+// id has been mined, and settles every withdrawal cancelled along with it. They become
+// StatusCancelled, bearing the fee of the cancellation, if it won, and go back to
+// StatusProcessing if the original payout won. It returns the resulting status of id.
+func ResolveCancellation(ctx context.Context, db *WdDB, ethc ChainClient, id uint64) (uint64, error) {
+	obj, err := db.GetWdObjById(id)
+	if err != nil {
+		return 0, err
+	}
+	if obj.Status != StatusCancelling {
+		return obj.Status, nil
+	}
+
+	ids, err := db.sharingCancellation(obj.CancelHash)
+	if err != nil {
+		return obj.Status, err
+	}
+
+	if receipt, err := minedReceipt(ctx, ethc, obj.CancelHash); err != nil {
+		return obj.Status, err
+	} else if receipt != nil {
+		gasPrice, err := effectiveGasPrice(ctx, ethc, obj.CancelHash, receipt)
+		if err != nil {
+			return obj.Status, err
+		}
+		fee := big.NewInt(0).Mul(gasPrice, big.NewInt(0).SetUint64(receipt.GasUsed))
+		for _, id := range ids {
+			if err := db.SetBlock(id, receipt.BlockNumber.Uint64(), receipt.BlockHash.Hex()); err != nil {
+				return obj.Status, err
+			}
+			if err := db.SetFee(id, receipt.GasUsed, gasPrice, feeShare(fee, ids, id)); err != nil {
+				return obj.Status, err
+			}
+			if err := db.CompareAndSwapStatus(db.StatusKey(id), StatusCancelling, StatusCancelled); err != nil {
+				return obj.Status, err
+			}
+		}
+		return StatusCancelled, nil
+	}
+
+	if receipt, err := minedReceipt(ctx, ethc, obj.Hash); err != nil {
+		return obj.Status, err
+	} else if receipt != nil {
+		logger.Info("original transaction mined before cancellation", "id", id, "txid", obj.Hash)
+		for _, id := range ids {
+			if err := db.CompareAndSwapStatus(db.StatusKey(id), StatusCancelling, StatusProcessing); err != nil {
+				return obj.Status, err
+			}
+		}
+		return StatusProcessing, nil
+	}
+	return obj.Status, nil
+}
+
+// minedReceipt returns the receipt of transaction txid, nil if it is not mined.
+func minedReceipt(ctx context.Context, ethc ChainClient, txid string) (*types.Receipt, error) {
+	if txid == "" {
+		return nil, nil
+	}
+
+	receipt, err := ethc.TransactionReceipt(ctx, common.HexToHash(txid))
+	if errors.Is(err, ethereum.NotFound) {
+		return nil, nil
+	}
+	return receipt, err
+}
@@ -0,0 +1,258 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestWdDB_Cancelling(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	defer ldb.Close()
+
+	db := NewWithdrawalDB(ldb)
+	require.NoError(t, db.GetOrSet([]byte("kv-id"), ToBigEndianBytes(1)))
+	require.NoError(t, db.BatchInsert([]*DbWithdrawalObj{
+		{Address: "0x0000000000000000000000000000000000006001", Amount: big.NewInt(10)},
+		{Address: "0x0000000000000000000000000000000000006002", Amount: big.NewInt(20)},
+	}))
+	ids, err := db.GetUnhandledRecordsId()
+	require.NoError(t, err)
+	require.Len(t, ids, 2)
+
+	// only a broadcast withdrawal is cancelled, its nonce replaced by the cancellation
+	key := append([]byte("status-"), ToBigEndianBytes(ids[0])...)
+	require.NoError(t, db.UpdateTransaction(ids[0], 7, "0x01", nil))
+	require.NoError(t, db.CompareAndSwapStatus(key, StatusInit, StatusProcessing))
+	assert.Error(t, db.CompareAndSwapStatus(key, StatusInit, StatusCancelling))
+	require.NoError(t, db.CompareAndSwapStatus(key, StatusProcessing, StatusCancelling))
+	require.NoError(t, db.SetCancelTransaction(ids[0], "0x02", nil))
+
+	cancelling, err := db.GetRecordsIdByStatus(StatusCancelling)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{ids[0]}, cancelling)
+	pending, err := db.GetUnhandledRecordsId()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{ids[1]}, pending)
+
+	obj, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusCancelling, obj.Status)
+	assert.Equal(t, uint64(7), obj.Nonce)
+	assert.Equal(t, "0x01", obj.Hash)
+	assert.Equal(t, "0x02", obj.CancelHash)
+
+	// records without a cancellation read as such
+	obj, err = db.GetWdObjById(ids[1])
+	require.NoError(t, err)
+	assert.Empty(t, obj.CancelHash)
+}
+
+func TestWorker_CancelBatch(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	contract := deployTestContract(t, client.SimulatedBackend, w.prvKey, "Disperse")
+	w.Disperse = &contract
+	w.BatchSize = 2
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000006001", Amount: big.NewInt(10)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000006002", Amount: big.NewInt(20)},
+	)
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	// the simulated pool takes no replacement, drop the batch to let the cancellation in
+	client.Rollback()
+	cancel, err := w.Cancel(context.Background(), ids[0])
+	require.NoError(t, err)
+
+	// cancelling one withdrawal of a batch cancels the whole disperse call
+	for _, id := range ids {
+		obj, err := db.GetWdObjById(id)
+		require.NoError(t, err)
+		assert.Equal(t, StatusCancelling, obj.Status)
+		assert.Equal(t, cancel.Hash().Hex(), obj.CancelHash)
+	}
+
+	client.Commit()
+	require.NoError(t, w.TrackOnce(context.Background()))
+	for _, id := range ids {
+		obj, err := db.GetWdObjById(id)
+		require.NoError(t, err)
+		assert.Equal(t, StatusCancelled, obj.Status)
+	}
+}
+
+func TestCancelWithdrawal(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	flaky := &flakyClient{SimulatedClient: client}
+	w.ethc = flaky
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000006101", Amount: big.NewInt(10)},
+	)
+	_, err := w.Cancel(context.Background(), ids[0])
+	assert.Error(t, err, "not broadcast yet")
+
+	require.NoError(t, w.Dispatch(context.Background()))
+	client.Rollback()
+
+	// a rejected cancellation leaves the withdrawal in flight
+	flaky.err = errors.New("nonce too low")
+	_, err = w.Cancel(context.Background(), ids[0])
+	assert.Error(t, err)
+	obj, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessing, obj.Status)
+	assert.Empty(t, obj.CancelHash)
+
+	// one the node may hold is recorded before it is broadcast, and followed
+	flaky.err = context.DeadlineExceeded
+	flaky.deliver = true
+	_, err = w.Cancel(context.Background(), ids[0])
+	assert.Error(t, err)
+	obj, err = db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusCancelling, obj.Status)
+	assert.NotEmpty(t, obj.CancelHash)
+}
+
+func TestSignCancelTransaction(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000006401", Amount: big.NewInt(10)},
+	)
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	obj, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	original, _, err := client.TransactionByHash(context.Background(), common.HexToHash(obj.Hash))
+	require.NoError(t, err)
+
+	// the replacement outbids the original even above the price of the policy
+	cancel, err := SignCancelTransaction(context.Background(), obj, client, w.fromAddr, w.prvKey, simChainID, FeePolicy{})
+	require.NoError(t, err)
+	minimum := big.NewInt(0).Mul(original.GasPrice(), replacementBump)
+	minimum.Div(minimum, big.NewInt(100))
+	assert.Equal(t, minimum.String(), cancel.GasPrice().String())
+
+	// but not above its max
+	_, err = SignCancelTransaction(context.Background(), obj, client, w.fromAddr, w.prvKey, simChainID, FeePolicy{Max: original.GasPrice()})
+	assert.Error(t, err)
+}
+
+func TestWorker_RebroadcastCancel(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	flaky := &flakyClient{SimulatedClient: client}
+	w.ethc = flaky
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000006501", Amount: big.NewInt(10)},
+	)
+	require.NoError(t, w.Dispatch(context.Background()))
+	client.Rollback()
+
+	// a node already holding the cancellation accepts it all the same
+	flaky.err = errors.New("already known")
+	flaky.deliver = true
+	cancel, err := w.Cancel(context.Background(), ids[0])
+	require.NoError(t, err)
+	flaky.err = nil
+
+	// a dropped cancellation is sent again until either transaction is mined
+	client.Rollback()
+	require.NoError(t, w.TrackOnce(context.Background()))
+	client.Commit()
+	require.NoError(t, w.TrackOnce(context.Background()))
+
+	obj, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusCancelled, obj.Status)
+	assert.Equal(t, cancel.Hash().Hex(), obj.CancelHash)
+}
+
+func TestResolveCancellation(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	flaky := &flakyClient{SimulatedClient: client}
+	w.ethc = flaky
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000006201", Amount: big.NewInt(10)},
+	)
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	// the original payout wins over a cancellation that never reached the pool
+	flaky.err = context.DeadlineExceeded
+	_, err := w.Cancel(context.Background(), ids[0])
+	assert.Error(t, err)
+	status, err := ResolveCancellation(context.Background(), db, client, ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusCancelling, status, "neither is mined")
+
+	client.Commit()
+	status, err = ResolveCancellation(context.Background(), db, client, ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessing, status)
+
+	// the cancellation wins and bears its fee
+	flaky.err = nil
+	ids = append(ids, insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000006202", Amount: big.NewInt(20)},
+	)...)
+	require.NoError(t, w.Dispatch(context.Background()))
+	client.Rollback()
+	cancel, err := w.Cancel(context.Background(), ids[1])
+	if !assert.NoError(t, err) {
+		return
+	}
+	client.Commit()
+	status, err = ResolveCancellation(context.Background(), db, client, ids[1])
+	require.NoError(t, err)
+	assert.Equal(t, StatusCancelled, status)
+
+	obj, err := db.GetWdObjById(ids[1])
+	require.NoError(t, err)
+	assert.Equal(t, StatusCancelled, obj.Status)
+	assert.Equal(t, cancel.Hash().Hex(), obj.CancelHash)
+	assert.Equal(t, uint64(21000), obj.GasUsed)
+	assert.Equal(t, big.NewInt(0).Mul(cancel.GasPrice(), big.NewInt(21000)).String(), obj.Fee.String())
+}
+
+func TestWorker_RecheckCancelled(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000006301", Amount: big.NewInt(10)},
+	)
+
+	parent := client.Blockchain().CurrentBlock().Hash()
+	require.NoError(t, w.Dispatch(context.Background()))
+	client.Rollback()
+	_, err := w.Cancel(context.Background(), ids[0])
+	require.NoError(t, err)
+	client.Commit()
+	require.NoError(t, w.TrackOnce(context.Background()))
+
+	obj, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusCancelled, obj.Status)
+	assert.NotEmpty(t, obj.BlockHash)
+
+	// a side chain without the cancellation leaves the nonce open again
+	require.NoError(t, client.Fork(context.Background(), parent))
+	client.Commit()
+	client.Commit()
+	require.NoError(t, w.TrackOnce(context.Background()))
+
+	obj, err = db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusCancelling, obj.Status)
+	assert.Empty(t, obj.BlockHash)
+	assert.Nil(t, obj.Fee)
+}
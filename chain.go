@@ -0,0 +1,143 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var ErrChainMismatch = errors.New("chain id mismatch")
+
+var chainIDKey = []byte("kv-chainid")
+
+// DetectChainID asks the node which chain it is on. Nodes predating eth_chainId are asked
+// for their network id instead, which equals the chain id on public networks.
+func DetectChainID(ctx context.Context, c ChainClient) (*big.Int, error) {
+	id, err := c.ChainID(ctx)
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) {
+		return c.NetworkID(ctx)
+	}
+	return id, err
+}
+
+// GetChainID returns the chain id the db view was first used with, or nil for a new one.
+func (w *WdDB) GetChainID() (*big.Int, error) {
+	v, err := w.getOptional(w.prefixed(chainIDKey))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return big.NewInt(0).SetBytes(v), nil
+}
+
+// CheckChainID records chainID in a new db and fails with ErrChainMismatch if the db
+// holds withdrawals of another chain.
+func (w *WdDB) CheckChainID(chainID *big.Int) error {
+	tx, err := w.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	key := w.prefixed(chainIDKey)
+	v, err := tx.Get(key, nil)
+	switch {
+	case errors.Is(err, leveldb.ErrNotFound):
+		if err := tx.Put(key, chainID.Bytes(), nil); err != nil {
+			tx.Discard()
+			return err
+		}
+		return tx.Commit()
+	case err != nil:
+		tx.Discard()
+		return err
+	}
+	tx.Discard()
+
+	if recorded := big.NewInt(0).SetBytes(v); recorded.Cmp(chainID) != 0 {
+		return fmt.Errorf("%w, db: %v expected: %v", ErrChainMismatch, recorded, chainID)
+	}
+	return nil
+}
+
+// VerifyChainID detects the chain of the node and checks it against the configured chain
+// id, if any, and the one recorded in the db. It returns the chain id to sign with.
+func VerifyChainID(ctx context.Context, db *WdDB, c ChainClient, configured *big.Int) (*big.Int, error) {
+	detected, err := DetectChainID(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect chain id: %w", err)
+	}
+	if configured != nil && configured.Sign() != 0 && configured.Cmp(detected) != 0 {
+		return nil, fmt.Errorf("%w, node: %v configured: %v", ErrChainMismatch, detected, configured)
+	}
+	if err := db.CheckChainID(detected); err != nil {
+		return nil, err
+	}
+	return detected, nil
+}
+
+// ChainConfig describes an EVM chain withdrawals are paid on.
+type ChainConfig struct {
+	Name          string         `json:"name"`          // namespace of its withdrawals in the db, empty for the default chain
+	Endpoints     []string       `json:"endpoints"`     // in order of preference
+	ChainID       int64          `json:"chainId"`       // expected chain id, 0 to take the node's
+	Fee           FeePolicy      `json:"fee"`           // premium and cap of the gas price
+	Gas           GasLimitPolicy `json:"gas"`           // margin and ceiling of the gas limit
+	Confirmations uint64         `json:"confirmations"` // blocks before a payout is final
+	NativeSymbol  string         `json:"nativeSymbol"`  // of the coin paying gas, for logs
+	Disperse      string         `json:"disperse"`      // disperse contract paying in batches, empty to pay one by one
+	Reserve       ReservePolicy  `json:"reserve"`       // kept back for network fees when splitting the balance
+}
+
+// LoadChains reads the chain registry, a JSON array of ChainConfig, from path.
+func LoadChains(path string) ([]ChainConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chains []ChainConfig
+	if err := json.Unmarshal(raw, &chains); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("no chain in %s", path)
+	}
+
+	seen := make(map[string]bool)
+	for i := range chains {
+		c := &chains[i]
+		if seen[c.Name] {
+			return nil, fmt.Errorf("duplicate chain %q", c.Name)
+		}
+		seen[c.Name] = true
+
+		if len(c.Endpoints) == 0 {
+			return nil, fmt.Errorf("no endpoint for chain %q", c.Name)
+		}
+		if c.Fee.Premium == nil {
+			c.Fee.Premium = DefaultFee.Premium
+		}
+		if c.Gas.Multiplier == 0 {
+			c.Gas = DefaultGasLimit
+		}
+		if c.Confirmations == 0 {
+			c.Confirmations = 3
+		}
+		if c.NativeSymbol == "" {
+			c.NativeSymbol = "ETH"
+		}
+		if c.Reserve.Kind == "" {
+			c.Reserve = DefaultReserve
+		}
+		if err := c.Reserve.validate(); err != nil {
+			return nil, fmt.Errorf("chain %q: %w", c.Name, err)
+		}
+	}
+	return chains, nil
+}
@@ -0,0 +1,137 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// foreignClient reports another chain than the one it is connected to
+type foreignClient struct {
+	ChainClient
+	chainID int64
+}
+
+func (c *foreignClient) ChainID(context.Context) (*big.Int, error) {
+	return big.NewInt(c.chainID), nil
+}
+
+func TestVerifyChainID(t *testing.T) {
+	sim, _, _ := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+	db := newTestDB(t)
+
+	_, err := VerifyChainID(context.Background(), db, client, big.NewInt(1))
+	assert.True(t, errors.Is(err, ErrChainMismatch))
+
+	// auto-detected and recorded in a new db
+	id, err := VerifyChainID(context.Background(), db, client, nil)
+	require.NoError(t, err)
+	assert.Equal(t, simChainID.String(), id.String())
+
+	recorded, err := db.GetChainID()
+	require.NoError(t, err)
+	assert.Equal(t, simChainID.String(), recorded.String())
+
+	// the db refuses a node on another chain
+	_, err = VerifyChainID(context.Background(), db, &foreignClient{client, 5}, nil)
+	assert.True(t, errors.Is(err, ErrChainMismatch))
+}
+
+func TestWorker_ChainMismatch(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000006001", Amount: big.NewInt(1)},
+	)
+
+	w.ethc = &foreignClient{client, 1}
+	assert.True(t, errors.Is(w.Dispatch(context.Background()), ErrChainMismatch))
+
+	pending, err := db.GetUnhandledRecordsId()
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+}
+
+func TestMultiClient_ChainID(t *testing.T) {
+	sim, _, _ := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+
+	m := NewMultiClient([]string{"a", "b"}, []ChainClient{client, client})
+	id, err := m.ChainID(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, simChainID.String(), id.String())
+
+	m = NewMultiClient([]string{"a", "b"}, []ChainClient{client, &foreignClient{client, 1}})
+	_, err = m.ChainID(context.Background())
+	assert.Error(t, err)
+}
+
+func TestWdDB_ForChain(t *testing.T) {
+	db := newTestDB(t)
+	side := db.ForChain("side")
+	require.NoError(t, side.GetOrSet([]byte("kv-id"), ToBigEndianBytes(1)))
+
+	// records are routed to the namespace of their chain
+	require.NoError(t, db.BatchInsert([]*DbWithdrawalObj{
+		{Address: "0x0000000000000000000000000000000000007001", Amount: big.NewInt(1)},
+		{Address: "0x0000000000000000000000000000000000007002", Amount: big.NewInt(2), Chain: "side"},
+	}))
+
+	ids, err := db.GetUnhandledRecordsId()
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+
+	sideIds, err := side.GetUnhandledRecordsId()
+	require.NoError(t, err)
+	require.Len(t, sideIds, 1)
+
+	// ids are per chain
+	assert.Equal(t, ids, sideIds)
+
+	obj, err := side.GetWdObjById(sideIds[0])
+	require.NoError(t, err)
+	assert.Equal(t, "side", obj.Chain)
+	assert.Equal(t, "2", obj.Amount.String())
+
+	// a chain without its counters is refused
+	err = db.BatchInsert([]*DbWithdrawalObj{{Address: "0x0000000000000000000000000000000000007003", Amount: big.NewInt(3), Chain: "unknown"}})
+	assert.Error(t, err)
+
+	// each chain records its own chain id
+	require.NoError(t, db.CheckChainID(big.NewInt(1)))
+	require.NoError(t, side.CheckChainID(big.NewInt(137)))
+	assert.True(t, errors.Is(side.CheckChainID(big.NewInt(1)), ErrChainMismatch))
+}
+
+func TestLoadChains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chains.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "", "endpoints": ["http://mainnet"], "chainId": 1},
+		{"name": "polygon", "endpoints": ["http://polygon"], "chainId": 137, "fee": {"premium": 30000000000, "max": 500000000000}, "gas": {"multiplier": 1.5, "ceiling": 5000000}, "confirmations": 64, "nativeSymbol": "MATIC"}
+	]`), 0644))
+
+	chains, err := LoadChains(path)
+	require.NoError(t, err)
+	require.Len(t, chains, 2)
+	assert.Equal(t, uint64(3), chains[0].Confirmations)
+	assert.Equal(t, DefaultFee.Premium.String(), chains[0].Fee.Premium.String())
+	assert.Equal(t, DefaultGasLimit, chains[0].Gas)
+	assert.Equal(t, "MATIC", chains[1].NativeSymbol)
+	assert.Equal(t, GasLimitPolicy{Multiplier: 1.5, Ceiling: 5000000}, chains[1].Gas)
+
+	price, err := chains[1].Fee.Apply(big.NewInt(100e9))
+	require.NoError(t, err)
+	assert.Equal(t, "130000000000", price.String())
+	_, err = chains[1].Fee.Apply(big.NewInt(500e9))
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name": "a", "endpoints": ["x"]}, {"name": "a", "endpoints": ["y"]}]`), 0644))
+	_, err = LoadChains(path)
+	assert.Error(t, err)
+}
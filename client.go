@@ -0,0 +1,156 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ChainClient is the part of the node API the project uses. *ethclient.Client
+// implements it, SimulatedClient runs the same code against an in-memory chain.
+type ChainClient interface {
+	ChainID(ctx context.Context) (*big.Int, error)
+	NetworkID(ctx context.Context) (*big.Int, error)
+
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error)
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error)
+	CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+	PendingCallContract(ctx context.Context, msg ethereum.CallMsg) ([]byte, error)
+
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error)
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// SimulatedClient adapts backends.SimulatedBackend to ChainClient. With AutoCommit set
+// every accepted transaction is mined into its own block, like a development node.
+type SimulatedClient struct {
+	*backends.SimulatedBackend
+	AutoCommit bool
+}
+
+func NewSimulatedClient(sim *backends.SimulatedBackend) *SimulatedClient {
+	return &SimulatedClient{SimulatedBackend: sim}
+}
+
+func (c *SimulatedClient) ChainID(context.Context) (*big.Int, error) {
+	return new(big.Int).Set(c.Blockchain().Config().ChainID), nil
+}
+
+func (c *SimulatedClient) NetworkID(ctx context.Context) (*big.Int, error) {
+	return c.ChainID(ctx)
+}
+
+func (c *SimulatedClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if err := c.SimulatedBackend.SendTransaction(ctx, tx); err != nil {
+		return err
+	}
+	if c.AutoCommit {
+		c.Commit()
+	}
+	return nil
+}
+
+// timeoutClient bounds every call to the wrapped client by its own deadline.
+type timeoutClient struct {
+	c       ChainClient
+	timeout time.Duration
+}
+
+// WithCallTimeout returns a ChainClient giving up on each call after timeout, so a hung
+// node cannot block its caller. The caller's own cancellation is honoured as well.
+func WithCallTimeout(c ChainClient, timeout time.Duration) ChainClient {
+	if timeout <= 0 {
+		return c
+	}
+	return &timeoutClient{c: c, timeout: timeout}
+}
+
+func (t *timeoutClient) ChainID(ctx context.Context) (*big.Int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.ChainID(ctx)
+}
+
+func (t *timeoutClient) NetworkID(ctx context.Context) (*big.Int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.NetworkID(ctx)
+}
+
+func (t *timeoutClient) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.BalanceAt(ctx, account, blockNumber)
+}
+
+func (t *timeoutClient) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.NonceAt(ctx, account, blockNumber)
+}
+
+func (t *timeoutClient) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.PendingNonceAt(ctx, account)
+}
+
+func (t *timeoutClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.SuggestGasPrice(ctx)
+}
+
+func (t *timeoutClient) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.EstimateGas(ctx, msg)
+}
+
+func (t *timeoutClient) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.CallContract(ctx, msg, blockNumber)
+}
+
+func (t *timeoutClient) PendingCallContract(ctx context.Context, msg ethereum.CallMsg) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.PendingCallContract(ctx, msg)
+}
+
+func (t *timeoutClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.SendTransaction(ctx, tx)
+}
+
+func (t *timeoutClient) TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.TransactionByHash(ctx, hash)
+}
+
+func (t *timeoutClient) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.TransactionReceipt(ctx, txHash)
+}
+
+func (t *timeoutClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return t.c.HeaderByNumber(ctx, number)
+}
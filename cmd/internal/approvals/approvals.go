@@ -0,0 +1,93 @@
+// Package approvals holds the approval flags shared by the withdrawal commands.
+package approvals
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	emt "github.com/haihongs/eth-multi-transactions"
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+// Reviewer reviews withdrawals as the identity it authenticates with, like the admin API
+// of the worker holding the db.
+type Reviewer interface {
+	Approve(id uint64) error
+	Reject(id uint64, reason string) error
+	ApproveBatch(id uint64) error
+	RejectBatch(id uint64, reason string) error
+	SetApprovalPolicy(p *emt.ApprovalPolicy) error
+}
+
+// Command is what the approval flags ask for.
+type Command struct {
+	Chain        string
+	PolicyFile   string
+	Approve      uint64
+	Reject       uint64
+	ApproveBatch uint64
+	RejectBatch  uint64
+	Reason       string
+}
+
+// RegisterFlags defines the approval flags on fs.
+func (c *Command) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.PolicyFile, "approval-policy", "", "store the approval policy in this JSON file, applied to the withdrawals inserted from now on, and exit")
+	fs.Uint64Var(&c.Approve, "approve", 0, "approve the withdrawal awaiting approval with this id as the identity of -admin-token and exit")
+	fs.Uint64Var(&c.Reject, "reject", 0, "reject the withdrawal awaiting approval with this id as the identity of -admin-token and exit")
+	fs.Uint64Var(&c.ApproveBatch, "approve-batch", 0, "approve every withdrawal awaiting approval of the payout batch with this id as the identity of -admin-token and exit")
+	fs.Uint64Var(&c.RejectBatch, "reject-batch", 0, "reject every withdrawal awaiting approval of the payout batch with this id as the identity of -admin-token and exit")
+	fs.StringVar(&c.Reason, "reason", "", "why -reject or -reject-batch rejects")
+	fs.StringVar(&c.Chain, "approval-chain", "", "chain of the approval commands")
+}
+
+// Set reports whether an approval flag was given.
+func (c *Command) Set() bool {
+	return c.PolicyFile != "" || c.Approve != 0 || c.Reject != 0 || c.ApproveBatch != 0 || c.RejectBatch != 0
+}
+
+// Run stores the approval policy file, then makes the reviews asked for, through r.
+func (c *Command) Run(r Reviewer) error {
+	if c.PolicyFile != "" {
+		raw, err := os.ReadFile(c.PolicyFile)
+		if err != nil {
+			return err
+		}
+		var policy emt.ApprovalPolicy
+		if err := json.Unmarshal(raw, &policy); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", c.PolicyFile, err)
+		}
+		if err := r.SetApprovalPolicy(&policy); err != nil {
+			return err
+		}
+		logger.Info("approval policy changed", "rules", len(policy.Rules))
+	}
+
+	if c.Approve != 0 {
+		if err := r.Approve(c.Approve); err != nil {
+			return err
+		}
+		logger.Info("withdrawal approved", "id", c.Approve)
+	}
+	if c.Reject != 0 {
+		if err := r.Reject(c.Reject, c.Reason); err != nil {
+			return err
+		}
+		logger.Info("withdrawal rejected", "id", c.Reject)
+	}
+	if c.ApproveBatch != 0 {
+		if err := r.ApproveBatch(c.ApproveBatch); err != nil {
+			return err
+		}
+		logger.Info("batch approved", "batch", c.ApproveBatch)
+	}
+	if c.RejectBatch != 0 {
+		if err := r.RejectBatch(c.RejectBatch, c.Reason); err != nil {
+			return err
+		}
+		logger.Info("batch rejected", "batch", c.RejectBatch)
+	}
+	return nil
+}
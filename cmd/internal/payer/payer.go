@@ -0,0 +1,465 @@
+// Package payer holds the workers, flags and shutdown shared by the withdrawal commands.
+package payer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	emt "github.com/haihongs/eth-multi-transactions"
+	"github.com/haihongs/eth-multi-transactions/cmd/internal/approvals"
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+// every worker tracks its transactions, renewing its lease, at this interval
+const trackInterval = 5 * time.Second
+
+// Flags are the worker flags shared by the withdrawal commands.
+type Flags struct {
+	CancelId      uint64
+	CancelChain   string
+	MaxInFlight   int
+	Disperse      string
+	BatchSize     int
+	Gas           emt.GasLimitPolicy
+	ChainID       int64
+	Quorum        int
+	CallTimeout   time.Duration
+	DrainTimeout  time.Duration
+	Owner         string
+	LeaseTTL      time.Duration
+	LeaseFile     string
+	ChainsFile    string
+	PriorityId    uint64
+	Priority      uint64
+	PriorityChain string
+	Admin         string
+	AdminTokens   string
+	AdminToken    string
+	BalancePolicy string
+	Export        string
+
+	exports []export
+}
+
+// export is a CSV file written along -export.
+type export struct {
+	path  *string
+	what  string
+	write func(io.Writer, ...*emt.WdDB) error
+}
+
+// RegisterFlags defines the worker flags on fs.
+func (f *Flags) RegisterFlags(fs *flag.FlagSet) {
+	fs.Uint64Var(&f.CancelId, "cancel", 0, "cancel the broadcast withdrawal with this id and exit")
+	fs.IntVar(&f.MaxInFlight, "max-inflight", 16, "max withdrawals broadcast but not yet confirmed")
+	fs.StringVar(&f.Disperse, "disperse", "", "address of a disperse contract to pay withdrawals in batches")
+	fs.IntVar(&f.BatchSize, "batch-size", 100, "max withdrawals per disperse call")
+	f.Gas = emt.DefaultGasLimit
+	fs.Float64Var(&f.Gas.Multiplier, "gas-multiplier", f.Gas.Multiplier, "safety multiplier applied to gas estimates")
+	fs.Uint64Var(&f.Gas.Ceiling, "gas-ceiling", f.Gas.Ceiling, "max gas limit of a single transaction")
+	fs.Int64Var(&f.ChainID, "chain-id", 0, "chain id to pay on, refuse to run against another chain; 0 to take the node's")
+	fs.IntVar(&f.Quorum, "quorum", 1, "endpoints that must agree on balances and receipts")
+	fs.DurationVar(&f.CallTimeout, "call-timeout", 30*time.Second, "deadline of a single call to a node")
+	fs.DurationVar(&f.DrainTimeout, "drain-timeout", time.Minute, "time given to in-flight work on shutdown")
+	fs.StringVar(&f.Owner, "owner", defaultOwner(), "name of this worker in the lease, the same across restarts")
+	fs.DurationVar(&f.LeaseTTL, "lease-ttl", 0, "hold a lease renewed within this ttl, 0 to disable")
+	fs.StringVar(&f.LeaseFile, "lease-file", "", "hold the lease in this file on storage shared by every worker instead of the db")
+	fs.StringVar(&f.ChainsFile, "chains", "", "JSON registry of the chains to pay on, the flags above describe the only chain if unset")
+	fs.StringVar(&f.CancelChain, "cancel-chain", "", "chain of the withdrawal to cancel")
+	fs.Uint64Var(&f.PriorityId, "set-priority", 0, "change the priority of the pending withdrawal with this id to -priority and exit")
+	fs.Uint64Var(&f.Priority, "priority", 0, "priority set by -set-priority, higher is paid first")
+	fs.StringVar(&f.PriorityChain, "priority-chain", "", "chain of the withdrawal of -set-priority")
+	fs.StringVar(&f.Admin, "admin", "", "address of the admin API, served by the worker and called by the commands editing its db; loopback only without a host")
+	fs.StringVar(&f.AdminTokens, "admin-tokens", "", "JSON object of the identities allowed to call the admin API served with -admin and their bearer tokens")
+	fs.StringVar(&f.AdminToken, "admin-token", "", "file holding the bearer token the commands call the admin API with")
+	fs.StringVar(&f.BalancePolicy, "balance-policy", "alert", "when the queue exceeds the balance: alert, refuse to pay, or pay it partially in order")
+	fs.StringVar(&f.Export, "export", "", "write every withdrawal with its fee to this CSV file and exit")
+	f.RegisterExport(fs, "export-audit", "with -export, also write the audit log of approvals to this CSV file", "audit log", emt.ExportAuditCSV)
+	f.RegisterExport(fs, "export-overhead", "with -export, also write the fees of token approvals to this CSV file", "overhead fees", emt.ExportOverheadCSV)
+}
+
+// RegisterExport defines on fs the flag name of a CSV file written by write along -export.
+func (f *Flags) RegisterExport(fs *flag.FlagSet, name, usage, what string, write func(io.Writer, ...*emt.WdDB) error) {
+	path := fs.String(name, "", usage)
+	f.exports = append(f.exports, export{path: path, what: what, write: write})
+}
+
+// Check validates the flags, and returns the balance policy they ask for.
+func (f *Flags) Check() (emt.BalancePolicy, error) {
+	policy, err := emt.ParseBalancePolicy(f.BalancePolicy)
+	if err != nil {
+		return policy, err
+	}
+	return policy, emt.CheckLeaseTTL(f.LeaseTTL, trackInterval)
+}
+
+// AdminClient calls the admin API of the running worker, which holds the db, for chain.
+func (f *Flags) AdminClient(chain string) (*emt.AdminClient, error) {
+	token, err := emt.LoadAdminToken(f.AdminToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin token: %w", err)
+	}
+	return &emt.AdminClient{URL: f.Admin, Chain: chain, Token: token}, nil
+}
+
+// RunAdmin makes the changes asked for by -set-priority with -admin and by the approval
+// flags through the admin API. It reports whether there was any.
+func (f *Flags) RunAdmin(review *approvals.Command) (bool, error) {
+	if f.PriorityId != 0 && f.Admin != "" {
+		client, err := f.AdminClient(f.PriorityChain)
+		if err != nil {
+			return true, err
+		}
+		if err := client.SetPriority(f.PriorityId, f.Priority); err != nil {
+			return true, fmt.Errorf("failed to set priority of %v: %w", f.PriorityId, err)
+		}
+		logger.Info("priority changed", "id", f.PriorityId, "priority", f.Priority)
+		return true, nil
+	}
+
+	// reviewers are the identities of their admin tokens, never a db opened offline
+	if review.Set() {
+		if f.Admin == "" {
+			return true, errors.New("the approval commands need -admin")
+		}
+		client, err := f.AdminClient(review.Chain)
+		if err != nil {
+			return true, err
+		}
+		if err := review.Run(client); err != nil {
+			return true, fmt.Errorf("failed to review withdrawals: %w", err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// RunOffline writes the exports asked for, or changes the priority asked for by
+// -set-priority without -admin, in the db of chains. It reports whether there was any.
+func (f *Flags) RunOffline(wdDB *emt.WdDB, chains []emt.ChainConfig) (bool, error) {
+	if f.Export != "" {
+		if err := exportWithdrawals(f.Export, wdDB, chains, emt.ExportCSV); err != nil {
+			return true, fmt.Errorf("failed to export withdrawals to %s: %w", f.Export, err)
+		}
+		for _, e := range f.exports {
+			if *e.path == "" {
+				continue
+			}
+			if err := exportWithdrawals(*e.path, wdDB, chains, e.write); err != nil {
+				return true, fmt.Errorf("failed to export %s to %s: %w", e.what, *e.path, err)
+			}
+		}
+		return true, nil
+	}
+
+	if f.PriorityId != 0 {
+		if err := wdDB.ForChain(f.PriorityChain).SetPriority(f.PriorityId, f.Priority); err != nil {
+			return true, fmt.Errorf("failed to set priority of %v: %w", f.PriorityId, err)
+		}
+		logger.Info("priority changed", "id", f.PriorityId, "priority", f.Priority)
+		return true, nil
+	}
+	return false, nil
+}
+
+// Chains returns the registry of -chains, or the only chain described by the flags and
+// defaults if unset.
+func (f *Flags) Chains(defaults emt.ChainConfig) ([]emt.ChainConfig, error) {
+	if f.ChainsFile != "" {
+		return emt.LoadChains(f.ChainsFile)
+	}
+
+	cfg := defaults
+	cfg.ChainID = f.ChainID
+	cfg.Gas = f.Gas
+	cfg.Disperse = f.Disperse
+	return []emt.ChainConfig{cfg}, nil
+}
+
+// NewPayers registers one worker per chain, each with its own withdrawals and nonces, paying
+// from addr and warning about transactions unconfirmed for longer than timeout.
+func (f *Flags) NewPayers(
+	ctx context.Context,
+	wdDB *emt.WdDB,
+	chains []emt.ChainConfig,
+	addr common.Address,
+	prvKey *ecdsa.PrivateKey,
+	policy emt.BalancePolicy,
+	timeout time.Duration,
+) (map[string]*Payer, error) {
+	payers := make(map[string]*Payer)
+	for _, cfg := range chains {
+		p, err := NewPayer(ctx, wdDB.ForChain(cfg.Name), cfg, f.CallTimeout, f.Quorum)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init chain %q: %w", cfg.Name, err)
+		}
+
+		p.Worker = emt.NewWorker(p.DB, p.Ethc, addr, prvKey, p.ChainID, f.MaxInFlight)
+		if cfg.Disperse != "" {
+			contract := common.HexToAddress(cfg.Disperse)
+			p.Worker.Disperse = &contract
+			p.Worker.BatchSize = f.BatchSize
+		}
+		p.Worker.Confirmations = cfg.Confirmations
+		p.Worker.Policy = emt.TxPolicy{Gas: cfg.Gas, Fee: cfg.Fee}
+		p.Worker.BalancePolicy = policy
+		p.Worker.Timeout = timeout
+		p.Worker.Owner = f.Owner
+		p.Worker.LeaseTTL = f.LeaseTTL
+		if f.LeaseFile != "" {
+			p.Worker.LeaseStore = &emt.FileLeaseStore{Path: f.LeaseFile}
+		}
+		payers[cfg.Name] = p
+	}
+	return payers, nil
+}
+
+// RunCancel cancels the withdrawal of -cancel and waits for the cancellation to resolve.
+// It reports whether there was one to cancel.
+func (f *Flags) RunCancel(ctx context.Context, payers map[string]*Payer) (bool, error) {
+	if f.CancelId == 0 {
+		return false, nil
+	}
+	p, ok := payers[f.CancelChain]
+	if !ok {
+		return true, fmt.Errorf("unknown chain %q", f.CancelChain)
+	}
+	if err := cancel(ctx, p.DB, p.Worker, f.CancelId); err != nil {
+		return true, fmt.Errorf("failed to cancel withdrawal %v: %w", f.CancelId, err)
+	}
+	if err := p.Worker.ReleaseLease(); err != nil {
+		logger.Error("failed to release lease", "err", err)
+	}
+	return true, nil
+}
+
+// Serve serves the admin API of the db of payers on -admin until ctx is done, if set. The
+// returned channel is closed once the requests in progress finished.
+func (f *Flags) Serve(ctx context.Context, payers map[string]*Payer) (<-chan struct{}, error) {
+	serving := make(chan struct{})
+	if f.Admin == "" {
+		close(serving)
+		return serving, nil
+	}
+
+	views := make(map[string]*emt.WdDB)
+	for name, p := range payers {
+		views[name] = p.DB
+	}
+	tokens, err := emt.LoadAdminTokens(f.AdminTokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin tokens: %w", err)
+	}
+	server := &http.Server{Addr: emt.AdminAddr(f.Admin), Handler: emt.NewAdminHandler(views, tokens)}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("admin api stopped", "err", err)
+		}
+	}()
+	// requests in progress finish before the db is closed
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+		close(serving)
+	}()
+	return serving, nil
+}
+
+// Shutdown gives done -drain-timeout to close, then releases the leases of payers and
+// closes store.
+func (f *Flags) Shutdown(store *Store, payers map[string]*Payer, done ...<-chan struct{}) {
+	logger.Info("shutting down", "timeout", f.DrainTimeout)
+	if !emt.Drain(f.DrainTimeout, done...) {
+		// closing the db under running goroutines would fail their writes half way, exit
+		// with it open instead, leveldb replays its journal at the next start
+		logger.Fatal("drain timeout, exiting without closing the db")
+	}
+	for _, p := range payers {
+		if err := p.Worker.ReleaseLease(); err != nil {
+			logger.Error("failed to release lease", "err", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		logger.Error("failed to close leveldb", "err", err)
+	}
+	logger.Info("shutdown complete")
+}
+
+// Store is the db of a command, locked against any other worker.
+type Store struct {
+	DB     *leveldb.DB
+	lock   *emt.FileLock
+	closed bool
+}
+
+// OpenStore locks and opens the db in path, one worker per db.
+func OpenStore(path string) (*Store, error) {
+	lock, err := emt.AcquireFileLock(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("another worker is using the db: %w", err)
+	}
+
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		lock.Release()
+		return nil, fmt.Errorf("failed to init leveldb: %w", err)
+	}
+	return &Store{DB: db, lock: lock}, nil
+}
+
+// Close closes the db, then releases its lock. Closing it again is a no-op.
+func (s *Store) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.DB.Close()
+	if e := s.lock.Release(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// Payer pays the withdrawals of one chain.
+type Payer struct {
+	Cfg     emt.ChainConfig
+	DB      *emt.WdDB
+	Ethc    *emt.MultiClient
+	ChainID *big.Int
+	Worker  *emt.Worker
+}
+
+func NewPayer(ctx context.Context, db *emt.WdDB, cfg emt.ChainConfig, callTimeout time.Duration, quorum int) (*Payer, error) {
+	// register ethclient
+	ethc, err := emt.DialMultiClient(cfg.Endpoints, callTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ethc.Quorum = quorum
+
+	// check kv
+	initValue := emt.ToBigEndianBytes(1)
+
+	if err := db.GetOrSet([]byte("kv-id"), initValue); err != nil {
+		return nil, err
+	}
+
+	if err := db.GetOrSet([]byte("kv-nonce"), initValue); err != nil {
+		return nil, err
+	}
+
+	// never sign for another chain than the configured one and the one of the db
+	chainID, err := emt.VerifyChainID(ctx, db, ethc, big.NewInt(cfg.ChainID))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("chain", "name", cfg.Name, "id", chainID, "symbol", cfg.NativeSymbol)
+
+	return &Payer{Cfg: cfg, DB: db, Ethc: ethc, ChainID: chainID}, nil
+}
+
+// Run dispatches the withdrawals of the chain every interval and tracks them until ctx is
+// done. The returned channel is closed once both stopped.
+func (p *Payer) Run(ctx context.Context, interval time.Duration) <-chan struct{} {
+	go p.Ethc.RunHealthChecks(ctx, 30*time.Second)
+
+	tracking := make(chan struct{})
+	go func() {
+		p.Worker.Track(ctx, trackInterval)
+		close(tracking)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for ctx.Err() == nil {
+			if err := p.Worker.Dispatch(ctx); err != nil && ctx.Err() == nil {
+				logger.Error("failed to handle it", "chain", p.Cfg.Name, "err", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-ticker.C:
+			}
+		}
+		<-tracking
+	}()
+	return done
+}
+
+// defaultOwner names the worker after its host, so that a restarted worker takes its own
+// lease back at once.
+func defaultOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+func exportWithdrawals(path string, wdDB *emt.WdDB, chains []emt.ChainConfig, export func(io.Writer, ...*emt.WdDB) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	views := make([]*emt.WdDB, 0, len(chains))
+	for _, cfg := range chains {
+		views = append(views, wdDB.ForChain(cfg.Name))
+	}
+	if err := export(f, views...); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func cancel(ctx context.Context, db *emt.WdDB, worker *emt.Worker, id uint64) error {
+	tx, err := worker.Cancel(ctx, id)
+	if err != nil {
+		return err
+	}
+	logger.Info("cancellation broadcast", "id", id, "txid", tx.Hash().Hex())
+
+	end := time.Now().Add(worker.Timeout)
+	for time.Now().Before(end) {
+		select {
+		case <-ctx.Done():
+			logger.Info("interrupted, the cancellation will be resolved by the main loop", "id", id)
+			return nil
+		case <-time.After(5 * time.Second):
+		}
+
+		if err := worker.TrackOnce(ctx); err != nil {
+			logger.Error("failed to track transactions", "err", err)
+			continue
+		}
+
+		obj, err := db.GetWdObjById(id)
+		if err != nil {
+			return err
+		}
+		if obj.Status != emt.StatusCancelling {
+			logger.Info("cancellation resolved", "id", id, "status", obj.Status)
+			return nil
+		}
+	}
+	logger.Info("cancellation still pending, it will be resolved by the main loop", "id", id)
+	return nil
+}
@@ -1,24 +1,31 @@
 package main
 
 import (
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
     "math/big"
+    "os"
+    "os/signal"
+    "strings"
+    "syscall"
     "time"
 
     "github.com/ethereum/go-ethereum/common"
     "github.com/ethereum/go-ethereum/crypto"
-    "github.com/ethereum/go-ethereum/ethclient"
-    "github.com/robfig/cron/v3"
-    "github.com/syndtr/goleveldb/leveldb"
 
     emt "github.com/haihongs/eth-multi-transactions"
+    "github.com/haihongs/eth-multi-transactions/cmd/internal/approvals"
+    "github.com/haihongs/eth-multi-transactions/cmd/internal/payer"
     "github.com/haihongs/eth-multi-transactions/common/logger"
 )
 
 var (
-    Wei     = big.NewInt(1)
-    GWei    = big.NewInt(1e9)
-    Ether   = big.NewInt(0).Mul(GWei, GWei) // 1ether = 1e18wei
-    ChainID = big.NewInt(1)
+    Wei   = big.NewInt(1)
+    GWei  = big.NewInt(1e9)
+    Ether = big.NewInt(0).Mul(GWei, GWei) // 1ether = 1e18wei
 )
 
 type dest struct {
@@ -26,14 +33,65 @@ type dest struct {
     percent *big.Int
     amt     *big.Int
     memo    string
+    chain   string   // name in the chain registry, empty for the default chain
+    min     *big.Int // shares below it accrue until they reach it, nil to pay any share
 }
 
 func main() {
     logger.Init(logger.DebugLevel)
 
+    flags := &payer.Flags{}
+    flags.RegisterFlags(flag.CommandLine)
+    distributionFile := flag.String("distribution", "", "JSON object of the distribution of each chain by name, the users split by percent if unset; seeds the default plan of chains without plans")
+    flags.RegisterExport(flag.CommandLine, "export-dust", "with -export, also write the ledger of shares accrued below the minimum payout to this CSV file", "dust ledger", emt.ExportDustCSV)
+    scheduleSpec := flag.String("schedule", "@daily", "cron expression of the default plan, at most one batch per period")
+    timezone := flag.String("timezone", "", "time zone of the schedule of the default plan, empty for local time")
+    catchUpRule := flag.String("catch-up", "latest", "periods the default plan missed while stopped to generate at startup: latest or skip")
+    planPut := flag.String("plan-put", "", "store the plan in this JSON file as its next version and exit")
+    planDelete := flag.String("plan-delete", "", "delete the plan with this name and exit")
+    planList := flag.Bool("plan-list", false, "print the latest version of every plan and exit")
+    planChain := flag.String("plan-chain", "", "chain of the plan of the -plan commands")
+    review := &approvals.Command{}
+    review.RegisterFlags(flag.CommandLine)
+    reservePolicy := flag.String("reserve", "fixed:1000000000000000000", "kept back for network fees: fixed:<wei>, percent:<of the balance> or estimate:<safety factor>")
+    flag.Parse()
+
+    policy, err := flags.Check()
+    if err != nil {
+        logger.Fatal("invalid flag", "err", err)
+    }
+    reserve, err := emt.ParseReservePolicy(*reservePolicy)
+    if err != nil {
+        logger.Fatal("invalid flag", "err", err)
+    }
+    if catchUp, err := emt.ParseCatchUp(*catchUpRule); err != nil {
+        logger.Fatal("invalid flag", "err", err)
+    } else if catchUp == emt.CatchUpAll {
+        logger.Fatal("invalid flag", "err", "the default plan splits the live balance, it cannot catch up on all missed periods")
+    }
+    seed := emt.Plan{Name: "default", Schedule: *scheduleSpec, Timezone: *timezone, CatchUp: *catchUpRule}
+
+    // edit the plans of a running worker through its admin API
+    planCommand := *planPut != "" || *planDelete != "" || *planList
+    if planCommand && flags.Admin != "" {
+        client, err := flags.AdminClient(*planChain)
+        if err != nil {
+            logger.Fatal("failed to call the admin api", "err", err)
+        }
+        if err := editPlans(client, *planPut, *planDelete, *planList); err != nil {
+            logger.Fatal("failed to edit plans", "err", err)
+        }
+        return
+    }
+    if ok, err := flags.RunAdmin(review); err != nil {
+        logger.Fatal("failed to call the admin api", "err", err)
+    } else if ok {
+        return
+    }
+
     // TODO: flag parse
     path := "./db"
-    nodeEndpoint := ""
+    nodeEndpoint := "" // comma separated, in order of preference
     addr := ""
     sk := ""
     users := []*dest{
@@ -44,137 +102,376 @@ func main() {
         &dest{addr: "0x793", percent: big.NewInt(2)},
     }
 
-    // register db
-    db, err := leveldb.OpenFile(path, nil)
+    chains, err := flags.Chains(emt.ChainConfig{
+        Endpoints:     strings.Split(nodeEndpoint, ","),
+        Fee:           emt.DefaultFee,
+        Confirmations: 3,
+        NativeSymbol:  "ETH",
+        Reserve:       reserve,
+    })
     if err != nil {
-        logger.Fatal("failed to init leveldb", "dir", path, "err", err)
+        logger.Fatal("failed to load chains", "err", err)
     }
-    defer db.Close()
 
-    wdDB := emt.NewWithdrawalDB(db)
+    // stop taking new withdrawals on SIGINT/SIGTERM
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
 
-    // register ethclient
-    ethc, err := ethclient.Dial(nodeEndpoint)
+    // register db, one worker per db
+    store, err := payer.OpenStore(path)
     if err != nil {
-        logger.Fatal("failed to init ethclient", "err", err)
+        logger.Fatal("failed to open db", "dir", path, "err", err)
     }
+    defer store.Close()
 
-    // initial condition check
-    {
-        // check kv
-        initValue := emt.ToBigEndianBytes(1)
+    wdDB := emt.NewWithdrawalDB(store.DB)
 
-        if err := wdDB.GetOrSet([]byte("kv-id"), initValue); err != nil {
-            logger.Fatal("condition check failed", "err", err)
+    if planCommand {
+        if err := editPlans(wdDB.ForChain(*planChain), *planPut, *planDelete, *planList); err != nil {
+            logger.Fatal("failed to edit plans", "err", err)
         }
+        return
+    }
+    if ok, err := flags.RunOffline(wdDB, chains); err != nil {
+        logger.Fatal("failed to run command", "err", err)
+    } else if ok {
+        return
+    }
+
+    prvKey, err := crypto.HexToECDSA(sk)
+    if err != nil {
+        logger.Fatal("failed to parse private key", "err", err)
+    }
+
+    payers, err := flags.NewPayers(ctx, wdDB, chains, common.HexToAddress(addr), prvKey, policy, 40*time.Minute)
+    if err != nil {
+        logger.Fatal("failed to init chains", "err", err)
+    }
+
+    if ok, err := flags.RunCancel(ctx, payers); err != nil {
+        logger.Fatal("failed to cancel withdrawal", "err", err)
+    } else if ok {
+        return
+    }
 
-        if err := wdDB.GetOrSet([]byte("kv-nonce"), initValue); err != nil {
-            logger.Fatal("condition check failed", "err", err)
+    // the users or the distribution flag seed the plan of chains without plans
+    distributions := make(map[string]json.RawMessage)
+    for name := range payers {
+        if chainUsers := usersOn(users, name); len(chainUsers) > 0 {
+            if distributions[name], err = weightedSplit(chainUsers); err != nil {
+                logger.Fatal("failed to build distribution", "err", err)
+            }
+        }
+    }
+    if *distributionFile != "" {
+        loaded, err := loadDistributions(*distributionFile)
+        if err != nil {
+            logger.Fatal("failed to load distributions", "err", err)
+        }
+        for name, d := range loaded {
+            distributions[name] = d
+        }
+    }
+    for name, d := range distributions {
+        p, ok := payers[name]
+        if !ok {
+            logger.Fatal("distribution for unknown chain", "chain", name)
         }
+        plan := seed
+        plan.Distribution = d
+        plan.Reserve = p.Cfg.Reserve
+        if err := seedPlan(p.DB, &plan); err != nil {
+            logger.Fatal("failed to seed plan", "chain", name, "err", err)
+        }
+    }
+
+    // generate withdrawals of the plans of each chain, following their edits
+    done := make([]<-chan struct{}, 0, 2*len(payers)+1)
+    for _, p := range payers {
+        done = append(done, runPlans(ctx, p, addr, 30*time.Second))
     }
 
-    // generate withdrawals
-    c := cron.New()
-    if _, err := c.AddFunc("@every 24h", func() { generateWithdrawals(wdDB, ethc, addr, users) }); err != nil {
-        logger.Fatal("failed to init cron", "err", err)
+    serving, err := flags.Serve(ctx, payers)
+    if err != nil {
+        logger.Fatal("failed to serve admin api", "err", err)
     }
-    c.Start()
+    done = append(done, serving)
 
     // main loop
-    for {
-        if err := handle(wdDB, ethc, addr, sk); err != nil {
-            logger.Error("failed to handle it", "err", err)
+    for _, p := range payers {
+        done = append(done, p.Run(ctx, 30*60*time.Second))
+    }
+    <-ctx.Done()
+
+    flags.Shutdown(store, payers, done...)
+}
+
+func usersOn(users []*dest, chain string) []*dest {
+    var ans []*dest
+    for _, u := range users {
+        if u.chain == chain {
+            ans = append(ans, u)
         }
-        time.Sleep(30 * 60 * time.Second)
     }
+    return ans
 }
 
-func handle(db *emt.WdDB, ethc *ethclient.Client, addr, sk string) error {
-    fromAddr := common.HexToAddress(addr)
-    prvKey, err := crypto.HexToECDSA(sk)
-    if err != nil {
-        return err
+// weightedSplit returns the JSON form of the distribution splitting by the percent of users.
+func weightedSplit(users []*dest) (json.RawMessage, error) {
+    d := struct {
+        Type       string          `json:"type"`
+        Recipients []emt.Recipient `json:"recipients"`
+    }{Type: "weighted"}
+    for _, u := range users {
+        d.Recipients = append(d.Recipients, emt.Recipient{Address: u.addr, Weight: u.percent, Min: u.min})
     }
+    return json.Marshal(&d)
+}
 
-    // handle
-    ids, err := db.GetUnhandledRecordsId()
+// loadDistributions reads a JSON object mapping chain names to distributions.
+func loadDistributions(path string) (map[string]json.RawMessage, error) {
+    raw, err := os.ReadFile(path)
     if err != nil {
-        return err
+        return nil, err
+    }
+
+    var configs map[string]json.RawMessage
+    if err := json.Unmarshal(raw, &configs); err != nil {
+        return nil, err
     }
 
-    logger.Info("start handling")
-    for _, id := range ids {
-        key := append([]byte("status-"), emt.ToBigEndianBytes(id)...)
-        if err := db.CompareAndSwapStatus(key, 0, 1); err != nil {
-            logger.Error("failed to CAS status", "err", err, "id", id)
-            continue
+    for name, c := range configs {
+        if _, err := emt.ParseDistribution(c); err != nil {
+            return nil, fmt.Errorf("chain %q: %w", name, err)
         }
+    }
+    return configs, nil
+}
 
-        obj, err := db.GetWdObjById(id)
-        if err != nil {
-            logger.Error("failed to get wd obj", "err", err, "id", id)
-            continue
+// generateWithdrawals splits the balance of plan for period, less what it already owes,
+// failing on errors worth retrying. A balance below the reserve generates nothing.
+func generateWithdrawals(ctx context.Context, p *payer.Payer, addr string, plan *emt.Plan, dist emt.Distribution, schedule string, period time.Time) error {
+    wdDB := p.DB
+
+    reserve := plan.Reserve
+    if reserve.Kind == "" {
+        reserve = p.Cfg.Reserve
+        if plan.Token != "" {
+            // fees are paid in ether, nothing to keep of a token
+            reserve = emt.ReservePolicy{Kind: "fixed", Amount: big.NewInt(0)}
         }
+    }
+
+    // get balance
+    balance, err := planBalance(ctx, p.Ethc, addr, plan.Token)
+    if err != nil {
+        return fmt.Errorf("failed to get balance: %w", err)
+    }
+
+    // withdrawals not paid yet and dust are owed out of the balance, never split them again
+    committed, err := wdDB.Committed(plan.Token)
+    if err != nil {
+        return fmt.Errorf("failed to get committed balance: %w", err)
+    }
+    if balance.Cmp(committed) <= 0 {
+        logger.Info("balance committed to unpaid withdrawals", "chain", wdDB.Chain(), "plan", plan.Name, "balance", balance, "committed", committed)
+        return nil
+    }
+    balance.Sub(balance, committed)
+
+    // keep the reserve to pay the network fee of paying the recipients the whole balance would pay
+    recipients, _, err := dist.Split(balance)
+    if err != nil {
+        return fmt.Errorf("failed to split balance: %w", err)
+    }
+    gas, err := p.Worker.PayoutGas(plan.Token, len(recipients))
+    if err != nil {
+        return fmt.Errorf("failed to estimate payout gas: %w", err)
+    }
+    kept, err := reserve.Reserve(ctx, p.Ethc, p.Worker.Policy, balance, gas)
+    if err != nil {
+        return fmt.Errorf("failed to compute reserve: %w", err)
+    }
+    if balance.Cmp(kept) <= 0 {
+        logger.Info("not enough balance", "chain", wdDB.Chain(), "plan", plan.Name, "balance", balance, "reserve", kept)
+        return nil
+    }
+
+    balance.Sub(balance, kept)
 
-        txId, err := emt.SendEthTransaction(obj, ethc, fromAddr, prvKey, ChainID)
+    // generate records
+    shares, leftover, err := dist.Split(balance)
+    if err != nil {
+        return fmt.Errorf("failed to split balance: %w", err)
+    }
+
+    // the shares, the dust and the leftover must add up to the balance split, to the wei
+    batch := &emt.PayoutBatch{
+        Token:    plan.Token,
+        Total:    balance,
+        Leftover: leftover,
+        Reserve:  kept,
+        Schedule: schedule,
+        Period:   uint64(period.Unix()),
+        Plan:     plan.Name,
+        Version:  plan.Version,
+        Created:  uint64(time.Now().Unix()),
+    }
+    objs, err := wdDB.InsertShares(batch, shares)
+    if errors.Is(err, emt.ErrPeriodGenerated) {
+        logger.Info("period already generated", "chain", wdDB.Chain(), "plan", plan.Name, "period", period)
+        return nil
+    } else if err != nil {
+        return fmt.Errorf("failed to insert db: %w", err)
+    }
+
+    logger.Info("succeed to generate withdrawals", "chain", wdDB.Chain(), "plan", plan.Name, "version", plan.Version,
+        "batch", batch.Id, "count", len(objs), "reserve", kept, "accrued", batch.Accrued, "released", batch.Released, "leftover", leftover)
+
+    // TODO: dingding notification
+    return nil
+}
+
+func planBalance(ctx context.Context, c emt.ChainClient, addr, token string) (*big.Int, error) {
+    if token == "" {
+        return emt.GetBalance(ctx, c, addr)
+    }
+    return emt.TokenBalance(ctx, c, common.HexToAddress(token), common.HexToAddress(addr))
+}
+
+// planStore is a db view of a chain or the admin API of the worker running it.
+type planStore interface {
+    PutPlan(p *emt.Plan) error
+    DeletePlan(name string) error
+    ListPlans() ([]*emt.Plan, error)
+}
+
+func editPlans(store planStore, putFile, deleteName string, list bool) error {
+    if putFile != "" {
+        raw, err := os.ReadFile(putFile)
         if err != nil {
-            logger.Error("failed to send eth transaction", "err", err, "id", id)
-            continue
+            return err
+        }
+        var plan emt.Plan
+        if err := json.Unmarshal(raw, &plan); err != nil {
+            return fmt.Errorf("failed to parse %s: %w", putFile, err)
         }
-        logger.Info("broadcast succeed", "txid", txId)
+        if err := store.PutPlan(&plan); err != nil {
+            return err
+        }
+        logger.Info("plan stored", "plan", plan.Name, "version", plan.Version)
+    }
 
-        if err := emt.PollingTransaction(ethc, txId, 3, 40*time.Minute); err != nil {
-            logger.Error("failed to confirm eth transaction", "err", err, "id", id)
-            continue
+    if deleteName != "" {
+        if err := store.DeletePlan(deleteName); err != nil {
+            return err
         }
+        logger.Info("plan deleted", "plan", deleteName)
+    }
 
-        if err := db.CompareAndSwapStatus(key, 1, 2); err != nil {
-            logger.Error("failed to CAS status", "err", err, "id", id)
-            continue
+    if list {
+        plans, err := store.ListPlans()
+        if err != nil {
+            return err
         }
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        return enc.Encode(plans)
     }
-    logger.Info("finish handling")
     return nil
 }
 
-func generateWithdrawals(wdDB *emt.WdDB, ethc *ethclient.Client, addr string, users []*dest) {
-    // retry at most 5 times
-    for i := 0; i < 5; i++ {
-        // get balance
-        balance, err := emt.GetBalance(ethc, addr)
-        if err != nil {
-            logger.Error("failed to get balance", "err", err)
-            time.Sleep(1 * time.Second)
-            continue
-        }
+// seedPlan stores plan if the chain of db has no plan yet.
+func seedPlan(db *emt.WdDB, plan *emt.Plan) error {
+    plans, err := db.ListPlans()
+    if err != nil || len(plans) > 0 {
+        return err
+    }
+    if err := db.PutPlan(plan); err != nil {
+        return err
+    }
+    logger.Info("plan seeded", "chain", db.Chain(), "plan", plan.Name)
+    return nil
+}
 
-        // keep 1ether to pay the network fee
-        if big.NewInt(0).Div(balance, Ether).Uint64() < 1 {
-            logger.Info("not enough balance")
-            return
-        }
+// runPlans generates the withdrawals of every plan of the chain of p on its schedule until
+// ctx is done, checking every interval for plans stored, edited or deleted meanwhile. The
+// returned channel is closed once every schedule stopped.
+func runPlans(ctx context.Context, p *payer.Payer, addr string, interval time.Duration) <-chan struct{} {
+    type running struct {
+        version uint64
+        stop    context.CancelFunc
+        done    chan struct{}
+    }
 
-        balance.Sub(balance, Ether)
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
 
-        // generate records
-        total := big.NewInt(0)
-        for _, u := range users {
-            total.Add(total, u.percent)
+        schedules := make(map[string]*running)
+        stop := func(name string) {
+            schedules[name].stop()
+            <-schedules[name].done
+            delete(schedules, name)
         }
+        defer func() {
+            for name := range schedules {
+                stop(name)
+            }
+        }()
+
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
 
-        // balance * percent / total
-        for _, u := range users {
-            u.amt = big.NewInt(0).Mul(balance, u.percent)
-            u.amt.Div(u.amt, total)
-            if err := wdDB.Insert(u.addr, u.amt, 0, 0, "", uint64(time.Now().Unix()), uint64(time.Now().Unix())); err != nil {
-                logger.Info("failed to insert db", "err", err)
-                continue
+        for {
+            plans, err := p.DB.ListPlans()
+            if err != nil {
+                logger.Error("failed to list plans", "chain", p.Cfg.Name, "err", err)
             }
-        }
 
-        logger.Info("succeed to generate withdrawals")
+            current := make(map[string]bool)
+            for _, plan := range plans {
+                plan := plan
+                current[plan.Name] = true
+                if r, ok := schedules[plan.Name]; ok && r.version == plan.Version {
+                    continue
+                }
 
-        // TODO: dingding notification
-        return
-    }
+                dist, schedule, err := plan.Parse()
+                if err != nil {
+                    logger.Error("invalid plan", "chain", p.Cfg.Name, "plan", plan.Name, "version", plan.Version, "err", err)
+                    continue
+                }
+                if _, ok := schedules[plan.Name]; ok {
+                    stop(plan.Name)
+                }
+
+                // the last period generated is kept in the db, so restarts never generate it twice
+                planCtx, cancel := context.WithCancel(ctx)
+                r := &running{version: plan.Version, stop: cancel, done: make(chan struct{})}
+                go func() {
+                    defer close(r.done)
+                    schedule.Run(planCtx, p.DB, func(ctx context.Context, period time.Time) error {
+                        return generateWithdrawals(ctx, p, addr, plan, dist, schedule.Name, period)
+                    })
+                }()
+                schedules[plan.Name] = r
+                logger.Info("plan scheduled", "chain", p.Cfg.Name, "plan", plan.Name, "version", plan.Version, "schedule", plan.Schedule)
+            }
+
+            for name := range schedules {
+                if err == nil && !current[name] {
+                    stop(name)
+                    logger.Info("plan stopped", "chain", p.Cfg.Name, "plan", name)
+                }
+            }
+
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+            }
+        }
+    }()
+    return done
 }
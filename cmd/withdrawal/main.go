@@ -1,23 +1,28 @@
 package main
 
 import (
+    "context"
+    "flag"
+    "fmt"
     "math/big"
+    "os/signal"
+    "strings"
+    "syscall"
     "time"
 
     "github.com/ethereum/go-ethereum/common"
     "github.com/ethereum/go-ethereum/crypto"
-    "github.com/ethereum/go-ethereum/ethclient"
-    "github.com/syndtr/goleveldb/leveldb"
 
     emt "github.com/haihongs/eth-multi-transactions"
+    "github.com/haihongs/eth-multi-transactions/cmd/internal/approvals"
+    "github.com/haihongs/eth-multi-transactions/cmd/internal/payer"
     "github.com/haihongs/eth-multi-transactions/common/logger"
 )
 
 var (
-    Wei     = big.NewInt(1)
-    GWei    = big.NewInt(1e9)
-    Ether   = big.NewInt(0).Mul(GWei, GWei) // 1ether = 1e18wei
-    ChainID = big.NewInt(1)
+    Wei   = big.NewInt(1)
+    GWei  = big.NewInt(1e9)
+    Ether = big.NewInt(0).Mul(GWei, GWei) // 1ether = 1e18wei
 )
 
 type dest struct {
@@ -25,110 +30,215 @@ type dest struct {
     percent *big.Int
     amt     *big.Int // wei based
     memo    string
+    chain   string // name in the chain registry, empty for the default chain
+
+    notBefore time.Time // not paid before, zero to pay at once
+    expiry    time.Time // not paid from, zero for no expiry
+    priority  uint64    // higher is paid first
 }
 
 func main() {
     logger.Init(logger.DebugLevel)
 
+    flags := &payer.Flags{}
+    flags.RegisterFlags(flag.CommandLine)
+    review := &approvals.Command{}
+    review.RegisterFlags(flag.CommandLine)
+    schedulesFile := flag.String("schedules", "", "JSON file of the recurring payouts and vestings to pay")
+    flag.Parse()
+
+    policy, err := flags.Check()
+    if err != nil {
+        logger.Fatal("invalid flag", "err", err)
+    }
+
+    // call the admin API of a running worker, which holds the db
+    if ok, err := flags.RunAdmin(review); err != nil {
+        logger.Fatal("failed to call the admin api", "err", err)
+    } else if ok {
+        return
+    }
+
     // TODO: flag parse
     path := "./db"
-    nodeEndpoint := ""
+    nodeEndpoint := "" // comma separated, in order of preference
     addr := ""
     sk := ""
     users := []*dest{
         &dest{addr: "0xaaaaa", amt: big.NewInt(456)},
     }
 
-    // register db
-    db, err := leveldb.OpenFile(path, nil)
+    chains, err := flags.Chains(emt.ChainConfig{
+        Endpoints:     strings.Split(nodeEndpoint, ","),
+        Fee:           emt.DefaultFee,
+        Confirmations: 3,
+        NativeSymbol:  "ETH",
+    })
     if err != nil {
-        logger.Fatal("failed to init leveldb", "dir", path, "err", err)
+        logger.Fatal("failed to load chains", "err", err)
+    }
+
+    schedules := &emt.PayoutSchedules{}
+    if *schedulesFile != "" {
+        if schedules, err = emt.LoadPayoutSchedules(*schedulesFile); err != nil {
+            logger.Fatal("failed to load schedules", "err", err)
+        }
     }
-    defer db.Close()
 
-    wdDB := emt.NewWithdrawalDB(db)
+    // stop taking new withdrawals on SIGINT/SIGTERM
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
 
-    // register ethclient
-    ethc, err := ethclient.Dial(nodeEndpoint)
+    // register db, one worker per db
+    store, err := payer.OpenStore(path)
     if err != nil {
-        logger.Fatal("failed to init ethclient", "err", err)
+        logger.Fatal("failed to open db", "dir", path, "err", err)
     }
+    defer store.Close()
 
-    // initial condition check
-    {
-        // check kv
-        initValue := emt.ToBigEndianBytes(1)
+    wdDB := emt.NewWithdrawalDB(store.DB)
 
-        if err := wdDB.GetOrSet([]byte("kv-id"), initValue); err != nil {
-            logger.Fatal("condition check failed", "err", err)
-        }
+    if ok, err := flags.RunOffline(wdDB, chains); err != nil {
+        logger.Fatal("failed to run command", "err", err)
+    } else if ok {
+        return
+    }
 
-        if err := wdDB.GetOrSet([]byte("kv-nonce"), initValue); err != nil {
-            logger.Fatal("condition check failed", "err", err)
-        }
+    prvKey, err := crypto.HexToECDSA(sk)
+    if err != nil {
+        logger.Fatal("failed to parse private key", "err", err)
+    }
+
+    payers, err := flags.NewPayers(ctx, wdDB, chains, common.HexToAddress(addr), prvKey, policy, 60*time.Minute)
+    if err != nil {
+        logger.Fatal("failed to init chains", "err", err)
+    }
+
+    if ok, err := flags.RunCancel(ctx, payers); err != nil {
+        logger.Fatal("failed to cancel withdrawal", "err", err)
+    } else if ok {
+        return
     }
 
     // generate withdrawals
     for _, u := range users {
-        if err := wdDB.Insert(u.addr, u.amt, 0, 0, "", uint64(time.Now().Unix()), uint64(time.Now().Unix())); err != nil {
-            logger.Info("failed to insert db", "err", err, "addr", u.addr, "amount", u.amt)
+        obj := &emt.DbWithdrawalObj{
+            Address:  u.addr,
+            Amount:   u.amt,
+            Chain:    u.chain,
+            Priority: u.priority,
+            Created:  uint64(time.Now().Unix()),
+            Modified: uint64(time.Now().Unix()),
+        }
+        if !u.notBefore.IsZero() {
+            obj.NotBefore = uint64(u.notBefore.Unix())
+        }
+        if !u.expiry.IsZero() {
+            obj.Expiry = uint64(u.expiry.Unix())
+        }
+        if err := wdDB.BatchInsert([]*emt.DbWithdrawalObj{obj}); err != nil {
+            logger.Info("failed to insert db", "err", err, "chain", u.chain, "addr", u.addr, "amount", u.amt)
             continue
         }
     }
 
-    // main loop
-    for {
-        if err := handle(wdDB, ethc, addr, sk); err != nil {
-            logger.Error("failed to handle it", "err", err)
+    // generate the recurring payouts and the vested amounts, their progress kept in the db
+    var done []<-chan struct{}
+    for _, r := range schedules.Recurring {
+        p, ok := payers[r.Chain]
+        if !ok {
+            logger.Fatal("recurring payout for unknown chain", "chain", r.Chain, "name", r.Name)
         }
-        time.Sleep(5 * 60 * time.Second)
+        done = append(done, runRecurring(ctx, p.DB, r))
     }
-}
-
-func handle(db *emt.WdDB, ethc *ethclient.Client, addr, sk string) error {
-    fromAddr := common.HexToAddress(addr)
-    prvKey, err := crypto.HexToECDSA(sk)
-    if err != nil {
-        return err
+    for _, v := range schedules.Vesting {
+        p, ok := payers[v.Chain]
+        if !ok {
+            logger.Fatal("vesting for unknown chain", "chain", v.Chain, "name", v.Name)
+        }
+        done = append(done, runVesting(ctx, p.DB, v, 10*time.Minute))
     }
 
-    // handle
-    ids, err := db.GetUnhandledRecordsId()
+    serving, err := flags.Serve(ctx, payers)
     if err != nil {
-        return err
+        logger.Fatal("failed to serve admin api", "err", err)
     }
+    done = append(done, serving)
 
-    logger.Info("start handling")
-    for _, id := range ids {
-        key := append([]byte("status-"), emt.ToBigEndianBytes(id)...)
-        if err := db.CompareAndSwapStatus(key, 0, 1); err != nil {
-            logger.Error("failed to CAS status", "err", err, "id", id)
-            continue
-        }
+    // main loop
+    for _, p := range payers {
+        done = append(done, p.Run(ctx, 5*60*time.Second))
+    }
+    <-ctx.Done()
 
-        obj, err := db.GetWdObjById(id)
-        if err != nil {
-            logger.Error("failed to get wd obj", "err", err, "id", id)
-            continue
-        }
+    flags.Shutdown(store, payers, done...)
+}
 
-        txId, err := emt.SendEthTransaction(obj, ethc, fromAddr, prvKey, ChainID)
-        if err != nil {
-            logger.Error("failed to send eth transaction", "err", err, "id", id)
-            continue
-        }
-        logger.Info("broadcast succeed", "txid", txId)
+// runRecurring records the payout of r once per period of its schedule until ctx is done.
+func runRecurring(ctx context.Context, db *emt.WdDB, r *emt.Recurring) <-chan struct{} {
+    done := make(chan struct{})
+    schedule, err := r.Parse()
+    if err != nil {
+        logger.Error("invalid recurring payout", "name", r.Name, "err", err)
+        close(done)
+        return done
+    }
 
-        if err := emt.PollingTransaction(ethc, txId, 3, 60*time.Minute); err != nil {
-            logger.Error("failed to confirm eth transaction", "err", err, "id", id)
-            continue
-        }
+    go func() {
+        defer close(done)
+        schedule.Run(ctx, db, func(ctx context.Context, period time.Time) error {
+            obj, err := db.InsertRecurring(r, schedule.Name, period)
+            if err != nil {
+                return fmt.Errorf("failed to insert recurring payout %s: %w", r.Name, err)
+            }
+            logger.Info("recurring payout generated", "chain", db.Chain(), "name", r.Name, "period", period, "id", obj.Id, "amount", obj.Amount)
+            return nil
+        })
+    }()
+    return done
+}
 
-        if err := db.CompareAndSwapStatus(key, 1, 2); err != nil {
-            logger.Error("failed to CAS status", "err", err, "id", id)
-            continue
+// runVesting records a withdrawal of what v vested and was not paid yet at each of its
+// releases, until it is fully paid or ctx is done. Once fully vested it keeps checking every
+// interval while releases are pending, to release again what one done without paying owed.
+func runVesting(ctx context.Context, db *emt.WdDB, v *emt.Vesting, interval time.Duration) <-chan struct{} {
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+
+        for {
+            now := time.Now()
+            next := v.NextRelease(now)
+
+            obj, err := db.ReleaseVested(v, now)
+            switch {
+            case err != nil:
+                logger.Error("failed to release vested amount", "chain", db.Chain(), "name", v.Name, "err", err)
+                next = now.Add(time.Minute)
+            case obj != nil:
+                logger.Info("vested amount released", "chain", db.Chain(), "name", v.Name, "id", obj.Id, "amount", obj.Amount)
+            }
+
+            if next.IsZero() {
+                pending, err := db.PendingReleases(v.Name)
+                if err != nil {
+                    logger.Error("failed to read pending releases", "chain", db.Chain(), "name", v.Name, "err", err)
+                }
+                if err == nil && pending == 0 {
+                    logger.Info("vesting fully released", "chain", db.Chain(), "name", v.Name)
+                    return
+                }
+                next = now.Add(interval)
+            }
+
+            timer := time.NewTimer(time.Until(next))
+            select {
+            case <-ctx.Done():
+                timer.Stop()
+                return
+            case <-timer.C:
+            }
         }
-    }
-    logger.Info("finish handling")
-    return nil
+    }()
+    return done
 }
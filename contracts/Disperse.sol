@@ -0,0 +1,34 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.8.0;
+
+interface IERC20 {
+    function transfer(address to, uint256 value) external returns (bool);
+    function transferFrom(address from, address to, uint256 value) external returns (bool);
+}
+
+// Disperse pays many recipients in a single transaction, following the
+// interface of the contract deployed by disperse.app.
+contract Disperse {
+    function disperseEther(address[] calldata recipients, uint256[] calldata values) external payable {
+        require(recipients.length == values.length, "length mismatch");
+        for (uint256 i = 0; i < recipients.length; i++) {
+            payable(recipients[i]).transfer(values[i]);
+        }
+        uint256 balance = address(this).balance;
+        if (balance > 0) {
+            payable(msg.sender).transfer(balance);
+        }
+    }
+
+    function disperseToken(IERC20 token, address[] calldata recipients, uint256[] calldata values) external {
+        require(recipients.length == values.length, "length mismatch");
+        uint256 total = 0;
+        for (uint256 i = 0; i < recipients.length; i++) {
+            total += values[i];
+        }
+        require(token.transferFrom(msg.sender, address(this), total), "transferFrom failed");
+        for (uint256 i = 0; i < recipients.length; i++) {
+            require(token.transfer(recipients[i], values[i]), "transfer failed");
+        }
+    }
+}
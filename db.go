@@ -2,15 +2,49 @@ package eth_multi_transactions
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"math/big"
+	"sort"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// withdrawal status
+const (
+	StatusInit uint64 = iota
+	StatusProcessing
+	StatusConfirmed
+	StatusCancelling
+	StatusCancelled
+	StatusFailed
+	StatusFailedPrecheck
+	StatusExpired
+	// held until approved as the approval policy of the chain requires, see Approve
+	StatusAwaitingApproval
+	StatusRejected
+)
+
+var ErrNotPending = errors.New("withdrawal is not pending")
+
+// unpaid reports whether a withdrawal in status is done without having paid anything.
+func unpaid(status uint64) bool {
+	switch status {
+	case StatusCancelled, StatusFailed, StatusFailedPrecheck, StatusExpired, StatusRejected:
+		return true
+	}
+	return false
+}
+
 type WdDB struct {
 	db *leveldb.DB
+
+	// withdrawals of the default chain are stored without prefix, those of every other
+	// chain under "chain-<name>/" with their own ids
+	chain  string
+	prefix []byte
 }
 
 func NewWithdrawalDB(db *leveldb.DB) *WdDB {
@@ -19,6 +53,37 @@ func NewWithdrawalDB(db *leveldb.DB) *WdDB {
 	}
 }
 
+// ForChain returns a view of the withdrawals paid on the named chain, the empty name
+// being the default chain.
+func (w *WdDB) ForChain(name string) *WdDB {
+	if name == "" {
+		return &WdDB{db: w.db}
+	}
+	return &WdDB{
+		db:     w.db,
+		chain:  name,
+		prefix: []byte("chain-" + name + "/"),
+	}
+}
+
+// Chain returns the name of the chain the view is on.
+func (w *WdDB) Chain() string {
+	return w.chain
+}
+
+func (w *WdDB) prefixed(key []byte) []byte {
+	return append(append([]byte{}, w.prefix...), key...)
+}
+
+func (w *WdDB) key(field string, id uint64) []byte {
+	return append(w.prefixed([]byte(field)), ToBigEndianBytes(id)...)
+}
+
+// StatusKey returns the key holding the status of withdrawal id, for CompareAndSwapStatus.
+func (w *WdDB) StatusKey(id uint64) []byte {
+	return w.key("status-", id)
+}
+
 func (w *WdDB) GetRawDB() *leveldb.DB {
 	return w.db
 }
@@ -26,12 +91,37 @@ func (w *WdDB) GetRawDB() *leveldb.DB {
 type DbWithdrawalObj struct {
 	Id       uint64
 	Address  string
+	Chain    string // name of the chain paid on, empty for the default chain
+	Batch    uint64 // payout batch the withdrawal was generated by, 0 if none
+	Token    string // ERC-20 contract address, empty for ether
 	Amount   *big.Int
 	Nonce    uint64
 	Status   uint64
 	Hash     string
 	Created  uint64
 	Modified uint64
+
+	// unix times the withdrawal may be paid from and must be paid before, 0 for none
+	NotBefore uint64
+	Expiry    uint64
+	// withdrawals of higher priority are paid first
+	Priority uint64
+	// distinct approvals required before paying, 0 for none
+	Approvers uint64
+
+	// hash of the zero-value self-transfer replacing Nonce, if any
+	CancelHash string
+	// why the withdrawal failed, e.g. a decoded revert reason
+	Reason string
+	// block including Hash as last seen by the tracker, empty until mined
+	BlockNumber uint64
+	BlockHash   string
+
+	// execution of Hash, recorded once final. Fee is the share of the transaction fee
+	// borne by the withdrawal, a batch splitting it evenly among its withdrawals.
+	GasUsed  uint64
+	GasPrice *big.Int // effective price per gas, nil until final
+	Fee      *big.Int // in wei, nil until final
 }
 
 func (w *WdDB) BatchInsert(objs []*DbWithdrawalObj) error {
@@ -40,52 +130,102 @@ func (w *WdDB) BatchInsert(objs []*DbWithdrawalObj) error {
 		return err
 	}
 
-	e := func() error {
-		for _, o := range objs {
-			id, err := w.GetAndIncreasePrimaryKey(tx)
-			if err != nil {
-				return err
-			}
+	if e := w.insert(tx, objs); e != nil {
+		tx.Discard()
+		return e
+	}
+	return tx.Commit()
+}
 
-			_id := ToBigEndianBytes(id)
-			_address := []byte(o.Address)
-			_amount := o.Amount.Bytes()
-			_nonce := ToBigEndianBytes(o.Nonce)
-			_status := ToBigEndianBytes(o.Status)
-			_hash := []byte(o.Hash)
-			_created := ToBigEndianBytes(o.Created)
-			_modified := ToBigEndianBytes(o.Modified)
+// insert writes objs within tx, setting their ids. A new withdrawal the approval policy of
+// its chain applies to awaits approval, setting its Status and Approvers.
+func (w *WdDB) insert(tx *leveldb.Transaction, objs []*DbWithdrawalObj) error {
+	policies := make(map[string]*ApprovalPolicy)
+	for _, o := range objs {
+		ns := w
+		if o.Chain != w.chain {
+			ns = w.ForChain(o.Chain)
+		}
 
-			if err := tx.Put(append([]byte("address-"), _id...), _address, nil); err != nil {
-				return err
+		id, err := ns.GetAndIncreasePrimaryKey(tx)
+		if err != nil {
+			return err
+		}
+
+		if o.Status == StatusInit {
+			policy, ok := policies[o.Chain]
+			if !ok {
+				if policy, err = ns.approvalPolicy(tx); err != nil {
+					return err
+				}
+				policies[o.Chain] = policy
 			}
-			if err := tx.Put(append([]byte("amount-"), _id...), _amount, nil); err != nil {
-				return err
+			if o.Approvers = policy.Required(o.Token, o.Amount); o.Approvers > 0 {
+				o.Status = StatusAwaitingApproval
 			}
-			if err := tx.Put(append([]byte("nonce-"), _id...), _nonce, nil); err != nil {
+		}
+
+		_address := []byte(o.Address)
+		_token := []byte(o.Token)
+		_amount := o.Amount.Bytes()
+		_nonce := ToBigEndianBytes(o.Nonce)
+		_status := ToBigEndianBytes(o.Status)
+		_hash := []byte(o.Hash)
+		_created := ToBigEndianBytes(o.Created)
+		_modified := ToBigEndianBytes(o.Modified)
+
+		if err := tx.Put(ns.key("address-", id), _address, nil); err != nil {
+			return err
+		}
+		if err := tx.Put(ns.key("token-", id), _token, nil); err != nil {
+			return err
+		}
+		if err := tx.Put(ns.key("amount-", id), _amount, nil); err != nil {
+			return err
+		}
+		if err := tx.Put(ns.key("nonce-", id), _nonce, nil); err != nil {
+			return err
+		}
+		if err := tx.Put(ns.key("status-", id), _status, nil); err != nil {
+			return err
+		}
+		if err := tx.Put(ns.key("hash-", id), _hash, nil); err != nil {
+			return err
+		}
+		if err := tx.Put(ns.key("created-", id), _created, nil); err != nil {
+			return err
+		}
+		if err := tx.Put(ns.key("modified-", id), _modified, nil); err != nil {
+			return err
+		}
+		if o.Batch != 0 {
+			if err := tx.Put(ns.key("batch-", id), ToBigEndianBytes(o.Batch), nil); err != nil {
 				return err
 			}
-			if err := tx.Put(append([]byte("status-"), _id...), _status, nil); err != nil {
+		}
+		if o.NotBefore != 0 {
+			if err := tx.Put(ns.key("notbefore-", id), ToBigEndianBytes(o.NotBefore), nil); err != nil {
 				return err
 			}
-			if err := tx.Put(append([]byte("hash-"), _id...), _hash, nil); err != nil {
+		}
+		if o.Expiry != 0 {
+			if err := tx.Put(ns.key("expiry-", id), ToBigEndianBytes(o.Expiry), nil); err != nil {
 				return err
 			}
-			if err := tx.Put(append([]byte("created-"), _id...), _created, nil); err != nil {
+		}
+		if o.Priority != 0 {
+			if err := tx.Put(ns.key("priority-", id), ToBigEndianBytes(o.Priority), nil); err != nil {
 				return err
 			}
-			if err := tx.Put(append([]byte("modified-"), _id...), _modified, nil); err != nil {
+		}
+		if o.Approvers != 0 {
+			if err := tx.Put(ns.key("approvers-", id), ToBigEndianBytes(o.Approvers), nil); err != nil {
 				return err
 			}
 		}
-		return nil
-	}()
-
-	if e != nil {
-		tx.Discard()
-		return e
+		o.Id = id
 	}
-	return tx.Commit()
+	return nil
 }
 
 func (w *WdDB) Insert(
@@ -112,53 +252,351 @@ func (w *WdDB) Insert(
 }
 
 func (w *WdDB) GetWdObjById(id uint64) (*DbWithdrawalObj, error) {
-	ans := DbWithdrawalObj{Id: id}
-	idInBytes := ToBigEndianBytes(id)
+	ans := DbWithdrawalObj{Id: id, Chain: w.chain}
 
-	if v, err := w.db.Get(append([]byte("address-"), idInBytes...), nil); err != nil {
+	if v, err := w.db.Get(w.key("address-", id), nil); err != nil {
 		return nil, err
 	} else {
 		ans.Address = string(v)
 	}
 
-	if v, err := w.db.Get(append([]byte("amount-"), idInBytes...), nil); err != nil {
+	if v, err := w.db.Get(w.key("amount-", id), nil); err != nil {
 		return nil, err
 	} else {
 		ans.Amount = big.NewInt(0).SetBytes(v)
 	}
 
-	if v, err := w.db.Get(append([]byte("nonce-"), idInBytes...), nil); err != nil {
+	if v, err := w.db.Get(w.key("nonce-", id), nil); err != nil {
 		return nil, err
 	} else {
 		ans.Nonce, _ = FromBigEndianBytes(v)
 	}
 
-	if v, err := w.db.Get(append([]byte("status-"), idInBytes...), nil); err != nil {
+	if v, err := w.db.Get(w.key("status-", id), nil); err != nil {
 		return nil, err
 	} else {
 		ans.Status, _ = FromBigEndianBytes(v)
 	}
 
-	if v, err := w.db.Get(append([]byte("hash-"), idInBytes...), nil); err != nil {
+	if v, err := w.db.Get(w.key("hash-", id), nil); err != nil {
 		return nil, err
 	} else {
 		ans.Hash = string(v)
 	}
 
-	if v, err := w.db.Get(append([]byte("created-"), idInBytes...), nil); err != nil {
+	if v, err := w.db.Get(w.key("created-", id), nil); err != nil {
 		return nil, err
 	} else {
 		ans.Created, _ = FromBigEndianBytes(v)
 	}
 
-	if v, err := w.db.Get(append([]byte("modified-"), idInBytes...), nil); err != nil {
+	if v, err := w.db.Get(w.key("modified-", id), nil); err != nil {
 		return nil, err
 	} else {
 		ans.Modified, _ = FromBigEndianBytes(v)
 	}
+
+	// optional fields, absent on records written by older versions
+	if v, err := w.getOptional(w.key("token-", id)); err != nil {
+		return nil, err
+	} else {
+		ans.Token = string(v)
+	}
+
+	if v, err := w.getOptional(w.key("cancelhash-", id)); err != nil {
+		return nil, err
+	} else {
+		ans.CancelHash = string(v)
+	}
+
+	if v, err := w.getOptional(w.key("reason-", id)); err != nil {
+		return nil, err
+	} else {
+		ans.Reason = string(v)
+	}
+
+	if v, err := w.getOptional(w.key("batch-", id)); err != nil {
+		return nil, err
+	} else if len(v) > 0 {
+		ans.Batch, _ = FromBigEndianBytes(v)
+	}
+
+	if notBefore, expiry, err := w.getWindow(id); err != nil {
+		return nil, err
+	} else {
+		ans.NotBefore, ans.Expiry = notBefore, expiry
+	}
+
+	if priority, err := w.getPriority(id); err != nil {
+		return nil, err
+	} else {
+		ans.Priority = priority
+	}
+
+	if v, err := w.getOptional(w.key("approvers-", id)); err != nil {
+		return nil, err
+	} else if len(v) > 0 {
+		ans.Approvers, _ = FromBigEndianBytes(v)
+	}
+
+	if number, hash, err := w.GetBlock(id); err != nil {
+		return nil, err
+	} else {
+		ans.BlockNumber, ans.BlockHash = number, hash
+	}
+
+	if v, err := w.getOptional(w.key("gasused-", id)); err != nil {
+		return nil, err
+	} else if len(v) > 0 {
+		ans.GasUsed, _ = FromBigEndianBytes(v)
+	}
+
+	if v, err := w.getOptional(w.key("gasprice-", id)); err != nil {
+		return nil, err
+	} else if len(v) > 0 {
+		ans.GasPrice = big.NewInt(0).SetBytes(v)
+	}
+
+	if v, err := w.getOptional(w.key("fee-", id)); err != nil {
+		return nil, err
+	} else if len(v) > 0 {
+		ans.Fee = big.NewInt(0).SetBytes(v)
+	}
 	return &ans, nil
 }
 
+func (w *WdDB) getOptional(key []byte) ([]byte, error) {
+	v, err := w.db.Get(key, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	return v, err
+}
+
+// UpdateTransaction records the nonce, hash and signed bytes of the transaction broadcast
+// for withdrawal id, an empty hash clearing them.
+func (w *WdDB) UpdateTransaction(id uint64, nonce uint64, hash string, raw []byte) error {
+	batch := new(leveldb.Batch)
+	batch.Put(w.key("nonce-", id), ToBigEndianBytes(nonce))
+	batch.Put(w.key("hash-", id), []byte(hash))
+	if len(raw) > 0 {
+		batch.Put(w.key("rawtx-", id), raw)
+	} else {
+		batch.Delete(w.key("rawtx-", id))
+	}
+	batch.Put(w.key("modified-", id), ToBigEndianBytes(uint64(time.Now().Unix())))
+	return w.db.Write(batch, nil)
+}
+
+// SetPaidTogether records that transaction hash pays the withdrawals ids, the batch its
+// fee is shared by.
+func (w *WdDB) SetPaidTogether(hash string, ids []uint64) error {
+	v := make([]byte, 0, 8*len(ids))
+	for _, id := range ids {
+		v = append(v, ToBigEndianBytes(id)...)
+	}
+	return w.db.Put(w.prefixed([]byte("paidby-"+hash)), v, nil)
+}
+
+// PaidTogether returns the withdrawals recorded by SetPaidTogether for transaction hash,
+// none for a single payout.
+func (w *WdDB) PaidTogether(hash string) ([]uint64, error) {
+	v, err := w.getOptional(w.prefixed([]byte("paidby-" + hash)))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(v)/8)
+	for i := 0; i+8 <= len(v); i += 8 {
+		id, _ := FromBigEndianBytes(v[i : i+8])
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// sharingTransaction returns the withdrawals in flight paid by the transaction hash, one
+// unless it is a disperse call.
+func (w *WdDB) sharingTransaction(hash string) ([]uint64, error) {
+	return w.matching(StatusProcessing, "hash-", hash)
+}
+
+// sharingCancellation returns the withdrawals being cancelled by the transaction hash.
+func (w *WdDB) sharingCancellation(hash string) ([]uint64, error) {
+	return w.matching(StatusCancelling, "cancelhash-", hash)
+}
+
+// matching returns the withdrawals in status whose field equals value.
+func (w *WdDB) matching(status uint64, field string, value string) ([]uint64, error) {
+	ids, err := w.GetRecordsIdByStatus(status)
+	if err != nil {
+		return nil, err
+	}
+
+	var ans []uint64
+	for _, id := range ids {
+		v, err := w.getOptional(w.key(field, id))
+		if err != nil {
+			return nil, err
+		}
+		if string(v) == value {
+			ans = append(ans, id)
+		}
+	}
+	return ans, nil
+}
+
+// GetRawTransaction returns the signed transaction recorded by UpdateTransaction for
+// withdrawal id, nil if none was.
+func (w *WdDB) GetRawTransaction(id uint64) ([]byte, error) {
+	return w.getOptional(w.key("rawtx-", id))
+}
+
+// SetCancelTransaction records the hash and signed bytes of the cancellation transaction
+// broadcast for withdrawal id, an empty hash clearing them.
+func (w *WdDB) SetCancelTransaction(id uint64, hash string, raw []byte) error {
+	batch := new(leveldb.Batch)
+	batch.Put(w.key("cancelhash-", id), []byte(hash))
+	if len(raw) > 0 {
+		batch.Put(w.key("cancelrawtx-", id), raw)
+	} else {
+		batch.Delete(w.key("cancelrawtx-", id))
+	}
+	batch.Put(w.key("modified-", id), ToBigEndianBytes(uint64(time.Now().Unix())))
+	return w.db.Write(batch, nil)
+}
+
+// GetCancelTransaction returns the signed cancellation recorded by SetCancelTransaction
+// for withdrawal id, nil if none was.
+func (w *WdDB) GetCancelTransaction(id uint64) ([]byte, error) {
+	return w.getOptional(w.key("cancelrawtx-", id))
+}
+
+// SetReason records why withdrawal id failed.
+func (w *WdDB) SetReason(id uint64, reason string) error {
+	batch := new(leveldb.Batch)
+	batch.Put(w.key("reason-", id), []byte(reason))
+	batch.Put(w.key("modified-", id), ToBigEndianBytes(uint64(time.Now().Unix())))
+	return w.db.Write(batch, nil)
+}
+
+// SetBlock records the block including the transaction of withdrawal id, an empty hash
+// meaning it is not included in any.
+func (w *WdDB) SetBlock(id uint64, number uint64, hash string) error {
+	previous, previousHash, err := w.GetBlock(id)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	if previousHash != "" {
+		batch.Delete(w.blockIndexKey(previous, id))
+	}
+	if hash != "" {
+		batch.Put(w.blockIndexKey(number, id), nil)
+	}
+	batch.Put(w.key("blocknumber-", id), ToBigEndianBytes(number))
+	batch.Put(w.key("blockhash-", id), []byte(hash))
+	batch.Put(w.key("modified-", id), ToBigEndianBytes(uint64(time.Now().Unix())))
+	return w.db.Write(batch, nil)
+}
+
+// GetBlock returns the block recorded by SetBlock for withdrawal id.
+func (w *WdDB) GetBlock(id uint64) (uint64, string, error) {
+	hash, err := w.getOptional(w.key("blockhash-", id))
+	if err != nil || len(hash) == 0 {
+		return 0, "", err
+	}
+
+	v, err := w.db.Get(w.key("blocknumber-", id), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	number, err := FromBigEndianBytes(v)
+	return number, string(hash), err
+}
+
+// SetRecheckSince records number as the first block whose withdrawals are rechecked for
+// reorgs, the status of those in earlier blocks being final.
+func (w *WdDB) SetRecheckSince(number uint64) error {
+	return w.db.Put(w.prefixed([]byte("kv-rechecksince")), ToBigEndianBytes(number), nil)
+}
+
+// blockIndexKey is the key indexing withdrawal id under the block number including it.
+func (w *WdDB) blockIndexKey(number uint64, id uint64) []byte {
+	return append(w.key("blockindex-", number), ToBigEndianBytes(id)...)
+}
+
+// GetRecordsIdSinceBlock returns the withdrawals recorded by SetBlock in block number or
+// a later one, in order of block.
+func (w *WdDB) GetRecordsIdSinceBlock(number uint64) ([]uint64, error) {
+	prefix := w.prefixed([]byte("blockindex-"))
+	itr := w.db.NewIterator(&util.Range{
+		Start: w.key("blockindex-", number),
+		Limit: util.BytesPrefix(prefix).Limit,
+	}, nil)
+	defer itr.Release()
+
+	var ans []uint64
+	for itr.Next() {
+		v, err := FromBigEndianBytes(itr.Key()[len(prefix)+8:])
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, v)
+	}
+	return ans, itr.Error()
+}
+
+// IndexBlocks indexes the withdrawals recorded in a block before the index existed, once.
+func (w *WdDB) IndexBlocks() error {
+	marker := w.prefixed([]byte("kv-blockindex"))
+	if ok, err := w.db.Has(marker, nil); err != nil || ok {
+		return err
+	}
+
+	prefix := w.prefixed([]byte("blockhash-"))
+	itr := w.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer itr.Release()
+
+	batch := new(leveldb.Batch)
+	for itr.Next() {
+		if len(itr.Value()) == 0 {
+			continue
+		}
+		id, err := FromBigEndianBytes(itr.Key()[len(prefix):])
+		if err != nil {
+			return err
+		}
+		number, _, err := w.GetBlock(id)
+		if err != nil {
+			return err
+		}
+		batch.Put(w.blockIndexKey(number, id), nil)
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+	batch.Put(marker, ToBigEndianBytes(1))
+	return w.db.Write(batch, nil)
+}
+
+// SetFee records the execution of the transaction of withdrawal id, nil prices clearing it.
+func (w *WdDB) SetFee(id uint64, gasUsed uint64, gasPrice *big.Int, fee *big.Int) error {
+	batch := new(leveldb.Batch)
+	if gasPrice == nil || fee == nil {
+		batch.Delete(w.key("gasused-", id))
+		batch.Delete(w.key("gasprice-", id))
+		batch.Delete(w.key("fee-", id))
+	} else {
+		batch.Put(w.key("gasused-", id), ToBigEndianBytes(gasUsed))
+		// a zero price is stored as a single zero byte, as empty means unknown
+		batch.Put(w.key("gasprice-", id), append([]byte{0}, gasPrice.Bytes()...))
+		batch.Put(w.key("fee-", id), append([]byte{0}, fee.Bytes()...))
+	}
+	batch.Put(w.key("modified-", id), ToBigEndianBytes(uint64(time.Now().Unix())))
+	return w.db.Write(batch, nil)
+}
+
 func (w *WdDB) CompareAndSwapStatus(key []byte, from, to uint64) error {
 	rawValue, err := w.db.Get(key, nil)
 	if err != nil {
@@ -178,14 +616,140 @@ func (w *WdDB) CompareAndSwapStatus(key []byte, from, to uint64) error {
 }
 
 func (w *WdDB) GetUnhandledRecordsId() ([]uint64, error) {
-	itr := w.db.NewIterator(util.BytesPrefix([]byte("status-")), nil)
-	initialStatus := ToBigEndianBytes(0)
+	return w.GetRecordsIdByStatus(StatusInit)
+}
+
+// GetDueRecordsId splits the unhandled withdrawals into those payable at now, in the order
+// they are paid, and those whose expiry passed. Withdrawals whose not-before time has not
+// come are in neither. Due withdrawals are ordered by priority, highest first, then by
+// not-before time and id.
+func (w *WdDB) GetDueRecordsId(now time.Time) (due []uint64, expired []uint64, err error) {
+	ids, err := w.GetUnhandledRecordsId()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type entry struct {
+		id        uint64
+		priority  uint64
+		notBefore uint64
+	}
+	var queue []entry
+
+	t := uint64(now.Unix())
+	for _, id := range ids {
+		notBefore, expiry, err := w.getWindow(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case expiry != 0 && t >= expiry:
+			expired = append(expired, id)
+		case t >= notBefore:
+			priority, err := w.getPriority(id)
+			if err != nil {
+				return nil, nil, err
+			}
+			queue = append(queue, entry{id: id, priority: priority, notBefore: notBefore})
+		}
+	}
+
+	sort.Slice(queue, func(i, j int) bool {
+		a, b := queue[i], queue[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if a.notBefore != b.notBefore {
+			return a.notBefore < b.notBefore
+		}
+		return a.id < b.id
+	})
+	for _, e := range queue {
+		due = append(due, e.id)
+	}
+	return due, expired, nil
+}
+
+func (w *WdDB) getPriority(id uint64) (uint64, error) {
+	v, err := w.getOptional(w.key("priority-", id))
+	if err != nil || len(v) == 0 {
+		return 0, err
+	}
+	return FromBigEndianBytes(v)
+}
+
+// SetPriority changes the priority of withdrawal id, queued or awaiting approval, failing
+// with ErrNotPending once it is neither.
+func (w *WdDB) SetPriority(id uint64, priority uint64) error {
+	tx, err := w.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	v, err := tx.Get(w.StatusKey(id), nil)
+	if err != nil {
+		tx.Discard()
+		return err
+	}
+	if status, _ := FromBigEndianBytes(v); status != StatusInit && status != StatusAwaitingApproval {
+		tx.Discard()
+		return fmt.Errorf("%w, id: %v status: %v", ErrNotPending, id, status)
+	}
+
+	if err := tx.Put(w.key("priority-", id), ToBigEndianBytes(priority), nil); err != nil {
+		tx.Discard()
+		return err
+	}
+	if err := tx.Put(w.key("modified-", id), ToBigEndianBytes(uint64(time.Now().Unix())), nil); err != nil {
+		tx.Discard()
+		return err
+	}
+	return tx.Commit()
+}
+
+// getWindow returns the not-before time and the expiry of withdrawal id, 0 when unset.
+func (w *WdDB) getWindow(id uint64) (notBefore, expiry uint64, err error) {
+	if v, err := w.getOptional(w.key("notbefore-", id)); err != nil {
+		return 0, 0, err
+	} else if len(v) > 0 {
+		notBefore, _ = FromBigEndianBytes(v)
+	}
+
+	if v, err := w.getOptional(w.key("expiry-", id)); err != nil {
+		return 0, 0, err
+	} else if len(v) > 0 {
+		expiry, _ = FromBigEndianBytes(v)
+	}
+	return notBefore, expiry, nil
+}
+
+// GetRecordsId returns the ids of every withdrawal, whatever its status.
+func (w *WdDB) GetRecordsId() ([]uint64, error) {
+	prefix := w.prefixed([]byte("status-"))
+	itr := w.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer itr.Release()
+
+	var ans []uint64
+	for itr.Next() {
+		v, err := FromBigEndianBytes(itr.Key()[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, v)
+	}
+	return ans, itr.Error()
+}
+
+func (w *WdDB) GetRecordsIdByStatus(status uint64) ([]uint64, error) {
+	prefix := w.prefixed([]byte("status-"))
+	itr := w.db.NewIterator(util.BytesPrefix(prefix), nil)
+	expected := ToBigEndianBytes(status)
 
 	var ans []uint64
 
 	for itr.Next() {
-		if bytes.Compare(initialStatus, itr.Value()) == 0 {
-			v, err := FromBigEndianBytes(itr.Key()[7:])
+		if bytes.Compare(expected, itr.Value()) == 0 {
+			v, err := FromBigEndianBytes(itr.Key()[len(prefix):])
 			if err != nil {
 				return nil, err
 			}
@@ -200,8 +764,10 @@ func (w *WdDB) GetUnhandledRecordsId() ([]uint64, error) {
 }
 
 func (w *WdDB) GetAndIncreasePrimaryKey(tx *leveldb.Transaction) (uint64, error) {
-	idRaw, err := tx.Get([]byte("kv-id"), nil)
-	if err != nil {
+	idRaw, err := tx.Get(w.prefixed([]byte("kv-id")), nil)
+	if errors.Is(err, leveldb.ErrNotFound) && w.chain != "" {
+		return 0, fmt.Errorf("db not initialized for chain %q: %w", w.chain, err)
+	} else if err != nil {
 		return 0, err
 	}
 
@@ -211,10 +777,11 @@ func (w *WdDB) GetAndIncreasePrimaryKey(tx *leveldb.Transaction) (uint64, error)
 	}
 
 	id += 1
-	return id, tx.Put([]byte("kv-id"), ToBigEndianBytes(id), nil)
+	return id, tx.Put(w.prefixed([]byte("kv-id")), ToBigEndianBytes(id), nil)
 }
 
 func (w *WdDB) GetOrSet(key []byte, initValue []byte) error {
+	key = w.prefixed(key)
 	if ok, err := w.db.Has(key, nil); err != nil {
 		return err
 	} else if ok {
@@ -223,3 +790,85 @@ func (w *WdDB) GetOrSet(key []byte, initValue []byte) error {
 
 	return w.db.Put(key, initValue, nil)
 }
+
+// settlePayouts goes through the amounts recorded under field for withdrawals paying what
+// the db owes, like vested amounts or dust, within tx. Each withdrawal done without paying
+// is given to credit, so that what it owed is owed again, and forgotten as the confirmed ones.
+// Withdrawals done in a block still rechecked for reorgs are left for later, a reorg may
+// hand them back to the tracker.
+func (w *WdDB) settlePayouts(tx *leveldb.Transaction, field string, credit func(id uint64, amount *big.Int) error) error {
+	since := uint64(0)
+	if v, err := tx.Get(w.prefixed([]byte("kv-rechecksince")), nil); err == nil {
+		since, _ = FromBigEndianBytes(v)
+	} else if !errors.Is(err, leveldb.ErrNotFound) {
+		return err
+	}
+
+	prefix := w.prefixed([]byte(field))
+	itr := tx.NewIterator(util.BytesPrefix(prefix), nil)
+	var (
+		ids     []uint64
+		amounts []*big.Int
+	)
+	for itr.Next() {
+		id, err := FromBigEndianBytes(itr.Key()[len(prefix):])
+		if err != nil {
+			itr.Release()
+			return err
+		}
+		ids = append(ids, id)
+		amounts = append(amounts, big.NewInt(0).SetBytes(itr.Value()))
+	}
+	itr.Release()
+	if err := itr.Error(); err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		raw, err := tx.Get(w.StatusKey(id), nil)
+		if err != nil {
+			return err
+		}
+		status, err := FromBigEndianBytes(raw)
+		if err != nil {
+			return err
+		}
+
+		if !unpaid(status) && status != StatusConfirmed {
+			continue
+		}
+		if final, err := w.finalIn(tx, id, since); err != nil {
+			return err
+		} else if !final {
+			continue
+		}
+
+		if unpaid(status) {
+			if err := credit(id, amounts[i]); err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(w.key(field, id), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finalIn reports within tx whether the status of withdrawal id is final, being recorded
+// in no block or in one before since, the first block rechecked for reorgs.
+func (w *WdDB) finalIn(tx *leveldb.Transaction, id uint64, since uint64) (bool, error) {
+	hash, err := tx.Get(w.key("blockhash-", id), nil)
+	if errors.Is(err, leveldb.ErrNotFound) || (err == nil && len(hash) == 0) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	v, err := tx.Get(w.key("blocknumber-", id), nil)
+	if err != nil {
+		return false, err
+	}
+	number, err := FromBigEndianBytes(v)
+	return number < since, err
+}
@@ -2,9 +2,12 @@ package eth_multi_transactions
 
 import (
     "fmt"
+    "math/big"
     "testing"
+    "time"
 
     "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
     "github.com/syndtr/goleveldb/leveldb"
     "github.com/syndtr/goleveldb/leveldb/util"
 
@@ -122,3 +125,70 @@ func TestWdDB_GetWdObjById(t *testing.T) {
 
     fmt.Printf("%+v %v\n", ans, ans.Amount.String())
 }
+
+func TestWdDB_BlockIndex(t *testing.T) {
+    db := newTestDB(t)
+    ids := insertTestWithdrawals(t, db,
+        &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001001", Amount: big.NewInt(1)},
+        &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001002", Amount: big.NewInt(1)},
+        &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001003", Amount: big.NewInt(1)},
+    )
+    require.NoError(t, db.SetBlock(ids[0], 5, "0x05"))
+    require.NoError(t, db.SetBlock(ids[1], 10, "0x0a"))
+    require.NoError(t, db.SetBlock(ids[2], 10, "0x0a"))
+
+    since, err := db.GetRecordsIdSinceBlock(6)
+    require.NoError(t, err)
+    assert.Equal(t, ids[1:], since)
+
+    // moving to another block or out of any moves the index along
+    require.NoError(t, db.SetBlock(ids[0], 11, "0x0b"))
+    require.NoError(t, db.SetBlock(ids[1], 0, ""))
+    since, err = db.GetRecordsIdSinceBlock(6)
+    require.NoError(t, err)
+    assert.Equal(t, []uint64{ids[2], ids[0]}, since)
+
+    // withdrawals recorded before the index existed are indexed once
+    require.NoError(t, db.db.Delete(db.blockIndexKey(11, ids[0]), nil))
+    require.NoError(t, db.IndexBlocks())
+    since, err = db.GetRecordsIdSinceBlock(0)
+    require.NoError(t, err)
+    assert.Equal(t, []uint64{ids[2], ids[0]}, since)
+
+    require.NoError(t, db.db.Delete(db.blockIndexKey(11, ids[0]), nil))
+    require.NoError(t, db.IndexBlocks())
+    since, err = db.GetRecordsIdSinceBlock(0)
+    require.NoError(t, err)
+    assert.Equal(t, []uint64{ids[2]}, since)
+}
+
+func TestWdDB_Priority(t *testing.T) {
+    db := newTestDB(t)
+
+    now := uint64(time.Now().Unix())
+    ids := insertTestWithdrawals(t, db,
+        &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001001", Amount: big.NewInt(1)},
+        &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001002", Amount: big.NewInt(2), NotBefore: now - 60},
+        &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001003", Amount: big.NewInt(3), Priority: 1},
+        &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001004", Amount: big.NewInt(4)},
+    )
+
+    // by priority, then the oldest not-before time, then id
+    due, _, err := db.GetDueRecordsId(time.Now())
+    require.NoError(t, err)
+    assert.Equal(t, []uint64{ids[2], ids[0], ids[3], ids[1]}, due)
+
+    require.NoError(t, db.SetPriority(ids[3], 5))
+    due, _, err = db.GetDueRecordsId(time.Now())
+    require.NoError(t, err)
+    assert.Equal(t, []uint64{ids[3], ids[2], ids[0], ids[1]}, due)
+
+    // still pending while awaiting approval, not once in flight
+    require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(ids[1]), StatusInit, StatusAwaitingApproval))
+    require.NoError(t, db.SetPriority(ids[1], 2))
+    require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(ids[3]), StatusInit, StatusProcessing))
+    assert.ErrorIs(t, db.SetPriority(ids[3], 0), ErrNotPending)
+    obj, err := db.GetWdObjById(ids[3])
+    require.NoError(t, err)
+    assert.Equal(t, uint64(5), obj.Priority)
+}
@@ -0,0 +1,94 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+// abi of contracts/Disperse.sol, compatible with the contract deployed by disperse.app
+const disperseABI = `[
+	{"inputs":[{"name":"recipients","type":"address[]"},{"name":"values","type":"uint256[]"}],"name":"disperseEther","outputs":[],"stateMutability":"payable","type":"function"},
+	{"inputs":[{"name":"token","type":"address"},{"name":"recipients","type":"address[]"},{"name":"values","type":"uint256[]"}],"name":"disperseToken","outputs":[],"stateMutability":"nonpayable","type":"function"}
+]`
+
+var disperse = mustParseABI(disperseABI)
+
+// SignDisperseTransaction builds and signs a single disperse call paying every obj at the
+// given nonce. All objs must carry the same token; token batches need an allowance for
+// the disperse contract, see SignApproveTransaction.
+func SignDisperseTransaction(
+	ctx context.Context,
+	objs []*DbWithdrawalObj,
+	backend ChainClient,
+	contract common.Address,
+	nonce uint64,
+	fromAddr common.Address,
+	prvKey *ecdsa.PrivateKey,
+	chainID *big.Int,
+	policy TxPolicy,
+) (*types.Transaction, error) {
+	if len(objs) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+
+	token := objs[0].Token
+	recipients := make([]common.Address, 0, len(objs))
+	values := make([]*big.Int, 0, len(objs))
+	total := big.NewInt(0)
+	for _, o := range objs {
+		if o.Token != token {
+			return nil, fmt.Errorf("mixed tokens in batch: %q and %q", token, o.Token)
+		}
+		recipients = append(recipients, common.HexToAddress(o.Address))
+		values = append(values, o.Amount)
+		total.Add(total, o.Amount)
+	}
+
+	var (
+		data  []byte
+		value = big.NewInt(0)
+		err   error
+	)
+	if token == "" {
+		data, err = disperse.Pack("disperseEther", recipients, values)
+		value = total
+	} else {
+		data, err = disperse.Pack("disperseToken", common.HexToAddress(token), recipients, values)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("disperse", "nonce", nonce, "token", token, "count", len(objs), "total", total)
+	return signTransaction(ctx, backend, contract, value, data, nonce, fromAddr, prvKey, chainID, policy)
+}
+
+// SignApproveTransaction builds and signs an ERC-20 approval of spender for amount, which
+// replaces its allowance.
+func SignApproveTransaction(
+	ctx context.Context,
+	backend ChainClient,
+	token common.Address,
+	spender common.Address,
+	amount *big.Int,
+	nonce uint64,
+	fromAddr common.Address,
+	prvKey *ecdsa.PrivateKey,
+	chainID *big.Int,
+	policy TxPolicy,
+) (*types.Transaction, error) {
+	data, err := erc20.Pack("approve", spender, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("approve", "nonce", nonce, "token", token, "spender", spender, "amount", amount)
+	return signTransaction(ctx, backend, token, big.NewInt(0), data, nonce, fromAddr, prvKey, chainID, policy)
+}
@@ -0,0 +1,148 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+// chain id of backends.SimulatedBackend
+var simChainID = big.NewInt(1337)
+
+func newTestBackend(t *testing.T) (*backends.SimulatedBackend, *ecdsa.PrivateKey, common.Address) {
+	logger.Init(logger.DebugLevel)
+
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	addr := crypto.PubkeyToAddress(key.PublicKey)
+
+	funds := big.NewInt(0).Mul(big.NewInt(1000), Ether)
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{addr: {Balance: funds}}, 30000000)
+	t.Cleanup(func() { sim.Close() })
+	return sim, key, addr
+}
+
+// deployTestContract deploys contracts/<name>.bin, compiled from contracts/<name>.sol
+// with solc 0.8.21 for the london evm.
+func deployTestContract(t *testing.T, sim *backends.SimulatedBackend, key *ecdsa.PrivateKey, name string, params ...interface{}) common.Address {
+	rawABI, err := os.ReadFile("contracts/" + name + ".abi")
+	require.NoError(t, err)
+	bin, err := os.ReadFile("contracts/" + name + ".bin")
+	require.NoError(t, err)
+
+	parsed, err := abi.JSON(strings.NewReader(string(rawABI)))
+	require.NoError(t, err)
+
+	opts, err := bind.NewKeyedTransactorWithChainID(key, simChainID)
+	require.NoError(t, err)
+
+	addr, _, _, err := bind.DeployContract(opts, parsed, common.FromHex(strings.TrimSpace(string(bin))), sim, params...)
+	require.NoError(t, err)
+	sim.Commit()
+	return addr
+}
+
+func TestSignDisperseTransaction_Ether(t *testing.T) {
+	sim, key, from := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+	contract := deployTestContract(t, sim, key, "Disperse")
+
+	objs := []*DbWithdrawalObj{
+		{Id: 2, Address: "0x0000000000000000000000000000000000000a01", Amount: big.NewInt(100)},
+		{Id: 3, Address: "0x0000000000000000000000000000000000000a02", Amount: big.NewInt(200)},
+		{Id: 4, Address: "0x0000000000000000000000000000000000000a03", Amount: Ether},
+	}
+
+	nonce, err := sim.PendingNonceAt(context.Background(), from)
+	require.NoError(t, err)
+
+	tx, err := SignDisperseTransaction(context.Background(), objs, client, contract, nonce, from, key, simChainID, DefaultTxPolicy)
+	require.NoError(t, err)
+	require.NoError(t, sim.SendTransaction(context.Background(), tx))
+	sim.Commit()
+
+	receipt, err := sim.TransactionReceipt(context.Background(), tx.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), receipt.Status)
+
+	for _, o := range objs {
+		balance, err := sim.BalanceAt(context.Background(), common.HexToAddress(o.Address), nil)
+		require.NoError(t, err)
+		assert.Equal(t, o.Amount.String(), balance.String(), o.Address)
+	}
+
+	// the contract forwards nothing it was not asked to
+	balance, err := sim.BalanceAt(context.Background(), contract, nil)
+	require.NoError(t, err)
+	assert.Zero(t, balance.Sign())
+}
+
+func TestSignDisperseTransaction_Token(t *testing.T) {
+	sim, key, from := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+	contract := deployTestContract(t, sim, key, "Disperse")
+	token := deployTestContract(t, sim, key, "TestToken", big.NewInt(1000000))
+
+	objs := []*DbWithdrawalObj{
+		{Id: 2, Address: "0x0000000000000000000000000000000000000b01", Token: token.Hex(), Amount: big.NewInt(1000)},
+		{Id: 3, Address: "0x0000000000000000000000000000000000000b02", Token: token.Hex(), Amount: big.NewInt(2500)},
+	}
+
+	allowance, err := TokenAllowance(context.Background(), client, token, from, contract)
+	require.NoError(t, err)
+	assert.Zero(t, allowance.Sign())
+
+	nonce, err := sim.PendingNonceAt(context.Background(), from)
+	require.NoError(t, err)
+
+	approve, err := SignApproveTransaction(context.Background(), client, token, contract, big.NewInt(3500), nonce, from, key, simChainID, DefaultTxPolicy)
+	require.NoError(t, err)
+	require.NoError(t, sim.SendTransaction(context.Background(), approve))
+	sim.Commit()
+
+	tx, err := SignDisperseTransaction(context.Background(), objs, client, contract, nonce+1, from, key, simChainID, DefaultTxPolicy)
+	require.NoError(t, err)
+	require.NoError(t, sim.SendTransaction(context.Background(), tx))
+	sim.Commit()
+
+	receipt, err := sim.TransactionReceipt(context.Background(), tx.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), receipt.Status)
+
+	for _, o := range objs {
+		balance, err := TokenBalance(context.Background(), client, token, common.HexToAddress(o.Address))
+		require.NoError(t, err)
+		assert.Equal(t, o.Amount.String(), balance.String(), o.Address)
+	}
+
+	balance, err := TokenBalance(context.Background(), client, token, from)
+	require.NoError(t, err)
+	assert.Equal(t, "996500", balance.String())
+}
+
+func TestSignDisperseTransaction_MixedTokens(t *testing.T) {
+	sim, key, from := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+
+	objs := []*DbWithdrawalObj{
+		{Address: "0x0000000000000000000000000000000000000c01", Amount: big.NewInt(1)},
+		{Address: "0x0000000000000000000000000000000000000c02", Token: "0x0000000000000000000000000000000000000d01", Amount: big.NewInt(1)},
+	}
+
+	_, err := SignDisperseTransaction(context.Background(), objs, client, common.Address{}, 0, from, key, simChainID, DefaultTxPolicy)
+	assert.Error(t, err)
+}
@@ -0,0 +1,278 @@
+package eth_multi_transactions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// Share is the part of a distributed amount paid to an address.
+type Share struct {
+	Address string
+	Amount  *big.Int
+	Min     *big.Int // minimum payout of the address, nil for none
+}
+
+// Distribution splits an amount among recipients. The shares and the leftover, the
+// wei no recipient could take, add up to the amount split.
+type Distribution interface {
+	Split(total *big.Int) (shares []Share, leftover *big.Int, err error)
+}
+
+// Recipient is an address in a distribution, each strategy using the fields it needs.
+type Recipient struct {
+	Address string   `json:"address"`
+	Weight  *big.Int `json:"weight,omitempty"`
+	Amount  *big.Int `json:"amount,omitempty"`
+	Cap     *big.Int `json:"cap,omitempty"`
+	Min     *big.Int `json:"min,omitempty"` // shares below it accrue as dust until they reach it
+}
+
+// WeightedSplit splits the amount in proportion to the weights of the recipients.
+type WeightedSplit struct {
+	Recipients []Recipient
+}
+
+func (d *WeightedSplit) Split(total *big.Int) ([]Share, *big.Int, error) {
+	weights := make([]*big.Int, len(d.Recipients))
+	for i, r := range d.Recipients {
+		weights[i] = r.Weight
+	}
+	amounts, leftover, err := splitByWeight(total, weights)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shares := make([]Share, len(d.Recipients))
+	for i, r := range d.Recipients {
+		shares[i] = Share{Address: r.Address, Amount: amounts[i], Min: r.Min}
+	}
+	return shares, leftover, nil
+}
+
+// FixedSplit pays every recipient its fixed amount and the rest to RemainderTo.
+type FixedSplit struct {
+	Recipients  []Recipient
+	RemainderTo string
+}
+
+func (d *FixedSplit) Split(total *big.Int) ([]Share, *big.Int, error) {
+	left := big.NewInt(0).Set(total)
+	shares := make([]Share, 0, len(d.Recipients)+1)
+	for _, r := range d.Recipients {
+		if r.Amount == nil || r.Amount.Sign() < 0 {
+			return nil, nil, fmt.Errorf("invalid amount for %s", r.Address)
+		}
+		left.Sub(left, r.Amount)
+		shares = append(shares, Share{Address: r.Address, Amount: big.NewInt(0).Set(r.Amount), Min: r.Min})
+	}
+	if left.Sign() < 0 {
+		return nil, nil, fmt.Errorf("fixed amounts exceed the total, total: %v short: %v", total, big.NewInt(0).Neg(left))
+	}
+
+	if d.RemainderTo == "" {
+		return shares, left, nil
+	}
+	return mergeShares(append(shares, Share{Address: d.RemainderTo, Amount: left})), big.NewInt(0), nil
+}
+
+// Tier splits the part of the amount up to UpTo, counted from the start of the amount and
+// nil for the rest of it, with its own distribution.
+type Tier struct {
+	UpTo         *big.Int
+	Distribution Distribution
+}
+
+// TieredSplit splits consecutive slices of the amount with the distribution of their tier,
+// like tax brackets. The amount above the last bounded tier is left over.
+type TieredSplit struct {
+	Tiers []Tier
+}
+
+func (d *TieredSplit) Split(total *big.Int) ([]Share, *big.Int, error) {
+	var shares []Share
+	leftover := big.NewInt(0)
+	from := big.NewInt(0)
+	for i, tier := range d.Tiers {
+		if from.Cmp(total) >= 0 {
+			break
+		}
+
+		to := total
+		if tier.UpTo != nil {
+			if tier.UpTo.Cmp(from) <= 0 {
+				return nil, nil, fmt.Errorf("tier %d does not go above the previous one", i)
+			}
+			if tier.UpTo.Cmp(total) < 0 {
+				to = tier.UpTo
+			}
+		}
+
+		s, l, err := tier.Distribution.Split(big.NewInt(0).Sub(to, from))
+		if err != nil {
+			return nil, nil, fmt.Errorf("tier %d: %w", i, err)
+		}
+		shares = append(shares, s...)
+		leftover.Add(leftover, l)
+		from = to
+	}
+
+	if from.Cmp(total) < 0 {
+		leftover.Add(leftover, big.NewInt(0).Sub(total, from))
+	}
+	return mergeShares(shares), leftover, nil
+}
+
+// CappedSplit splits the amount by weight without paying any recipient above its cap, the
+// overflow going to the recipients below their cap by weight. What no one can take is left over.
+type CappedSplit struct {
+	Recipients []Recipient
+}
+
+func (d *CappedSplit) Split(total *big.Int) ([]Share, *big.Int, error) {
+	shares := make([]Share, len(d.Recipients))
+	active := make([]int, 0, len(d.Recipients))
+	for i, r := range d.Recipients {
+		shares[i] = Share{Address: r.Address, Amount: big.NewInt(0), Min: r.Min}
+		if r.Cap != nil && r.Cap.Sign() < 0 {
+			return nil, nil, fmt.Errorf("invalid cap for %s", r.Address)
+		}
+		active = append(active, i)
+	}
+
+	left := big.NewInt(0).Set(total)
+	for len(active) > 0 && left.Sign() > 0 {
+		weights := make([]*big.Int, len(active))
+		for j, i := range active {
+			weights[j] = d.Recipients[i].Weight
+		}
+		amounts, _, err := splitByWeight(left, weights)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// recipients reaching their cap take what fits and leave the round
+		var uncapped []int
+		for j, i := range active {
+			c := d.Recipients[i].Cap
+			if c == nil || big.NewInt(0).Add(shares[i].Amount, amounts[j]).Cmp(c) < 0 {
+				uncapped = append(uncapped, i)
+				continue
+			}
+			left.Sub(left, big.NewInt(0).Sub(c, shares[i].Amount))
+			shares[i].Amount.Set(c)
+		}
+
+		if len(uncapped) == len(active) {
+			for j, i := range active {
+				shares[i].Amount.Add(shares[i].Amount, amounts[j])
+				left.Sub(left, amounts[j])
+			}
+			break
+		}
+		active = uncapped
+	}
+	return shares, left, nil
+}
+
+// splitByWeight splits total in proportion to weights conserving every wei: each part is
+// rounded down, then the wei left are handed one by one to the largest remainders, the
+// earlier recipient first on a tie.
+func splitByWeight(total *big.Int, weights []*big.Int) ([]*big.Int, *big.Int, error) {
+	sum := big.NewInt(0)
+	for _, w := range weights {
+		if w == nil || w.Sign() <= 0 {
+			return nil, nil, errors.New("weights must be positive")
+		}
+		sum.Add(sum, w)
+	}
+	if sum.Sign() == 0 {
+		return nil, nil, errors.New("no recipient")
+	}
+
+	left := big.NewInt(0).Set(total)
+	amounts := make([]*big.Int, len(weights))
+	remainders := make([]*big.Int, len(weights))
+	for i, w := range weights {
+		amounts[i], remainders[i] = big.NewInt(0).QuoRem(big.NewInt(0).Mul(total, w), sum, big.NewInt(0))
+		left.Sub(left, amounts[i])
+	}
+
+	// fewer wei are left than there are recipients
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]].Cmp(remainders[order[b]]) > 0
+	})
+	for _, i := range order {
+		if left.Sign() <= 0 {
+			break
+		}
+		amounts[i].Add(amounts[i], big.NewInt(1))
+		left.Sub(left, big.NewInt(1))
+	}
+	return amounts, left, nil
+}
+
+// mergeShares sums the shares of each address, in order of first appearance, keeping the
+// first minimum payout set for it.
+func mergeShares(shares []Share) []Share {
+	index := make(map[string]int)
+	var ans []Share
+	for _, s := range shares {
+		if i, ok := index[s.Address]; ok {
+			ans[i].Amount.Add(ans[i].Amount, s.Amount)
+			if ans[i].Min == nil {
+				ans[i].Min = s.Min
+			}
+			continue
+		}
+		index[s.Address] = len(ans)
+		ans = append(ans, Share{Address: s.Address, Amount: big.NewInt(0).Set(s.Amount), Min: s.Min})
+	}
+	return ans
+}
+
+// distributionConfig is the JSON form of the built-in distributions.
+type distributionConfig struct {
+	Type        string      `json:"type"` // weighted, fixed, tiered or capped
+	Recipients  []Recipient `json:"recipients,omitempty"`
+	RemainderTo string      `json:"remainderTo,omitempty"`
+	Tiers       []struct {
+		UpTo         *big.Int        `json:"upTo,omitempty"`
+		Distribution json.RawMessage `json:"distribution"`
+	} `json:"tiers,omitempty"`
+}
+
+// ParseDistribution builds a built-in distribution from its JSON form, for example
+// {"type": "weighted", "recipients": [{"address": "0x..", "weight": 1}]}.
+func ParseDistribution(raw []byte) (Distribution, error) {
+	var cfg distributionConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Type {
+	case "weighted":
+		return &WeightedSplit{Recipients: cfg.Recipients}, nil
+	case "fixed":
+		return &FixedSplit{Recipients: cfg.Recipients, RemainderTo: cfg.RemainderTo}, nil
+	case "capped":
+		return &CappedSplit{Recipients: cfg.Recipients}, nil
+	case "tiered":
+		d := &TieredSplit{}
+		for i, t := range cfg.Tiers {
+			inner, err := ParseDistribution(t.Distribution)
+			if err != nil {
+				return nil, fmt.Errorf("tier %d: %w", i, err)
+			}
+			d.Tiers = append(d.Tiers, Tier{UpTo: t.UpTo, Distribution: inner})
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown distribution type: %q", cfg.Type)
+}
@@ -0,0 +1,184 @@
+package eth_multi_transactions
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requireConserved checks that the shares and the leftover add up to total.
+func requireConserved(t *testing.T, total *big.Int, shares []Share, leftover *big.Int) {
+	sum := big.NewInt(0).Set(leftover)
+	for _, s := range shares {
+		require.True(t, s.Amount.Sign() >= 0, "negative share for %s", s.Address)
+		sum.Add(sum, s.Amount)
+	}
+	require.Equal(t, total.String(), sum.String())
+}
+
+func amounts(shares []Share) map[string]string {
+	ans := make(map[string]string)
+	for _, s := range shares {
+		ans[s.Address] = s.Amount.String()
+	}
+	return ans
+}
+
+func TestWeightedSplit(t *testing.T) {
+	d := &WeightedSplit{Recipients: []Recipient{
+		{Address: "a", Weight: big.NewInt(1)},
+		{Address: "b", Weight: big.NewInt(1)},
+		{Address: "c", Weight: big.NewInt(2)},
+	}}
+
+	for _, total := range []int64{0, 1, 7, 1000, 1000003} {
+		shares, leftover, err := d.Split(big.NewInt(total))
+		require.NoError(t, err)
+		requireConserved(t, big.NewInt(total), shares, leftover)
+	}
+
+	shares, _, err := d.Split(big.NewInt(400))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "100", "b": "100", "c": "200"}, amounts(shares))
+
+	_, _, err = (&WeightedSplit{Recipients: []Recipient{{Address: "a", Weight: big.NewInt(0)}}}).Split(big.NewInt(1))
+	assert.Error(t, err)
+}
+
+func TestSplitByWeight(t *testing.T) {
+	for _, c := range []struct {
+		total   int64
+		weights []int64
+		want    []string
+	}{
+		{10, []int64{1, 1, 1}, []string{"4", "3", "3"}},
+		{10, []int64{1, 2}, []string{"3", "7"}},
+		{11, []int64{1, 1, 1}, []string{"4", "4", "3"}},
+		{5, []int64{3, 3, 4}, []string{"2", "1", "2"}},
+		{1, []int64{1, 1, 1, 1}, []string{"1", "0", "0", "0"}},
+	} {
+		weights := make([]*big.Int, len(c.weights))
+		for i, w := range c.weights {
+			weights[i] = big.NewInt(w)
+		}
+		parts, leftover, err := splitByWeight(big.NewInt(c.total), weights)
+		require.NoError(t, err)
+		assert.Equal(t, "0", leftover.String())
+
+		got := make([]string, len(parts))
+		for i, p := range parts {
+			got[i] = p.String()
+		}
+		assert.Equal(t, c.want, got, "total %d weights %v", c.total, c.weights)
+	}
+}
+
+func TestFixedSplit(t *testing.T) {
+	d := &FixedSplit{
+		Recipients: []Recipient{
+			{Address: "a", Amount: big.NewInt(100)},
+			{Address: "b", Amount: big.NewInt(250)},
+		},
+		RemainderTo: "treasury",
+	}
+
+	shares, leftover, err := d.Split(big.NewInt(1001))
+	require.NoError(t, err)
+	requireConserved(t, big.NewInt(1001), shares, leftover)
+	assert.Equal(t, map[string]string{"a": "100", "b": "250", "treasury": "651"}, amounts(shares))
+	assert.Zero(t, leftover.Sign())
+
+	// without a remainder address the rest is left over
+	d.RemainderTo = ""
+	shares, leftover, err = d.Split(big.NewInt(1001))
+	require.NoError(t, err)
+	requireConserved(t, big.NewInt(1001), shares, leftover)
+	assert.Equal(t, "651", leftover.String())
+
+	_, _, err = d.Split(big.NewInt(349))
+	assert.Error(t, err)
+}
+
+func TestTieredSplit(t *testing.T) {
+	half := &WeightedSplit{Recipients: []Recipient{
+		{Address: "a", Weight: big.NewInt(1)},
+		{Address: "b", Weight: big.NewInt(1)},
+	}}
+	mostlyB := &WeightedSplit{Recipients: []Recipient{
+		{Address: "a", Weight: big.NewInt(1)},
+		{Address: "b", Weight: big.NewInt(3)},
+	}}
+	d := &TieredSplit{Tiers: []Tier{
+		{UpTo: big.NewInt(1000), Distribution: half},
+		{Distribution: mostlyB},
+	}}
+
+	shares, leftover, err := d.Split(big.NewInt(3000))
+	require.NoError(t, err)
+	requireConserved(t, big.NewInt(3000), shares, leftover)
+	assert.Equal(t, map[string]string{"a": "1000", "b": "2000"}, amounts(shares))
+
+	// below the first bound only the first tier applies
+	shares, leftover, err = d.Split(big.NewInt(601))
+	require.NoError(t, err)
+	requireConserved(t, big.NewInt(601), shares, leftover)
+
+	// above the last bounded tier the rest is left over
+	d.Tiers = d.Tiers[:1]
+	shares, leftover, err = d.Split(big.NewInt(1500))
+	require.NoError(t, err)
+	requireConserved(t, big.NewInt(1500), shares, leftover)
+	assert.Equal(t, "500", leftover.String())
+}
+
+func TestCappedSplit(t *testing.T) {
+	d := &CappedSplit{Recipients: []Recipient{
+		{Address: "a", Weight: big.NewInt(1), Cap: big.NewInt(100)},
+		{Address: "b", Weight: big.NewInt(1)},
+		{Address: "c", Weight: big.NewInt(2)},
+	}}
+
+	// a is capped, its overflow goes to b and c by weight
+	shares, leftover, err := d.Split(big.NewInt(1000))
+	require.NoError(t, err)
+	requireConserved(t, big.NewInt(1000), shares, leftover)
+	assert.Equal(t, map[string]string{"a": "100", "b": "300", "c": "600"}, amounts(shares))
+
+	// when everyone is capped the rest is left over
+	d.Recipients[1].Cap = big.NewInt(200)
+	d.Recipients[2].Cap = big.NewInt(300)
+	shares, leftover, err = d.Split(big.NewInt(1000))
+	require.NoError(t, err)
+	requireConserved(t, big.NewInt(1000), shares, leftover)
+	assert.Equal(t, "400", leftover.String())
+
+	for _, total := range []int64{0, 1, 599, 601, 12345} {
+		shares, leftover, err := d.Split(big.NewInt(total))
+		require.NoError(t, err)
+		requireConserved(t, big.NewInt(total), shares, leftover)
+	}
+}
+
+func TestParseDistribution(t *testing.T) {
+	d, err := ParseDistribution([]byte(`{"type": "tiered", "tiers": [
+		{"upTo": 1000, "distribution": {"type": "fixed", "recipients": [{"address": "a", "amount": 400}], "remainderTo": "b"}},
+		{"distribution": {"type": "capped", "recipients": [{"address": "a", "weight": 1, "cap": 100}, {"address": "b", "weight": 1}]}}
+	]}`))
+	require.NoError(t, err)
+
+	shares, leftover, err := d.Split(big.NewInt(2000))
+	require.NoError(t, err)
+	requireConserved(t, big.NewInt(2000), shares, leftover)
+	assert.Equal(t, map[string]string{"a": "500", "b": "1500"}, amounts(shares))
+
+	d, err = ParseDistribution([]byte(`{"type": "weighted", "recipients": [{"address": "a", "weight": 1, "min": 50}]}`))
+	require.NoError(t, err)
+	shares, _, err = d.Split(big.NewInt(10))
+	require.NoError(t, err)
+	assert.Equal(t, "50", shares[0].Min.String())
+
+	_, err = ParseDistribution([]byte(`{"type": "lottery"}`))
+	assert.Error(t, err)
+}
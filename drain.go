@@ -0,0 +1,19 @@
+package eth_multi_transactions
+
+import "time"
+
+// Drain waits until every channel is done or timeout elapses, reporting which came first.
+// The goroutines behind channels not done by then may still be using the db.
+func Drain(timeout time.Duration, done ...<-chan struct{}) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for _, d := range done {
+		select {
+		case <-d:
+		case <-timer.C:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,21 @@
+package eth_multi_transactions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+	finished := make(chan struct{})
+	close(finished)
+	assert.True(t, Drain(time.Second, finished, finished))
+
+	stuck := make(chan struct{})
+	assert.False(t, Drain(10*time.Millisecond, finished, stuck))
+
+	late := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(late) })
+	assert.True(t, Drain(time.Second, late, finished))
+}
@@ -0,0 +1,292 @@
+package eth_multi_transactions
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// DustEntry is a change of the dust of a recipient, the amount of a token owed to it below
+// its minimum payout.
+type DustEntry struct {
+	Id       uint64
+	Batch    uint64
+	Token    string // empty for ether
+	Address  string
+	Accrued  *big.Int // share of the batch kept as dust
+	Released *big.Int // dust paid with the batch
+	Balance  *big.Int // dust owed after the batch
+}
+
+// dustKey keeps ether dust under dust-<address>, where it was before dust of tokens, and
+// the dust of a token under dust-<token>/<address>.
+func (w *WdDB) dustKey(token, address string) []byte {
+	if token == "" {
+		return w.prefixed([]byte("dust-" + address))
+	}
+	return w.prefixed([]byte("dust-" + token + "/" + address))
+}
+
+// GetDust returns the dust of token, empty for ether, owed to address.
+func (w *WdDB) GetDust(token, address string) (*big.Int, error) {
+	v, err := w.getOptional(w.dustKey(token, address))
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(0).SetBytes(v), nil
+}
+
+// Dust returns the dust of token owed to every address owed some.
+func (w *WdDB) Dust(token string) (map[string]*big.Int, error) {
+	prefix := w.dustKey(token, "")
+	itr := w.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer itr.Release()
+
+	ans := make(map[string]*big.Int)
+	for itr.Next() {
+		address := string(itr.Key()[len(prefix):])
+		if strings.Contains(address, "/") {
+			// dust of a token, under the prefix of ether dust
+			continue
+		}
+		ans[address] = big.NewInt(0).SetBytes(itr.Value())
+	}
+	return ans, itr.Error()
+}
+
+// InsertShares records b and a withdrawal of b.Token for each share, like InsertBatch. A share below
+// the minimum payout of its recipient is added to its dust instead, and a share paid
+// takes the dust of its recipient along. It sets Accrued and Released on b and returns
+// the withdrawals inserted. The dust taken by withdrawals done since without paying is
+// owed again first.
+func (w *WdDB) InsertShares(b *PayoutBatch, shares []Share) ([]*DbWithdrawalObj, error) {
+	tx, err := w.db.OpenTransaction()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.creditDust(tx); err != nil {
+		tx.Discard()
+		return nil, err
+	}
+	objs, released, entries, err := w.settleDust(tx, b, shares)
+	if err != nil {
+		tx.Discard()
+		return nil, err
+	}
+
+	id, err := w.insertBatch(tx, b, objs)
+	if err == nil {
+		for _, e := range entries {
+			e.Batch = id
+			if err = w.putDustEntry(tx, e); err != nil {
+				break
+			}
+		}
+	}
+	for i := 0; err == nil && i < len(objs); i++ {
+		if released[i].Sign() > 0 {
+			// credited back by creditDust if the withdrawal never pays
+			err = tx.Put(w.key("dustpaid-", objs[i].Id), released[i].Bytes(), nil)
+		}
+	}
+	if err != nil {
+		tx.Discard()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	b.Id = id
+	return objs, nil
+}
+
+// creditDust adds the dust taken by withdrawals done without paying back to the dust of
+// their recipients within tx, recording the changes in the ledger.
+func (w *WdDB) creditDust(tx *leveldb.Transaction) error {
+	return w.settlePayouts(tx, "dustpaid-", func(id uint64, amount *big.Int) error {
+		e := &DustEntry{Accrued: amount, Released: big.NewInt(0)}
+		if v, err := tx.Get(w.key("token-", id), nil); err != nil {
+			return err
+		} else {
+			e.Token = string(v)
+		}
+		if v, err := tx.Get(w.key("address-", id), nil); err != nil {
+			return err
+		} else {
+			e.Address = string(v)
+		}
+		if v, err := tx.Get(w.key("batch-", id), nil); err == nil {
+			e.Batch, _ = FromBigEndianBytes(v)
+		} else if !errors.Is(err, leveldb.ErrNotFound) {
+			return err
+		}
+
+		key := w.dustKey(e.Token, e.Address)
+		e.Balance = big.NewInt(0).Set(amount)
+		if v, err := tx.Get(key, nil); err == nil {
+			e.Balance.Add(e.Balance, big.NewInt(0).SetBytes(v))
+		} else if !errors.Is(err, leveldb.ErrNotFound) {
+			return err
+		}
+		if err := tx.Put(key, e.Balance.Bytes(), nil); err != nil {
+			return err
+		}
+		return w.putDustEntry(tx, e)
+	})
+}
+
+// settleDust updates the dust of the recipients of shares within tx, and returns the
+// withdrawals to pay, the dust each takes along, and the ledger entries of the changes.
+func (w *WdDB) settleDust(tx *leveldb.Transaction, b *PayoutBatch, shares []Share) ([]*DbWithdrawalObj, []*big.Int, []*DustEntry, error) {
+	b.Accrued, b.Released = big.NewInt(0), big.NewInt(0)
+
+	var (
+		objs     []*DbWithdrawalObj
+		released []*big.Int
+		entries  []*DustEntry
+	)
+	for _, s := range shares {
+		key := w.dustKey(b.Token, s.Address)
+		dust := big.NewInt(0)
+		if v, err := tx.Get(key, nil); err == nil {
+			dust.SetBytes(v)
+		} else if !errors.Is(err, leveldb.ErrNotFound) {
+			return nil, nil, nil, err
+		}
+		owed := big.NewInt(0).Add(dust, s.Amount)
+		if owed.Sign() == 0 {
+			// nothing to pay nor to accrue
+			continue
+		}
+
+		if s.Min != nil && owed.Cmp(s.Min) < 0 {
+			if s.Amount.Sign() == 0 {
+				continue
+			}
+			if err := tx.Put(key, owed.Bytes(), nil); err != nil {
+				return nil, nil, nil, err
+			}
+			b.Accrued.Add(b.Accrued, s.Amount)
+			entries = append(entries, &DustEntry{Token: b.Token, Address: s.Address, Accrued: s.Amount, Released: big.NewInt(0), Balance: owed})
+			continue
+		}
+
+		if dust.Sign() > 0 {
+			if err := tx.Delete(key, nil); err != nil {
+				return nil, nil, nil, err
+			}
+			b.Released.Add(b.Released, dust)
+			entries = append(entries, &DustEntry{Token: b.Token, Address: s.Address, Accrued: big.NewInt(0), Released: dust, Balance: big.NewInt(0)})
+		}
+		objs = append(objs, &DbWithdrawalObj{
+			Address:  s.Address,
+			Token:    b.Token,
+			Amount:   owed,
+			Chain:    w.chain,
+			Created:  b.Created,
+			Modified: b.Created,
+		})
+		released = append(released, dust)
+	}
+	return objs, released, entries, nil
+}
+
+func (w *WdDB) putDustEntry(tx *leveldb.Transaction, e *DustEntry) error {
+	id, err := w.nextId(tx, "kv-dustid")
+	if err != nil {
+		return err
+	}
+	e.Id = id
+
+	if err := tx.Put(w.key("dustbatch-", id), ToBigEndianBytes(e.Batch), nil); err != nil {
+		return err
+	}
+	if err := tx.Put(w.key("dusttoken-", id), []byte(e.Token), nil); err != nil {
+		return err
+	}
+	if err := tx.Put(w.key("dustaddress-", id), []byte(e.Address), nil); err != nil {
+		return err
+	}
+	if err := tx.Put(w.key("dustaccrued-", id), e.Accrued.Bytes(), nil); err != nil {
+		return err
+	}
+	if err := tx.Put(w.key("dustreleased-", id), e.Released.Bytes(), nil); err != nil {
+		return err
+	}
+	return tx.Put(w.key("dustbalance-", id), e.Balance.Bytes(), nil)
+}
+
+// DustLedger returns every change of the dust of recipients, oldest first.
+func (w *WdDB) DustLedger() ([]*DustEntry, error) {
+	prefix := w.prefixed([]byte("dustbatch-"))
+	itr := w.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer itr.Release()
+
+	var ids []uint64
+	for itr.Next() {
+		id, err := FromBigEndianBytes(itr.Key()[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+
+	ans := make([]*DustEntry, 0, len(ids))
+	for _, id := range ids {
+		e, err := w.getDustEntry(id)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, e)
+	}
+	return ans, nil
+}
+
+func (w *WdDB) getDustEntry(id uint64) (*DustEntry, error) {
+	ans := DustEntry{Id: id}
+
+	if v, err := w.db.Get(w.key("dustbatch-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Batch, _ = FromBigEndianBytes(v)
+	}
+
+	if v, err := w.db.Get(w.key("dusttoken-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Token = string(v)
+	}
+
+	if v, err := w.db.Get(w.key("dustaddress-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Address = string(v)
+	}
+
+	if v, err := w.db.Get(w.key("dustaccrued-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Accrued = big.NewInt(0).SetBytes(v)
+	}
+
+	if v, err := w.db.Get(w.key("dustreleased-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Released = big.NewInt(0).SetBytes(v)
+	}
+
+	if v, err := w.db.Get(w.key("dustbalance-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Balance = big.NewInt(0).SetBytes(v)
+	}
+	return &ans, nil
+}
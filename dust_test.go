@@ -0,0 +1,167 @@
+package eth_multi_transactions
+
+import (
+	"bytes"
+	"encoding/csv"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWdDB_InsertShares(t *testing.T) {
+	db := newTestDB(t)
+	min := big.NewInt(10)
+
+	generate := func(a, b int64) (*PayoutBatch, []*DbWithdrawalObj) {
+		shares := []Share{
+			{Address: "a", Amount: big.NewInt(a), Min: min},
+			{Address: "b", Amount: big.NewInt(b)},
+		}
+		batch := &PayoutBatch{Total: big.NewInt(a + b), Leftover: big.NewInt(0)}
+		objs, err := db.InsertShares(batch, shares)
+		require.NoError(t, err)
+		return batch, objs
+	}
+
+	// a accrues below its minimum, b is paid any share
+	batch, objs := generate(4, 1)
+	require.Len(t, objs, 1)
+	assert.Equal(t, "b", objs[0].Address)
+	assert.Equal(t, "4", batch.Accrued.String())
+	_, objs = generate(4, 1)
+	require.Len(t, objs, 1)
+
+	dust, err := db.GetDust("", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "8", dust.String())
+
+	// crossing the minimum pays the share with the dust
+	batch, objs = generate(5, 1)
+	require.Len(t, objs, 2)
+	assert.Equal(t, "13", objs[0].Amount.String())
+	assert.Equal(t, "8", batch.Released.String())
+
+	obj, err := db.GetWdObjById(objs[0].Id)
+	require.NoError(t, err)
+	assert.Equal(t, "13", obj.Amount.String())
+	assert.Equal(t, batch.Id, obj.Batch)
+
+	got, err := db.GetBatch(batch.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "0", got.Accrued.String())
+	assert.Equal(t, "8", got.Released.String())
+
+	owed, err := db.Dust("")
+	require.NoError(t, err)
+	assert.Empty(t, owed)
+
+	ledger, err := db.DustLedger()
+	require.NoError(t, err)
+	require.Len(t, ledger, 3)
+	assert.Equal(t, "8", ledger[1].Balance.String())
+	assert.Equal(t, "8", ledger[2].Released.String())
+	assert.Equal(t, batch.Id, ledger[2].Batch)
+
+	var out bytes.Buffer
+	require.NoError(t, ExportDustCSV(&out, db))
+	rows, err := csv.NewReader(&out).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 4)
+	assert.Equal(t, []string{"", "3", "3", "", "a", "0", "8", "0"}, rows[3])
+
+	// a zero share owing nothing pays nothing, whatever its minimum
+	_, objs = generate(0, 0)
+	assert.Empty(t, objs)
+}
+
+func TestWdDB_DustKey(t *testing.T) {
+	db := newTestDB(t)
+	token := "0x0000000000000000000000000000000000000aaa"
+
+	// ether dust accrued before dust of tokens is still owed
+	require.NoError(t, db.db.Put([]byte("dust-a"), big.NewInt(7).Bytes(), nil))
+	_, err := db.InsertShares(&PayoutBatch{Token: token, Total: big.NewInt(3), Leftover: big.NewInt(0)},
+		[]Share{{Address: "a", Amount: big.NewInt(3), Min: big.NewInt(10)}})
+	require.NoError(t, err)
+
+	dust, err := db.GetDust("", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "7", dust.String())
+	dust, err = db.GetDust(token, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "3", dust.String())
+
+	owed, err := db.Dust("")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*big.Int{"a": big.NewInt(7)}, owed)
+	owed, err = db.Dust(token)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*big.Int{"a": big.NewInt(3)}, owed)
+}
+
+func TestWdDB_InsertSharesUnpaid(t *testing.T) {
+	db := newTestDB(t)
+	min := big.NewInt(10)
+	generate := func(amount int64) []*DbWithdrawalObj {
+		batch := &PayoutBatch{Total: big.NewInt(amount), Leftover: big.NewInt(0)}
+		objs, err := db.InsertShares(batch, []Share{{Address: "a", Amount: big.NewInt(amount), Min: min}})
+		require.NoError(t, err)
+		return objs
+	}
+
+	generate(4)
+	objs := generate(8)
+	require.Len(t, objs, 1)
+	assert.Equal(t, "12", objs[0].Amount.String())
+
+	// the dust taken by a rejected withdrawal is owed again, its share is not
+	require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(objs[0].Id), StatusInit, StatusRejected))
+	committed, err := db.Committed("")
+	require.NoError(t, err)
+	assert.Equal(t, "4", committed.String())
+	objs = generate(3)
+	assert.Empty(t, objs)
+
+	dust, err := db.GetDust("", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "7", dust.String())
+
+	ledger, err := db.DustLedger()
+	require.NoError(t, err)
+	require.Len(t, ledger, 4)
+	assert.Equal(t, "4", ledger[2].Accrued.String())
+	assert.Equal(t, "4", ledger[2].Balance.String())
+
+	// dust paid by a confirmed withdrawal stays paid
+	objs = generate(10)
+	require.Len(t, objs, 1)
+	assert.Equal(t, "17", objs[0].Amount.String())
+	require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(objs[0].Id), StatusInit, StatusConfirmed))
+	assert.Empty(t, generate(1))
+	dust, err = db.GetDust("", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "1", dust.String())
+
+	// unless a reorg undoes it while its block is rechecked
+	objs = generate(10)
+	require.Len(t, objs, 1)
+	id := objs[0].Id
+	require.NoError(t, db.SetBlock(id, 10, "0x10"))
+	require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(id), StatusInit, StatusConfirmed))
+	require.NoError(t, db.SetRecheckSince(5))
+	assert.Empty(t, generate(1))
+	require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(id), StatusConfirmed, StatusProcessing))
+	require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(id), StatusProcessing, StatusFailed))
+	assert.Empty(t, generate(1))
+	dust, err = db.GetDust("", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "2", dust.String())
+
+	require.NoError(t, db.SetRecheckSince(11))
+	assert.Empty(t, generate(1))
+	dust, err = db.GetDust("", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "4", dust.String())
+}
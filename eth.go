@@ -3,13 +3,18 @@ package eth_multi_transactions
 import (
     "context"
     "crypto/ecdsa"
+    "errors"
     "fmt"
     "math/big"
+    "strings"
     "time"
 
+    "github.com/ethereum/go-ethereum"
+    "github.com/ethereum/go-ethereum/accounts/abi"
     "github.com/ethereum/go-ethereum/common"
     "github.com/ethereum/go-ethereum/core/types"
-    "github.com/ethereum/go-ethereum/ethclient"
+    "github.com/ethereum/go-ethereum/params"
+    "github.com/ethereum/go-ethereum/rpc"
 
     "github.com/haihongs/eth-multi-transactions/common/logger"
 )
@@ -20,90 +25,282 @@ var (
     Ether = big.NewInt(0).Mul(GWei, GWei) // 1ether = 1e18wei
 )
 
-func GetBalance(c *ethclient.Client, addr string) (*big.Int, error) {
-    return c.BalanceAt(context.Background(), common.HexToAddress(addr), nil)
+func GetBalance(ctx context.Context, c ChainClient, addr string) (*big.Int, error) {
+    return c.BalanceAt(ctx, common.HexToAddress(addr), nil)
 }
 
-func PollingTransaction(ethc *ethclient.Client, txid string, threshold int64, timeout time.Duration) error {
-    end := time.Now().Add(timeout)
+// PollingTransaction waits until txid is threshold blocks deep, the including block
+// counted. A transaction un-mined by a reorg is waited for again.
+func PollingTransaction(ctx context.Context, ethc ChainClient, txid string, threshold int64, timeout time.Duration) error {
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
     ticker := time.NewTicker(5 * time.Second)
-    cnt := int64(0)
+    defer ticker.Stop()
 
-    for range ticker.C {
-        if time.Now().After(end) {
-            return fmt.Errorf("polling timeout, txid: %s", txid)
+    for {
+        select {
+        case <-ctx.Done():
+            if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+                return fmt.Errorf("polling timeout, txid: %s", txid)
+            }
+            return ctx.Err()
+        case <-ticker.C:
         }
 
-        _, isPending, err := ethc.TransactionByHash(context.Background(), common.HexToHash(txid))
+        receipt, err := ethc.TransactionReceipt(ctx, common.HexToHash(txid))
+        if errors.Is(err, ethereum.NotFound) {
+            continue
+        }
         if err != nil {
-            logger.Error("failed to get transaction by hash", "err", err)
+            logger.Error("failed to get transaction receipt", "err", err)
             continue
         }
 
-        if isPending {
+        header, err := ethc.HeaderByNumber(ctx, nil)
+        if err != nil {
+            logger.Error("failed to get chain head", "err", err)
             continue
         }
 
-        cnt++
-        if cnt >= threshold {
+        if confirmations(header.Number.Uint64(), receipt.BlockNumber.Uint64()) >= uint64(threshold) {
             return nil
         }
     }
-    return nil
 }
 
 func SendEthTransaction(
+    ctx context.Context,
     obj *DbWithdrawalObj,
-    ethc *ethclient.Client,
+    ethc ChainClient,
     fromAddr common.Address,
     prvKey *ecdsa.PrivateKey,
     chainID *big.Int,
-) (string, error) {
+    policy TxPolicy,
+) (*types.Transaction, error) {
     // build tx
-    ctx := context.Background()
     nonce, err := ethc.NonceAt(ctx, fromAddr, nil)
     if err != nil {
-        return "", err
+        return nil, err
     }
 
-    gasPrice, err := ethc.SuggestGasPrice(ctx)
+    signedTx, err := SignEthTransaction(ctx, obj, ethc, nonce, fromAddr, prvKey, chainID, policy)
     if err != nil {
-        return "", err
+        return nil, err
     }
 
-    if balance, err := ethc.BalanceAt(ctx, fromAddr, nil); err != nil {
-        return "", err
-    } else {
-        if balance.Cmp(obj.Amount) <= 0 {
-            return "", fmt.Errorf("not enough balance, need: %v real: %v", obj.Amount, balance)
-        }
+    // broadcast
+    if err = ethc.SendTransaction(ctx, signedTx); err != nil {
+        return nil, err
+    }
+
+    return signedTx, nil
+}
+
+// SignEthTransaction builds and signs the payout of obj at the given nonce without broadcasting it.
+func SignEthTransaction(
+    ctx context.Context,
+    obj *DbWithdrawalObj,
+    ethc ChainClient,
+    nonce uint64,
+    fromAddr common.Address,
+    prvKey *ecdsa.PrivateKey,
+    chainID *big.Int,
+    policy TxPolicy,
+) (*types.Transaction, error) {
+    if obj.Token != "" {
+        return signTokenTransaction(ctx, obj, ethc, nonce, fromAddr, prvKey, chainID, policy)
     }
 
-    gasPrice.Add(gasPrice, big.NewInt(0).Mul(big.NewInt(5), GWei))
     toAddr := common.HexToAddress(obj.Address)
+    logger.Info("xx", "nonce", nonce, "toaddr", toAddr)
+    return signTransaction(ctx, ethc, toAddr, obj.Amount, nil, nonce, fromAddr, prvKey, chainID, policy)
+}
+
+func signTokenTransaction(
+    ctx context.Context,
+    obj *DbWithdrawalObj,
+    ethc ChainClient,
+    nonce uint64,
+    fromAddr common.Address,
+    prvKey *ecdsa.PrivateKey,
+    chainID *big.Int,
+    policy TxPolicy,
+) (*types.Transaction, error) {
+    token := common.HexToAddress(obj.Token)
+    if balance, err := TokenBalance(ctx, ethc, token, fromAddr); err != nil {
+        return nil, err
+    } else if balance.Cmp(obj.Amount) < 0 {
+        return nil, fmt.Errorf("not enough token balance, token: %v need: %v real: %v", obj.Token, obj.Amount, balance)
+    }
+
+    data, err := erc20.Pack("transfer", common.HexToAddress(obj.Address), obj.Amount)
+    if err != nil {
+        return nil, err
+    }
+
+    logger.Debug("signing token transfer", "nonce", nonce, "token", token, "toaddr", obj.Address)
+    return signTransaction(ctx, ethc, token, big.NewInt(0), data, nonce, fromAddr, prvKey, chainID, policy)
+}
+
+// GasLimitPolicy turns an eth_estimateGas result into the gas limit of a transaction.
+type GasLimitPolicy struct {
+    Multiplier float64 `json:"multiplier"` // safety margin applied to estimates of contract executions
+    Ceiling    uint64  `json:"ceiling"`    // refuse to send transactions needing more gas, 0 for no ceiling
+}
+
+var DefaultGasLimit = GasLimitPolicy{Multiplier: 1.25, Ceiling: 2000000}
+
+func (p GasLimitPolicy) Apply(estimate uint64) (uint64, error) {
+    // a plain transfer to an account without code costs exactly its estimate
+    if estimate == params.TxGas {
+        return estimate, nil
+    }
+
+    limit := uint64(float64(estimate) * p.Multiplier)
+    if limit < estimate {
+        limit = estimate
+    }
+    if p.Ceiling > 0 && limit > p.Ceiling {
+        return 0, fmt.Errorf("gas limit above ceiling, estimate: %v limit: %v ceiling: %v", estimate, limit, p.Ceiling)
+    }
+    return limit, nil
+}
+
+// FeePolicy turns the gas price suggested by the node into the one paid.
+type FeePolicy struct {
+    Premium *big.Int `json:"premium"` // wei per gas added to the suggestion to get ahead of the pool
+    Max     *big.Int `json:"max"`     // refuse to pay more per gas, nil for no cap
+}
+
+var DefaultFee = FeePolicy{Premium: big.NewInt(0).Mul(big.NewInt(5), GWei)}
+
+func (p FeePolicy) Apply(suggested *big.Int) (*big.Int, error) {
+    price := big.NewInt(0).Set(suggested)
+    if p.Premium != nil {
+        price.Add(price, p.Premium)
+    }
+    if p.Max != nil && price.Cmp(p.Max) > 0 {
+        return nil, fmt.Errorf("gas price above max, price: %v max: %v", price, p.Max)
+    }
+    return price, nil
+}
+
+// TxPolicy is the gas limit and the gas price policies of the transactions signed for a chain.
+type TxPolicy struct {
+    Gas GasLimitPolicy
+    Fee FeePolicy
+}
+
+var DefaultTxPolicy = TxPolicy{Gas: DefaultGasLimit, Fee: DefaultFee}
+
+// RevertError reports a transaction whose simulation failed, so broadcasting it would
+// only burn gas.
+type RevertError struct {
+    Reason string
+}
+
+const revertPrefix = "execution reverted"
+
+func (e *RevertError) Error() string {
+    if e.Reason == "" {
+        return revertPrefix
+    }
+    return revertPrefix + ": " + e.Reason
+}
+
+// Simulate executes msg with eth_call on the pending block. A revert is returned as
+// *RevertError carrying the decoded reason when the contract provided one.
+func Simulate(ctx context.Context, backend ChainClient, msg ethereum.CallMsg) ([]byte, error) {
+    out, err := backend.PendingCallContract(ctx, msg)
+    if err == nil {
+        return out, nil
+    }
+
+    var dataErr rpc.DataError
+    if errors.As(err, &dataErr) {
+        if raw, ok := dataErr.ErrorData().(string); ok {
+            if reason, e := abi.UnpackRevert(common.FromHex(raw)); e == nil {
+                return nil, &RevertError{Reason: reason}
+            }
+            return nil, &RevertError{Reason: raw}
+        }
+    }
+    // nodes without revert data report the reason in the message, after the same prefix
+    if i := strings.Index(err.Error(), revertPrefix); i >= 0 {
+        reason := strings.TrimPrefix(err.Error()[i+len(revertPrefix):], ":")
+        return nil, &RevertError{Reason: strings.TrimSpace(reason)}
+    }
+    return nil, err
+}
+
+func signTransaction(
+    ctx context.Context,
+    backend ChainClient,
+    to common.Address,
+    value *big.Int,
+    data []byte,
+    nonce uint64,
+    fromAddr common.Address,
+    prvKey *ecdsa.PrivateKey,
+    chainID *big.Int,
+    policy TxPolicy,
+) (*types.Transaction, error) {
+    // pre-flight, never pay gas for a transaction that is going to fail
+    if out, err := Simulate(ctx, backend, ethereum.CallMsg{From: fromAddr, To: &to, Value: value, Data: data}); err != nil {
+        return nil, err
+    } else if err := checkTokenResult(data, out); err != nil {
+        return nil, err
+    }
+
+    suggested, err := backend.SuggestGasPrice(ctx)
+    if err != nil {
+        return nil, err
+    }
+    gasPrice, err := policy.Fee.Apply(suggested)
+    if err != nil {
+        return nil, err
+    }
+
+    estimate, err := backend.EstimateGas(ctx, ethereum.CallMsg{
+        From:     fromAddr,
+        To:       &to,
+        GasPrice: gasPrice,
+        Value:    value,
+        Data:     data,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    gas, err := policy.Gas.Apply(estimate)
+    if err != nil {
+        return nil, err
+    }
+
+    // value + gasLimit * gasPrice
+    need := big.NewInt(0).Mul(big.NewInt(0).SetUint64(gas), gasPrice)
+    need.Add(need, value)
+    if balance, err := backend.BalanceAt(ctx, fromAddr, nil); err != nil {
+        return nil, err
+    } else if balance.Cmp(need) < 0 {
+        return nil, fmt.Errorf("not enough balance, need: %v real: %v", need, balance)
+    }
 
-    logger.Info("xx", "nonce", nonce, "gasprice", gasPrice, "toaddr", toAddr)
     tx := types.NewTx(&types.LegacyTx{
         Nonce:    nonce,
-        To:       &toAddr,
-        Value:    obj.Amount,
-        Gas:      21000,
+        To:       &to,
+        Value:    value,
+        Gas:      gas,
         GasPrice: gasPrice,
-        Data:     []byte{},
+        Data:     data,
     })
 
-    signer := types.LatestSignerForChainID(chainID)
-
-    signedTx, err := types.SignTx(tx, signer, prvKey)
+    signedTx, err := types.SignTx(tx, types.LatestSignerForChainID(chainID), prvKey)
     //signedTx, err := types.SignTx(tx, types.HomesteadSigner{}, prvKey)
     if err != nil {
-        return "", err
-    }
-
-    // broadcast
-    if err = ethc.SendTransaction(ctx, signedTx); err != nil {
-        return "", err
+        return nil, err
     }
 
-    return signedTx.Hash().Hex(), nil
+    return signedTx, nil
 }
@@ -0,0 +1,118 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGasLimitPolicy_Apply(t *testing.T) {
+	p := GasLimitPolicy{Multiplier: 1.5, Ceiling: 100000}
+
+	// plain transfers keep their exact cost
+	gas, err := p.Apply(21000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(21000), gas)
+
+	gas, err = p.Apply(40000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(60000), gas)
+
+	_, err = p.Apply(80000)
+	assert.Error(t, err)
+
+	// a multiplier below one never cuts the estimate
+	gas, err = GasLimitPolicy{Multiplier: 0.5}.Apply(40000)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(40000), gas)
+}
+
+func TestSimulate_RevertReason(t *testing.T) {
+	sim, key, from := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+	token := deployTestContract(t, sim, key, "TestToken", big.NewInt(1000))
+
+	data, err := erc20.Pack("transfer", common.HexToAddress("0x0000000000000000000000000000000000000e01"), big.NewInt(1001))
+	require.NoError(t, err)
+
+	_, err = Simulate(context.Background(), client, ethereum.CallMsg{From: from, To: &token, Data: data})
+	var revertErr *RevertError
+	require.True(t, errors.As(err, &revertErr), "unexpected error: %v", err)
+	assert.Equal(t, "insufficient balance", revertErr.Reason)
+
+	// a disperse call without allowance fails before anything is signed
+	contract := deployTestContract(t, sim, key, "Disperse")
+	obj := &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000000e01", Token: token.Hex(), Amount: big.NewInt(1)}
+	_, err = SignDisperseTransaction(context.Background(), []*DbWithdrawalObj{obj}, client, contract, 0, from, key, simChainID, DefaultTxPolicy)
+	require.True(t, errors.As(err, &revertErr), "unexpected error: %v", err)
+	assert.Equal(t, "insufficient allowance", revertErr.Reason)
+}
+
+// revertingClient fails every call with err, like a node reporting reverts without data
+type revertingClient struct {
+	ChainClient
+	err error
+}
+
+func (c *revertingClient) PendingCallContract(context.Context, ethereum.CallMsg) ([]byte, error) {
+	return nil, c.err
+}
+
+func TestSimulate_RevertMessage(t *testing.T) {
+	for msg, reason := range map[string]string{
+		"execution reverted: insufficient balance":          "insufficient balance",
+		"rpc error: execution reverted: insufficient funds": "insufficient funds",
+		"execution reverted":                                "",
+	} {
+		_, err := Simulate(context.Background(), &revertingClient{err: errors.New(msg)}, ethereum.CallMsg{})
+		var revertErr *RevertError
+		require.True(t, errors.As(err, &revertErr), "unexpected error: %v", err)
+		assert.Equal(t, reason, revertErr.Reason)
+		assert.Equal(t, strings.TrimPrefix(msg, "rpc error: "), err.Error())
+	}
+
+	_, err := Simulate(context.Background(), &revertingClient{err: errors.New("connection refused")}, ethereum.CallMsg{})
+	var revertErr *RevertError
+	assert.False(t, errors.As(err, &revertErr))
+}
+
+// hungClient never answers, like a node that accepted the connection and stalled
+type hungClient struct {
+	ChainClient
+}
+
+func (c *hungClient) BalanceAt(ctx context.Context, _ common.Address, _ *big.Int) (*big.Int, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (c *hungClient) TransactionByHash(ctx context.Context, _ common.Hash) (*types.Transaction, bool, error) {
+	<-ctx.Done()
+	return nil, false, ctx.Err()
+}
+
+func TestWithCallTimeout(t *testing.T) {
+	c := WithCallTimeout(&hungClient{}, 50*time.Millisecond)
+
+	start := time.Now()
+	_, err := GetBalance(context.Background(), c, "0x0000000000000000000000000000000000006001")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestPollingTransaction_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := PollingTransaction(ctx, &hungClient{}, "0x01", 3, time.Hour)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,192 @@
+package eth_multi_transactions
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+var exportHeader = []string{
+	"chain", "id", "address", "token", "amount", "status", "nonce", "hash",
+	"block_number", "block_hash", "gas_used", "gas_price", "fee", "created", "modified", "reason",
+	"not_before", "expiry", "priority", "approvers",
+}
+
+// ExportCSV writes every withdrawal of the given db views as CSV, amounts, prices and fees
+// in wei. Execution columns are empty until a withdrawal is final.
+func ExportCSV(out io.Writer, views ...*WdDB) error {
+	cw := csv.NewWriter(out)
+	if err := cw.Write(exportHeader); err != nil {
+		return err
+	}
+
+	for _, w := range views {
+		ids, err := w.GetRecordsId()
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			obj, err := w.GetWdObjById(id)
+			if err != nil {
+				return err
+			}
+			if err := cw.Write(exportRow(obj)); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+var dustHeader = []string{"chain", "id", "batch", "token", "address", "accrued", "released", "balance"}
+
+// ExportDustCSV writes the dust ledger of the given db views as CSV, one row per change of
+// the dust owed to a recipient, amounts in wei.
+func ExportDustCSV(out io.Writer, views ...*WdDB) error {
+	cw := csv.NewWriter(out)
+	if err := cw.Write(dustHeader); err != nil {
+		return err
+	}
+
+	for _, w := range views {
+		entries, err := w.DustLedger()
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			row := []string{
+				w.Chain(),
+				strconv.FormatUint(e.Id, 10),
+				strconv.FormatUint(e.Batch, 10),
+				e.Token,
+				e.Address,
+				e.Accrued.String(),
+				e.Released.String(),
+				e.Balance.String(),
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+var auditHeader = []string{"chain", "id", "withdrawal", "approver", "action", "reason", "time"}
+
+// ExportAuditCSV writes the audit log of the given db views as CSV, one row per approval or
+// rejection of a withdrawal and per change of the approval policy.
+func ExportAuditCSV(out io.Writer, views ...*WdDB) error {
+	cw := csv.NewWriter(out)
+	if err := cw.Write(auditHeader); err != nil {
+		return err
+	}
+
+	for _, w := range views {
+		entries, err := w.AuditLog()
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			row := []string{
+				w.Chain(),
+				strconv.FormatUint(e.Id, 10),
+				strconv.FormatUint(e.Withdrawal, 10),
+				e.Approver,
+				e.Action,
+				e.Reason,
+				strconv.FormatUint(e.Time, 10),
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+var overheadHeader = []string{"chain", "id", "kind", "token", "hash", "time", "gas_used", "gas_price", "fee"}
+
+// ExportOverheadCSV writes the overhead transactions of the given db views as CSV, such as
+// token approvals, whose fees no withdrawal bears. Execution columns are empty until mined.
+func ExportOverheadCSV(out io.Writer, views ...*WdDB) error {
+	cw := csv.NewWriter(out)
+	if err := cw.Write(overheadHeader); err != nil {
+		return err
+	}
+
+	for _, w := range views {
+		overheads, err := w.Overheads()
+		if err != nil {
+			return err
+		}
+
+		for _, o := range overheads {
+			row := []string{
+				w.Chain(),
+				strconv.FormatUint(o.Id, 10),
+				o.Kind,
+				o.Token,
+				o.Hash,
+				strconv.FormatUint(o.Time, 10),
+				"", "", "",
+			}
+			if o.Fee != nil {
+				row[6] = strconv.FormatUint(o.GasUsed, 10)
+				row[7] = o.GasPrice.String()
+				row[8] = o.Fee.String()
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func exportRow(obj *DbWithdrawalObj) []string {
+	row := []string{
+		obj.Chain,
+		strconv.FormatUint(obj.Id, 10),
+		obj.Address,
+		obj.Token,
+		obj.Amount.String(),
+		strconv.FormatUint(obj.Status, 10),
+		strconv.FormatUint(obj.Nonce, 10),
+		obj.Hash,
+		"", obj.BlockHash,
+		"", "", "",
+		strconv.FormatUint(obj.Created, 10),
+		strconv.FormatUint(obj.Modified, 10),
+		obj.Reason,
+		"", "",
+		strconv.FormatUint(obj.Priority, 10),
+		strconv.FormatUint(obj.Approvers, 10),
+	}
+	if obj.BlockHash != "" {
+		row[8] = strconv.FormatUint(obj.BlockNumber, 10)
+	}
+	if obj.NotBefore != 0 {
+		row[16] = strconv.FormatUint(obj.NotBefore, 10)
+	}
+	if obj.Expiry != 0 {
+		row[17] = strconv.FormatUint(obj.Expiry, 10)
+	}
+	if obj.Fee != nil {
+		row[10] = strconv.FormatUint(obj.GasUsed, 10)
+		row[11] = obj.GasPrice.String()
+		row[12] = obj.Fee.String()
+	}
+	return row
+}
@@ -0,0 +1,57 @@
+package eth_multi_transactions
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportCSV(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x000000000000000000000000000000000000a001", Amount: big.NewInt(1)},
+		&DbWithdrawalObj{Address: "0x000000000000000000000000000000000000a002", Amount: big.NewInt(2)},
+	)
+	w.MaxInFlight = 1
+	require.NoError(t, w.Dispatch(context.Background()))
+	trackUntilSettled(t, w, client)
+
+	var out bytes.Buffer
+	require.NoError(t, ExportCSV(&out, db))
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, exportHeader, rows[0])
+
+	// the confirmed withdrawal carries its fee, the pending one nothing yet
+	assert.Equal(t, "2", rows[1][5])
+	assert.NotEmpty(t, rows[1][8])
+	assert.Equal(t, "21000", rows[1][10])
+	assert.NotEmpty(t, rows[1][12])
+	assert.Equal(t, "0", rows[2][5])
+	assert.Empty(t, rows[2][12])
+}
+
+func TestExportOverheadCSV(t *testing.T) {
+	db := newTestDB(t)
+	id, err := db.PutOverhead(OverheadApprove, "0x000000000000000000000000000000000000a101", "0x01")
+	require.NoError(t, err)
+	_, err = db.PutOverhead(OverheadApprove, "0x000000000000000000000000000000000000a101", "0x02")
+	require.NoError(t, err)
+	require.NoError(t, db.SetOverheadFee(id, 46000, big.NewInt(2), big.NewInt(92000)))
+
+	var out bytes.Buffer
+	require.NoError(t, ExportOverheadCSV(&out, db))
+	rows, err := csv.NewReader(&out).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, overheadHeader, rows[0])
+	assert.Equal(t, []string{"approve", "0x01", "46000", "2", "92000"}, []string{rows[1][2], rows[1][4], rows[1][6], rows[1][7], rows[1][8]})
+	assert.Equal(t, []string{"", "", ""}, rows[2][6:], "not mined yet")
+}
@@ -0,0 +1,245 @@
+package eth_multi_transactions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var ErrLeaseHeld = errors.New("lease held by another owner")
+
+// a lease outlives this many renewal intervals, so that a slow node or lease store does
+// not let it expire under a running worker
+const leaseMargin = 3
+
+// CheckLeaseTTL refuses a lease ttl that is not well above interval, the longest a
+// worker goes without renewing its lease.
+func CheckLeaseTTL(ttl, interval time.Duration) error {
+	if ttl > 0 && ttl < leaseMargin*interval {
+		return fmt.Errorf("lease ttl too short, ttl: %v min: %v", ttl, leaseMargin*interval)
+	}
+	return nil
+}
+
+// Lease records which worker may pay withdrawals from the db. A worker must renew it
+// before Expiry, after which any other worker may take it over.
+type Lease struct {
+	Owner     string
+	Expiry    time.Time
+	Heartbeat time.Time // last acquisition or renewal
+}
+
+// LeaseStore holds the lease. The db holds it for the workers of a single process, a
+// FileLeaseStore on shared storage for workers running on several hosts.
+type LeaseStore interface {
+	GetLease() (*Lease, error)
+	AcquireLease(owner string, ttl time.Duration) (*Lease, error)
+	ReleaseLease(owner string) error
+}
+
+var (
+	leaseOwnerKey     = []byte("kv-lease-owner")
+	leaseExpiryKey    = []byte("kv-lease-expiry")
+	leaseHeartbeatKey = []byte("kv-lease-heartbeat")
+)
+
+// GetLease returns the current lease, or nil if none was ever taken or it was released.
+func (w *WdDB) GetLease() (*Lease, error) {
+	return getLease(w.db)
+}
+
+// leaseReader is either the db or a transaction on it
+type leaseReader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+}
+
+func getLease(r leaseReader) (*Lease, error) {
+	owner, err := r.Get(leaseOwnerKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ans := Lease{Owner: string(owner)}
+	if v, err := r.Get(leaseExpiryKey, nil); err != nil {
+		return nil, err
+	} else {
+		expiry, _ := FromBigEndianBytes(v)
+		ans.Expiry = time.Unix(int64(expiry), 0)
+	}
+
+	if v, err := r.Get(leaseHeartbeatKey, nil); err != nil {
+		return nil, err
+	} else {
+		heartbeat, _ := FromBigEndianBytes(v)
+		ans.Heartbeat = time.Unix(int64(heartbeat), 0)
+	}
+	return &ans, nil
+}
+
+// AcquireLease takes the lease for owner until ttl from now, or extends it if owner
+// already holds it. It fails with ErrLeaseHeld while another owner holds an unexpired lease.
+func (w *WdDB) AcquireLease(owner string, ttl time.Duration) (*Lease, error) {
+	tx, err := w.db.OpenTransaction()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	lease, err := getLease(tx)
+	if err != nil {
+		tx.Discard()
+		return nil, err
+	}
+	if lease != nil && lease.Owner != owner && now.Before(lease.Expiry) {
+		tx.Discard()
+		return nil, fmt.Errorf("%w, owner: %s expiry: %v", ErrLeaseHeld, lease.Owner, lease.Expiry)
+	}
+
+	lease = &Lease{Owner: owner, Expiry: now.Add(ttl), Heartbeat: now}
+	batch := new(leveldb.Batch)
+	batch.Put(leaseOwnerKey, []byte(owner))
+	batch.Put(leaseExpiryKey, ToBigEndianBytes(uint64(lease.Expiry.Unix())))
+	batch.Put(leaseHeartbeatKey, ToBigEndianBytes(uint64(now.Unix())))
+	if err := tx.Write(batch, nil); err != nil {
+		tx.Discard()
+		return nil, err
+	}
+	return lease, tx.Commit()
+}
+
+// ReleaseLease gives up the lease if owner holds it, so that another worker can take
+// over without waiting for it to expire.
+func (w *WdDB) ReleaseLease(owner string) error {
+	tx, err := w.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	lease, err := getLease(tx)
+	if err != nil || lease == nil || lease.Owner != owner {
+		tx.Discard()
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete(leaseOwnerKey)
+	batch.Delete(leaseExpiryKey)
+	batch.Delete(leaseHeartbeatKey)
+	if err := tx.Write(batch, nil); err != nil {
+		tx.Discard()
+		return err
+	}
+	return tx.Commit()
+}
+
+// FileLeaseStore holds the lease in a file, meant to live on storage shared by every
+// worker. Changes are serialized by a lock file next to it and written atomically.
+type FileLeaseStore struct {
+	Path string
+}
+
+// leaseLockWait bounds the wait for another worker changing the lease file
+const leaseLockWait = 5 * time.Second
+
+type leaseFile struct {
+	Owner     string `json:"owner"`
+	Expiry    int64  `json:"expiry"`
+	Heartbeat int64  `json:"heartbeat"`
+}
+
+func (s *FileLeaseStore) GetLease() (*Lease, error) {
+	raw, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(raw) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f leaseFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", s.Path, err)
+	}
+	return &Lease{Owner: f.Owner, Expiry: time.Unix(f.Expiry, 0), Heartbeat: time.Unix(f.Heartbeat, 0)}, nil
+}
+
+// AcquireLease is WdDB.AcquireLease on the file.
+func (s *FileLeaseStore) AcquireLease(owner string, ttl time.Duration) (*Lease, error) {
+	lock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	now := time.Now()
+	lease, err := s.GetLease()
+	if err != nil {
+		return nil, err
+	}
+	if lease != nil && lease.Owner != owner && now.Before(lease.Expiry) {
+		return nil, fmt.Errorf("%w, owner: %s expiry: %v", ErrLeaseHeld, lease.Owner, lease.Expiry)
+	}
+
+	lease = &Lease{Owner: owner, Expiry: now.Add(ttl), Heartbeat: now}
+	raw, err := json.Marshal(leaseFile{Owner: owner, Expiry: lease.Expiry.Unix(), Heartbeat: now.Unix()})
+	if err != nil {
+		return nil, err
+	}
+	return lease, s.write(raw)
+}
+
+// ReleaseLease is WdDB.ReleaseLease on the file.
+func (s *FileLeaseStore) ReleaseLease(owner string) error {
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	lease, err := s.GetLease()
+	if err != nil || lease == nil || lease.Owner != owner {
+		return err
+	}
+	return s.write(nil)
+}
+
+// lock waits for the lock file while another worker changes the lease.
+func (s *FileLeaseStore) lock() (*FileLock, error) {
+	deadline := time.Now().Add(leaseLockWait)
+	for {
+		lock, err := AcquireFileLock(s.Path + ".lock")
+		if err == nil || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// write replaces the lease file, never leaving a partial one for readers.
+func (s *FileLeaseStore) write(raw []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
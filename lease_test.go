@@ -0,0 +1,133 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLease(t *testing.T) {
+	testLeaseStore(t, newTestDB(t))
+}
+
+func TestFileLeaseStore(t *testing.T) {
+	testLeaseStore(t, &FileLeaseStore{Path: filepath.Join(t.TempDir(), "lease")})
+}
+
+func testLeaseStore(t *testing.T, db LeaseStore) {
+	lease, err := db.GetLease()
+	require.NoError(t, err)
+	assert.Nil(t, lease)
+
+	_, err = db.AcquireLease("a", time.Minute)
+	require.NoError(t, err)
+
+	// renewing extends the lease of its owner only
+	_, err = db.AcquireLease("a", time.Hour)
+	require.NoError(t, err)
+	_, err = db.AcquireLease("b", time.Minute)
+	assert.True(t, errors.Is(err, ErrLeaseHeld))
+
+	lease, err = db.GetLease()
+	require.NoError(t, err)
+	assert.Equal(t, "a", lease.Owner)
+	assert.True(t, lease.Expiry.After(time.Now().Add(time.Minute)))
+
+	// releasing by someone else is a no-op
+	require.NoError(t, db.ReleaseLease("b"))
+	require.NoError(t, db.ReleaseLease("a"))
+	_, err = db.AcquireLease("b", -time.Second)
+	require.NoError(t, err)
+
+	// an expired lease can be taken over
+	_, err = db.AcquireLease("a", time.Minute)
+	require.NoError(t, err)
+}
+
+func TestWorker_Lease(t *testing.T) {
+	w, db, _ := newTestWorker(t)
+	w.Owner, w.LeaseTTL = "worker", time.Minute
+
+	_, err := db.AcquireLease("other", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, errors.Is(w.Dispatch(context.Background()), ErrLeaseHeld))
+	assert.True(t, errors.Is(w.TrackOnce(context.Background()), ErrLeaseHeld))
+
+	require.NoError(t, db.ReleaseLease("other"))
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	lease, err := db.GetLease()
+	require.NoError(t, err)
+	assert.Equal(t, "worker", lease.Owner)
+
+	require.NoError(t, w.ReleaseLease())
+	lease, err = db.GetLease()
+	require.NoError(t, err)
+	assert.Nil(t, lease)
+}
+
+func TestWorker_FileLease(t *testing.T) {
+	store := &FileLeaseStore{Path: filepath.Join(t.TempDir(), "lease")}
+	a, _, _ := newTestWorker(t)
+	a.Owner, a.LeaseTTL, a.LeaseStore = "host-a", time.Minute, store
+	b, _, _ := newTestWorker(t)
+	b.Owner, b.LeaseTTL, b.LeaseStore = "host-b", time.Minute, store
+
+	// workers with their own db still take turns through the shared lease
+	require.NoError(t, a.Dispatch(context.Background()))
+	assert.True(t, errors.Is(b.Dispatch(context.Background()), ErrLeaseHeld))
+
+	require.NoError(t, a.ReleaseLease())
+	require.NoError(t, b.Dispatch(context.Background()))
+	lease, err := store.GetLease()
+	require.NoError(t, err)
+	assert.Equal(t, "host-b", lease.Owner)
+}
+
+// losingLeaseStore lets its owner renew the lease only renewals more times.
+type losingLeaseStore struct {
+	LeaseStore
+	renewals int
+}
+
+func (s *losingLeaseStore) AcquireLease(owner string, ttl time.Duration) (*Lease, error) {
+	if s.renewals == 0 {
+		return nil, ErrLeaseHeld
+	}
+	s.renewals--
+	return s.LeaseStore.AcquireLease(owner, ttl)
+}
+
+func TestWorker_LeaseLostWhileDispatching(t *testing.T) {
+	w, db, _ := newTestWorker(t)
+	w.Owner, w.LeaseTTL = "worker", time.Minute
+	w.LeaseStore = &losingLeaseStore{LeaseStore: db, renewals: 2}
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000007101", Amount: big.NewInt(1)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000007102", Amount: big.NewInt(1)},
+	)
+
+	// the lease is renewed before each send, the one after losing it is not made
+	assert.True(t, errors.Is(w.Dispatch(context.Background()), ErrLeaseHeld))
+
+	sent, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessing, sent.Status)
+	held, err := db.GetWdObjById(ids[1])
+	require.NoError(t, err)
+	assert.Equal(t, StatusInit, held.Status)
+	assert.Empty(t, held.Hash)
+}
+
+func TestCheckLeaseTTL(t *testing.T) {
+	assert.NoError(t, CheckLeaseTTL(0, 5*time.Second), "no lease")
+	assert.NoError(t, CheckLeaseTTL(time.Minute, 5*time.Second))
+	assert.Error(t, CheckLeaseTTL(10*time.Second, 5*time.Second))
+}
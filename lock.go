@@ -0,0 +1,40 @@
+package eth_multi_transactions
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// FileLock is an exclusive advisory lock on a file, held until Release or process exit.
+type FileLock struct {
+	f *os.File
+}
+
+// AcquireFileLock locks path, creating it if needed, and writes the pid of the holder
+// into it. It fails at once if another process holds the lock.
+func AcquireFileLock(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f); err != nil {
+		holder, _ := os.ReadFile(path)
+		f.Close()
+		return nil, fmt.Errorf("%s is locked by pid %s: %w", path, strings.TrimSpace(string(holder)), err)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return &FileLock{f: f}, nil
+}
+
+func (l *FileLock) Release() error {
+	if err := unlockFile(l.f); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
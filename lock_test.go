@@ -0,0 +1,24 @@
+package eth_multi_transactions
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.lock")
+
+	lock, err := AcquireFileLock(path)
+	require.NoError(t, err)
+
+	_, err = AcquireFileLock(path)
+	assert.Error(t, err)
+
+	require.NoError(t, lock.Release())
+	lock, err = AcquireFileLock(path)
+	require.NoError(t, err)
+	require.NoError(t, lock.Release())
+}
@@ -0,0 +1,392 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+var ErrNoHealthyEndpoint = errors.New("no healthy endpoint")
+
+type endpoint struct {
+	name   string
+	client ChainClient
+
+	failures  int       // consecutive transport failures
+	openUntil time.Time // circuit open, skip the endpoint until then
+}
+
+// MultiClient spreads ChainClient calls over several nodes. Reads go to the first healthy
+// endpoint and fail over to the next one on transport errors, an endpoint failing
+// MaxFailures times in a row is skipped for Cooldown. Signed transactions are broadcast to
+// every healthy endpoint. With Quorum above one, balances and receipts must be reported
+// identically by that many endpoints.
+type MultiClient struct {
+	MaxFailures int
+	Cooldown    time.Duration
+	MaxLag      uint64 // blocks an endpoint may trail the best one before it is unhealthy
+	Quorum      int
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+}
+
+func NewMultiClient(names []string, clients []ChainClient) *MultiClient {
+	m := &MultiClient{
+		MaxFailures: 3,
+		Cooldown:    time.Minute,
+		MaxLag:      5,
+		Quorum:      1,
+	}
+	for i, c := range clients {
+		m.endpoints = append(m.endpoints, &endpoint{name: names[i], client: c})
+	}
+	return m
+}
+
+// DialMultiClient connects to every url, in order of preference. Each call to an
+// endpoint gives up after callTimeout so that the next one can be tried.
+func DialMultiClient(urls []string, callTimeout time.Duration) (*MultiClient, error) {
+	clients := make([]ChainClient, 0, len(urls))
+	for _, url := range urls {
+		c, err := ethclient.Dial(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial %s: %w", url, err)
+		}
+		clients = append(clients, WithCallTimeout(c, callTimeout))
+	}
+	return NewMultiClient(urls, clients), nil
+}
+
+// isTransportError tells failures of the endpoint itself from answers it gave, such as
+// a missing transaction or a reverted call, which another endpoint would give as well.
+func isTransportError(err error) bool {
+	// the caller gave up, not the endpoint
+	if err == nil || errors.Is(err, ethereum.NotFound) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var rpcErr rpc.Error
+	return !errors.As(err, &rpcErr)
+}
+
+func (m *MultiClient) healthy() []*endpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var ans []*endpoint
+	for _, e := range m.endpoints {
+		if now.After(e.openUntil) {
+			ans = append(ans, e)
+		}
+	}
+	return ans
+}
+
+func (m *MultiClient) report(e *endpoint, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !isTransportError(err) {
+		e.failures = 0
+		return
+	}
+
+	e.failures++
+	if e.failures >= m.MaxFailures {
+		e.openUntil = time.Now().Add(m.Cooldown)
+		logger.Warn("endpoint circuit open", "endpoint", e.name, "failures", e.failures, "err", err)
+	}
+}
+
+// do runs call against healthy endpoints in order until one of them answers.
+func (m *MultiClient) do(call func(c ChainClient) error) error {
+	err := ErrNoHealthyEndpoint
+	for _, e := range m.healthy() {
+		err = call(e.client)
+		m.report(e, err)
+		if !isTransportError(err) {
+			return err
+		}
+		logger.Warn("endpoint failed, trying next", "endpoint", e.name, "err", err)
+	}
+	return err
+}
+
+// quorum runs call against healthy endpoints until Quorum of them agree on the result key.
+func (m *MultiClient) quorum(call func(c ChainClient) (string, error)) error {
+	votes := make(map[string]int)
+	var lastErr error = ErrNoHealthyEndpoint
+	for _, e := range m.healthy() {
+		key, err := call(e.client)
+		m.report(e, err)
+		if isTransportError(err) {
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			key = "err:" + err.Error()
+		}
+
+		votes[key]++
+		if votes[key] >= m.Quorum {
+			return nil
+		}
+	}
+	if len(votes) > 1 {
+		return fmt.Errorf("endpoints disagree, quorum: %v votes: %v", m.Quorum, votes)
+	}
+	return fmt.Errorf("quorum not reached, quorum: %v votes: %v: %w", m.Quorum, votes, lastErr)
+}
+
+// CheckHealth probes every endpoint, including those with an open circuit, and opens the
+// circuit of endpoints that fail or trail the best block by more than MaxLag.
+func (m *MultiClient) CheckHealth(ctx context.Context) {
+	m.mu.Lock()
+	endpoints := append([]*endpoint(nil), m.endpoints...)
+	m.mu.Unlock()
+
+	heights := make(map[*endpoint]uint64)
+	best := uint64(0)
+	for _, e := range endpoints {
+		header, err := e.client.HeaderByNumber(ctx, nil)
+		if err != nil {
+			logger.Warn("endpoint unhealthy", "endpoint", e.name, "err", err)
+			m.mu.Lock()
+			e.failures++
+			e.openUntil = time.Now().Add(m.Cooldown)
+			m.mu.Unlock()
+			continue
+		}
+		heights[e] = header.Number.Uint64()
+		if heights[e] > best {
+			best = heights[e]
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for e, height := range heights {
+		if best-height > m.MaxLag {
+			logger.Warn("endpoint lagging", "endpoint", e.name, "height", height, "best", best)
+			e.openUntil = time.Now().Add(m.Cooldown)
+			continue
+		}
+		e.failures = 0
+		e.openUntil = time.Time{}
+	}
+}
+
+// RunHealthChecks calls CheckHealth every interval until ctx is done.
+func (m *MultiClient) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.CheckHealth(ctx)
+		}
+	}
+}
+
+func (m *MultiClient) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	var ans *big.Int
+	if m.Quorum > 1 {
+		err := m.quorum(func(c ChainClient) (string, error) {
+			v, err := c.BalanceAt(ctx, account, blockNumber)
+			if err != nil {
+				return "", err
+			}
+			ans = v
+			return v.String(), nil
+		})
+		return ans, err
+	}
+
+	err := m.do(func(c ChainClient) (err error) {
+		ans, err = c.BalanceAt(ctx, account, blockNumber)
+		return
+	})
+	return ans, err
+}
+
+func (m *MultiClient) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	var ans *types.Receipt
+	if m.Quorum > 1 {
+		var ansErr error
+		err := m.quorum(func(c ChainClient) (string, error) {
+			r, err := c.TransactionReceipt(ctx, txHash)
+			ans, ansErr = r, err
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s-%d", r.BlockHash.Hex(), r.Status), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ans, ansErr
+	}
+
+	err := m.do(func(c ChainClient) (err error) {
+		ans, err = c.TransactionReceipt(ctx, txHash)
+		return
+	})
+	return ans, err
+}
+
+// SendTransaction broadcasts tx to every healthy endpoint, it succeeds if any accepts it.
+func (m *MultiClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	endpoints := m.healthy()
+	if len(endpoints) == 0 {
+		return ErrNoHealthyEndpoint
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted bool
+		errs     []error
+	)
+	for _, e := range endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			err := e.client.SendTransaction(ctx, tx)
+			m.report(e, err)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil || isKnownTransaction(err) {
+				accepted = true
+				return
+			}
+			logger.Warn("endpoint rejected transaction", "endpoint", e.name, "txid", tx.Hash().Hex(), "err", err)
+			errs = append(errs, err)
+		}(e)
+	}
+	wg.Wait()
+
+	if accepted {
+		return nil
+	}
+	// an endpoint failing otherwise than rejecting may hold the transaction
+	for _, err := range errs {
+		if !isRejection(err) {
+			return err
+		}
+	}
+	return errs[0]
+}
+
+// ChainID asks every healthy endpoint and fails unless they all report the same chain, so
+// that a misconfigured endpoint cannot take over after a failover.
+func (m *MultiClient) ChainID(ctx context.Context) (*big.Int, error) {
+	return m.agree(func(c ChainClient) (*big.Int, error) { return c.ChainID(ctx) })
+}
+
+func (m *MultiClient) NetworkID(ctx context.Context) (*big.Int, error) {
+	return m.agree(func(c ChainClient) (*big.Int, error) { return c.NetworkID(ctx) })
+}
+
+func (m *MultiClient) agree(call func(c ChainClient) (*big.Int, error)) (*big.Int, error) {
+	var (
+		ans      *big.Int
+		answered string
+		lastErr  error = ErrNoHealthyEndpoint
+	)
+	for _, e := range m.healthy() {
+		v, err := call(e.client)
+		m.report(e, err)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if ans != nil && ans.Cmp(v) != 0 {
+			return nil, fmt.Errorf("endpoints on different chains, %s: %v %s: %v", answered, ans, e.name, v)
+		}
+		ans, answered = v, e.name
+	}
+	if ans == nil {
+		return nil, lastErr
+	}
+	return ans, nil
+}
+
+func (m *MultiClient) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (ans uint64, err error) {
+	err = m.do(func(c ChainClient) (err error) {
+		ans, err = c.NonceAt(ctx, account, blockNumber)
+		return
+	})
+	return
+}
+
+func (m *MultiClient) PendingNonceAt(ctx context.Context, account common.Address) (ans uint64, err error) {
+	err = m.do(func(c ChainClient) (err error) {
+		ans, err = c.PendingNonceAt(ctx, account)
+		return
+	})
+	return
+}
+
+func (m *MultiClient) SuggestGasPrice(ctx context.Context) (ans *big.Int, err error) {
+	err = m.do(func(c ChainClient) (err error) {
+		ans, err = c.SuggestGasPrice(ctx)
+		return
+	})
+	return
+}
+
+func (m *MultiClient) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (ans uint64, err error) {
+	err = m.do(func(c ChainClient) (err error) {
+		ans, err = c.EstimateGas(ctx, msg)
+		return
+	})
+	return
+}
+
+func (m *MultiClient) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) (ans []byte, err error) {
+	err = m.do(func(c ChainClient) (err error) {
+		ans, err = c.CallContract(ctx, msg, blockNumber)
+		return
+	})
+	return
+}
+
+func (m *MultiClient) PendingCallContract(ctx context.Context, msg ethereum.CallMsg) (ans []byte, err error) {
+	err = m.do(func(c ChainClient) (err error) {
+		ans, err = c.PendingCallContract(ctx, msg)
+		return
+	})
+	return
+}
+
+func (m *MultiClient) TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error) {
+	err = m.do(func(c ChainClient) (err error) {
+		tx, isPending, err = c.TransactionByHash(ctx, hash)
+		return
+	})
+	return
+}
+
+func (m *MultiClient) HeaderByNumber(ctx context.Context, number *big.Int) (ans *types.Header, err error) {
+	err = m.do(func(c ChainClient) (err error) {
+		ans, err = c.HeaderByNumber(ctx, number)
+		return
+	})
+	return
+}
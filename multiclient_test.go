@@ -0,0 +1,131 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errConnRefused = errors.New("dial tcp: connection refused")
+
+// downClient fails every call it overrides like an unreachable node
+type downClient struct {
+	ChainClient
+}
+
+func (c *downClient) BalanceAt(context.Context, common.Address, *big.Int) (*big.Int, error) {
+	return nil, errConnRefused
+}
+
+func (c *downClient) SendTransaction(context.Context, *types.Transaction) error {
+	return errConnRefused
+}
+
+func (c *downClient) HeaderByNumber(context.Context, *big.Int) (*types.Header, error) {
+	return nil, errConnRefused
+}
+
+// skewedClient reports balances off by one and a chain head behind by lag
+type skewedClient struct {
+	ChainClient
+	lag int64
+}
+
+func (c *skewedClient) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error) {
+	v, err := c.ChainClient.BalanceAt(ctx, account, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	return v.Add(v, big.NewInt(1)), nil
+}
+
+func (c *skewedClient) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	h, err := c.ChainClient.HeaderByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	h.Number = big.NewInt(0).Sub(h.Number, big.NewInt(c.lag))
+	return h, nil
+}
+
+func TestMultiClient_Failover(t *testing.T) {
+	sim, _, from := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+
+	m := NewMultiClient([]string{"down", "sim"}, []ChainClient{&downClient{client}, client})
+	m.MaxFailures = 2
+
+	for i := 0; i < 3; i++ {
+		balance, err := m.BalanceAt(context.Background(), from, nil)
+		require.NoError(t, err)
+		assert.Positive(t, balance.Sign())
+	}
+
+	// the failing endpoint is skipped once its circuit opened
+	healthy := m.healthy()
+	require.Len(t, healthy, 1)
+	assert.Equal(t, "sim", healthy[0].name)
+
+	// answers such as a missing receipt are not failures
+	_, err := m.TransactionReceipt(context.Background(), common.Hash{1})
+	assert.Error(t, err)
+	assert.Len(t, m.healthy(), 1)
+}
+
+func TestMultiClient_Quorum(t *testing.T) {
+	sim, _, from := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+
+	m := NewMultiClient([]string{"a", "b"}, []ChainClient{client, client})
+	m.Quorum = 2
+	balance, err := m.BalanceAt(context.Background(), from, nil)
+	require.NoError(t, err)
+	assert.Positive(t, balance.Sign())
+
+	m = NewMultiClient([]string{"a", "b"}, []ChainClient{client, &skewedClient{ChainClient: client}})
+	m.Quorum = 2
+	_, err = m.BalanceAt(context.Background(), from, nil)
+	assert.Error(t, err)
+}
+
+func TestMultiClient_Broadcast(t *testing.T) {
+	sim, key, from := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+
+	m := NewMultiClient([]string{"down", "sim"}, []ChainClient{&downClient{client}, client})
+
+	tx, err := signTransaction(context.Background(), m, common.HexToAddress("0x0000000000000000000000000000000000005001"), big.NewInt(1), nil, 0, from, key, simChainID, DefaultTxPolicy)
+	require.NoError(t, err)
+	require.NoError(t, m.SendTransaction(context.Background(), tx))
+
+	_, isPending, err := client.TransactionByHash(context.Background(), tx.Hash())
+	require.NoError(t, err)
+	assert.True(t, isPending)
+
+	m = NewMultiClient([]string{"down"}, []ChainClient{&downClient{client}})
+	assert.Error(t, m.SendTransaction(context.Background(), tx))
+}
+
+func TestMultiClient_CheckHealth(t *testing.T) {
+	sim, _, _ := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+	for i := 0; i < 10; i++ {
+		client.Commit()
+	}
+
+	m := NewMultiClient(
+		[]string{"sim", "lagging", "down"},
+		[]ChainClient{client, &skewedClient{ChainClient: client, lag: 8}, &downClient{client}},
+	)
+	m.CheckHealth(context.Background())
+
+	healthy := m.healthy()
+	require.Len(t, healthy, 1)
+	assert.Equal(t, "sim", healthy[0].name)
+}
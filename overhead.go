@@ -0,0 +1,139 @@
+package eth_multi_transactions
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// kinds of overhead transactions
+const (
+	OverheadApprove = "approve"
+)
+
+// Overhead is a transaction the worker sent besides payouts, such as a token approval for
+// the disperse contract, whose fee no withdrawal bears.
+type Overhead struct {
+	Id       uint64
+	Kind     string // OverheadApprove
+	Token    string
+	Hash     string
+	Time     uint64   // of the broadcast
+	GasUsed  uint64   // execution of Hash, recorded once mined
+	GasPrice *big.Int // effective price per gas, nil until mined
+	Fee      *big.Int // in wei, nil until mined
+}
+
+// PutOverhead records the broadcast of transaction hash of kind for token, its fee being
+// recorded by SetOverheadFee once mined. It returns the id of the entry.
+func (w *WdDB) PutOverhead(kind string, token string, hash string) (uint64, error) {
+	tx, err := w.db.OpenTransaction()
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := w.nextId(tx, "kv-overheadid")
+	if err != nil {
+		tx.Discard()
+		return 0, err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(w.key("ohkind-", id), []byte(kind))
+	batch.Put(w.key("ohtoken-", id), []byte(token))
+	batch.Put(w.key("ohhash-", id), []byte(hash))
+	batch.Put(w.key("ohtime-", id), ToBigEndianBytes(uint64(time.Now().Unix())))
+	if err := tx.Write(batch, nil); err != nil {
+		tx.Discard()
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// SetOverheadFee records the execution of the transaction of overhead id.
+func (w *WdDB) SetOverheadFee(id uint64, gasUsed uint64, gasPrice *big.Int, fee *big.Int) error {
+	batch := new(leveldb.Batch)
+	batch.Put(w.key("ohgasused-", id), ToBigEndianBytes(gasUsed))
+	// a zero price is stored as a single zero byte, as empty means unknown
+	batch.Put(w.key("ohgasprice-", id), append([]byte{0}, gasPrice.Bytes()...))
+	batch.Put(w.key("ohfee-", id), append([]byte{0}, fee.Bytes()...))
+	return w.db.Write(batch, nil)
+}
+
+// Overheads returns every overhead transaction, oldest first.
+func (w *WdDB) Overheads() ([]*Overhead, error) {
+	prefix := w.prefixed([]byte("ohhash-"))
+	itr := w.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer itr.Release()
+
+	var ids []uint64
+	for itr.Next() {
+		id, err := FromBigEndianBytes(itr.Key()[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+
+	ans := make([]*Overhead, 0, len(ids))
+	for _, id := range ids {
+		o, err := w.getOverhead(id)
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, o)
+	}
+	return ans, nil
+}
+
+func (w *WdDB) getOverhead(id uint64) (*Overhead, error) {
+	ans := Overhead{Id: id}
+
+	if v, err := w.db.Get(w.key("ohkind-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Kind = string(v)
+	}
+
+	if v, err := w.db.Get(w.key("ohtoken-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Token = string(v)
+	}
+
+	if v, err := w.db.Get(w.key("ohhash-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Hash = string(v)
+	}
+
+	if v, err := w.db.Get(w.key("ohtime-", id), nil); err != nil {
+		return nil, err
+	} else {
+		ans.Time, _ = FromBigEndianBytes(v)
+	}
+
+	if v, err := w.getOptional(w.key("ohgasused-", id)); err != nil {
+		return nil, err
+	} else if len(v) > 0 {
+		ans.GasUsed, _ = FromBigEndianBytes(v)
+	}
+
+	if v, err := w.getOptional(w.key("ohgasprice-", id)); err != nil {
+		return nil, err
+	} else if len(v) > 0 {
+		ans.GasPrice = big.NewInt(0).SetBytes(v)
+	}
+
+	if v, err := w.getOptional(w.key("ohfee-", id)); err != nil {
+		return nil, err
+	} else if len(v) > 0 {
+		ans.Fee = big.NewInt(0).SetBytes(v)
+	}
+	return &ans, nil
+}
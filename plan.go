@@ -0,0 +1,265 @@
+package eth_multi_transactions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Plan is a named payout generated on a schedule, kept in the db with every version of it.
+type Plan struct {
+	Name         string          `json:"name"`
+	Version      uint64          `json:"version"`            // set when stored, from 1
+	Distribution json.RawMessage `json:"distribution"`       // as read by ParseDistribution
+	Token        string          `json:"token,omitempty"`    // split, empty for ether
+	Schedule     string          `json:"schedule"`           // cron expression
+	Timezone     string          `json:"timezone,omitempty"` // of the schedule, empty for local time
+	CatchUp      string          `json:"catchUp,omitempty"`  // latest or skip, empty for latest
+	Reserve      ReservePolicy   `json:"reserve"`            // kept back before splitting, empty for the chain's, none for a token
+	Updated      uint64          `json:"updated"`            // set when stored
+	Deleted      bool            `json:"deleted,omitempty"`  // the version deleting the plan
+}
+
+// Parse checks the plan and returns its distribution and schedule.
+func (p *Plan) Parse() (Distribution, *Schedule, error) {
+	if p.Name == "" || strings.Contains(p.Name, "/") {
+		return nil, nil, fmt.Errorf("invalid plan name: %q", p.Name)
+	}
+	if p.Token != "" && !common.IsHexAddress(p.Token) {
+		return nil, nil, fmt.Errorf("invalid token: %s", p.Token)
+	}
+
+	if p.Reserve.Kind != "" {
+		if err := p.Reserve.validate(); err != nil {
+			return nil, nil, err
+		}
+		if p.Token != "" && p.Reserve.Kind == "estimate" {
+			return nil, nil, errors.New("fees are paid in ether, a token plan cannot reserve their estimate")
+		}
+	}
+
+	dist, err := ParseDistribution(p.Distribution)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var loc *time.Location
+	if p.Timezone != "" {
+		if loc, err = time.LoadLocation(p.Timezone); err != nil {
+			return nil, nil, err
+		}
+	}
+	catchUp := CatchUpLatest
+	if p.CatchUp != "" {
+		if catchUp, err = ParseCatchUp(p.CatchUp); err != nil {
+			return nil, nil, err
+		}
+	}
+	if catchUp == CatchUpAll {
+		// every missed period would split the same live balance again
+		return nil, nil, errors.New("a plan splits the live balance, it cannot catch up on all missed periods")
+	}
+	// periods are kept per plan, not per version, so editing a plan never generates a period twice
+	schedule, err := ParseSchedule("plan/"+p.Name, p.Schedule, loc, catchUp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dist, schedule, nil
+}
+
+func (w *WdDB) planKey(name string, version uint64) []byte {
+	return append(w.prefixed([]byte("planv-"+name+"/")), ToBigEndianBytes(version)...)
+}
+
+// PutPlan checks p and stores it as the next version of its plan, setting Version and Updated.
+// A plan splits the whole balance of its token, so a token is split by one plan only.
+func (w *WdDB) PutPlan(p *Plan) error {
+	if _, _, err := p.Parse(); err != nil {
+		return err
+	}
+
+	plans, err := w.ListPlans()
+	if err != nil {
+		return err
+	}
+	for _, other := range plans {
+		if other.Name != p.Name && sameToken(other.Token, p.Token) {
+			return fmt.Errorf("plan %q already splits the balance of the token", other.Name)
+		}
+	}
+	return w.putPlan(p)
+}
+
+func sameToken(a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+	return common.HexToAddress(a) == common.HexToAddress(b)
+}
+
+// Committed returns the amount of token, empty for ether, the balance holds for others: the
+// withdrawals not paid yet and the dust owed to recipients.
+func (w *WdDB) Committed(token string) (*big.Int, error) {
+	ans := big.NewInt(0)
+	for _, status := range []uint64{StatusInit, StatusAwaitingApproval, StatusProcessing, StatusCancelling} {
+		ids, err := w.GetRecordsIdByStatus(status)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			obj, err := w.GetWdObjById(id)
+			if err != nil {
+				return nil, err
+			}
+			if !sameToken(obj.Token, token) || obj.BlockHash != "" {
+				// another token, or mined and already off the balance
+				continue
+			}
+			ans.Add(ans, obj.Amount)
+		}
+	}
+
+	dust, err := w.Dust(token)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range dust {
+		ans.Add(ans, v)
+	}
+
+	// dust taken by withdrawals done without paying, owed again from the next InsertShares
+	prefix := w.prefixed([]byte("dustpaid-"))
+	itr := w.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer itr.Release()
+	for itr.Next() {
+		id, err := FromBigEndianBytes(itr.Key()[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		obj, err := w.GetWdObjById(id)
+		if err != nil {
+			return nil, err
+		}
+		if sameToken(obj.Token, token) && unpaid(obj.Status) {
+			ans.Add(ans, big.NewInt(0).SetBytes(itr.Value()))
+		}
+	}
+	return ans, itr.Error()
+}
+
+// DeletePlan stores a version deleting plan name, keeping the versions batches refer to.
+func (w *WdDB) DeletePlan(name string) error {
+	if _, err := w.GetPlan(name); err != nil {
+		return err
+	}
+	return w.putPlan(&Plan{Name: name, Deleted: true})
+}
+
+func (w *WdDB) putPlan(p *Plan) error {
+	tx, err := w.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	last, err := w.lastPlanVersion(tx, p.Name)
+	if err != nil {
+		tx.Discard()
+		return err
+	}
+
+	stored := *p
+	stored.Version = last + 1
+	stored.Updated = uint64(time.Now().Unix())
+	raw, err := json.Marshal(&stored)
+	if err != nil {
+		tx.Discard()
+		return err
+	}
+	if err := tx.Put(w.planKey(p.Name, stored.Version), raw, nil); err != nil {
+		tx.Discard()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	p.Version, p.Updated = stored.Version, stored.Updated
+	return nil
+}
+
+func (w *WdDB) lastPlanVersion(tx *leveldb.Transaction, name string) (uint64, error) {
+	itr := tx.NewIterator(util.BytesPrefix(w.prefixed([]byte("planv-"+name+"/"))), nil)
+	defer itr.Release()
+
+	if !itr.Last() {
+		return 0, itr.Error()
+	}
+	return FromBigEndianBytes(itr.Key()[len(itr.Key())-8:])
+}
+
+// GetPlan returns the latest version of plan name, leveldb.ErrNotFound if there is none or
+// it was deleted.
+func (w *WdDB) GetPlan(name string) (*Plan, error) {
+	plans, err := w.plans("planv-" + name + "/")
+	if err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return nil, leveldb.ErrNotFound
+	}
+	return plans[0], nil
+}
+
+// GetPlanVersion returns the given version of plan name.
+func (w *WdDB) GetPlanVersion(name string, version uint64) (*Plan, error) {
+	raw, err := w.db.Get(w.planKey(name, version), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Plan
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ListPlans returns the latest version of every plan not deleted, by name.
+func (w *WdDB) ListPlans() ([]*Plan, error) {
+	return w.plans("planv-")
+}
+
+// plans returns the latest version of the plans stored under prefix, skipping deleted ones.
+func (w *WdDB) plans(prefix string) ([]*Plan, error) {
+	itr := w.db.NewIterator(util.BytesPrefix(w.prefixed([]byte(prefix))), nil)
+	defer itr.Release()
+
+	var (
+		ans  []*Plan
+		last *Plan
+	)
+	for itr.Next() {
+		var p Plan
+		if err := json.Unmarshal(itr.Value(), &p); err != nil {
+			return nil, err
+		}
+		if last != nil && last.Name != p.Name && !last.Deleted {
+			ans = append(ans, last)
+		}
+		last = &p
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+	if last != nil && !last.Deleted {
+		ans = append(ans, last)
+	}
+	return ans, nil
+}
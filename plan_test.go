@@ -0,0 +1,135 @@
+package eth_multi_transactions
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func testPlan(name string, weight int) *Plan {
+	return &Plan{
+		Name:         name,
+		Distribution: []byte(`{"type": "weighted", "recipients": [{"address": "a", "weight": ` + big.NewInt(int64(weight)).String() + `}]}`),
+		Schedule:     "@daily",
+	}
+}
+
+func TestWdDB_Plans(t *testing.T) {
+	db := newTestDB(t)
+
+	a := testPlan("a", 1)
+	require.NoError(t, db.PutPlan(a))
+	assert.Equal(t, uint64(1), a.Version)
+	ab := testPlan("ab", 1)
+	ab.Token = "0x0000000000000000000000000000000000000aaa"
+	require.NoError(t, db.PutPlan(ab))
+
+	a = testPlan("a", 2)
+	require.NoError(t, db.PutPlan(a))
+	assert.Equal(t, uint64(2), a.Version)
+
+	got, err := db.GetPlan("a")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), got.Version)
+	assert.NotZero(t, got.Updated)
+
+	old, err := db.GetPlanVersion("a", 1)
+	require.NoError(t, err)
+	dist, _, err := old.Parse()
+	require.NoError(t, err)
+	shares, _, err := dist.Split(big.NewInt(1))
+	require.NoError(t, err)
+	assert.Equal(t, "1", shares[0].Amount.String())
+
+	plans, err := db.ListPlans()
+	require.NoError(t, err)
+	require.Len(t, plans, 2)
+	assert.Equal(t, "a", plans[0].Name)
+	assert.Equal(t, uint64(2), plans[0].Version)
+	assert.Equal(t, "ab", plans[1].Name)
+
+	// deleting keeps the versions and numbering
+	require.NoError(t, db.DeletePlan("a"))
+	_, err = db.GetPlan("a")
+	assert.True(t, errors.Is(err, leveldb.ErrNotFound))
+	assert.True(t, errors.Is(db.DeletePlan("a"), leveldb.ErrNotFound))
+	_, err = db.GetPlanVersion("a", 2)
+	require.NoError(t, err)
+
+	plans, err = db.ListPlans()
+	require.NoError(t, err)
+	require.Len(t, plans, 1)
+
+	a = testPlan("a", 3)
+	require.NoError(t, db.PutPlan(a))
+	assert.Equal(t, uint64(4), a.Version)
+
+	// plans are kept per chain
+	plans, err = db.ForChain("other").ListPlans()
+	require.NoError(t, err)
+	assert.Empty(t, plans)
+
+	for _, p := range []*Plan{
+		{Name: "a/b", Distribution: a.Distribution, Schedule: "@daily"},
+		{Name: "c", Distribution: []byte(`{"type": "lottery"}`), Schedule: "@daily"},
+		{Name: "c", Distribution: a.Distribution, Schedule: "sometimes"},
+		{Name: "c", Distribution: a.Distribution, Schedule: "@daily", Token: "0x01", Reserve: ReservePolicy{Kind: "estimate", Safety: 2}},
+		// the balances of ether and of the token are split by a and ab already
+		{Name: "c", Distribution: a.Distribution, Schedule: "@daily"},
+		{Name: "c", Distribution: a.Distribution, Schedule: "@daily", Token: "0x0000000000000000000000000000000000000AAA"},
+	} {
+		assert.Error(t, db.PutPlan(p), p.Name)
+	}
+
+	b := &PayoutBatch{Total: big.NewInt(0), Leftover: big.NewInt(0), Plan: "a", Version: 4}
+	require.NoError(t, db.InsertBatch(b, nil))
+	batch, err := db.GetBatch(b.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "a", batch.Plan)
+	assert.Equal(t, uint64(4), batch.Version)
+}
+
+func TestPlan_ParseCatchUp(t *testing.T) {
+	p := testPlan("a", 1)
+	for _, rule := range []string{"", "latest", "skip"} {
+		p.CatchUp = rule
+		_, _, err := p.Parse()
+		assert.NoError(t, err, rule)
+	}
+
+	// every missed period would split the same balance
+	p.CatchUp = "all"
+	_, _, err := p.Parse()
+	assert.Error(t, err)
+}
+
+func TestWdDB_Committed(t *testing.T) {
+	db := newTestDB(t)
+	token := "0x0000000000000000000000000000000000000aaa"
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001001", Amount: big.NewInt(1)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001002", Amount: big.NewInt(2)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001003", Amount: big.NewInt(4)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001004", Amount: big.NewInt(8), Token: token},
+	)
+	// mined or failed withdrawals are off the balance or never leave it
+	require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(ids[1]), StatusInit, StatusProcessing))
+	require.NoError(t, db.SetBlock(ids[1], 1, "0x01"))
+	require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(ids[2]), StatusInit, StatusFailed))
+
+	_, err := db.InsertShares(&PayoutBatch{Total: big.NewInt(16), Leftover: big.NewInt(0)},
+		[]Share{{Address: "a", Amount: big.NewInt(16), Min: big.NewInt(100)}})
+	require.NoError(t, err)
+
+	committed, err := db.Committed("")
+	require.NoError(t, err)
+	assert.Equal(t, "17", committed.String())
+	committed, err = db.Committed(token)
+	require.NoError(t, err)
+	assert.Equal(t, "8", committed.String())
+}
@@ -0,0 +1,298 @@
+package eth_multi_transactions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Duration is a time.Duration read from JSON as a string like "720h".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Recurring pays a fixed amount to an address once per period of a cron schedule.
+type Recurring struct {
+	Name     string   `json:"name"`
+	Chain    string   `json:"chain,omitempty"`
+	Address  string   `json:"address"`
+	Token    string   `json:"token,omitempty"` // empty for ether
+	Amount   *big.Int `json:"amount"`
+	Schedule string   `json:"schedule"`           // cron expression
+	Timezone string   `json:"timezone,omitempty"` // of the schedule, empty for local time
+	CatchUp  string   `json:"catchUp,omitempty"`  // latest, skip or all, empty for all as every period is owed
+}
+
+// Parse checks r and returns its schedule.
+func (r *Recurring) Parse() (*Schedule, error) {
+	if err := checkPayee(r.Name, r.Address, r.Token); err != nil {
+		return nil, err
+	}
+	if r.Amount == nil || r.Amount.Sign() <= 0 {
+		return nil, fmt.Errorf("recurring %q: invalid amount", r.Name)
+	}
+
+	var (
+		loc *time.Location
+		err error
+	)
+	if r.Timezone != "" {
+		if loc, err = time.LoadLocation(r.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	catchUp := CatchUpAll
+	if r.CatchUp != "" {
+		if catchUp, err = ParseCatchUp(r.CatchUp); err != nil {
+			return nil, err
+		}
+	}
+	return ParseSchedule("recurring/"+r.Name, r.Schedule, loc, catchUp)
+}
+
+// InsertRecurring records the payout of r for period, failing with ErrPeriodGenerated if
+// it was recorded already.
+func (w *WdDB) InsertRecurring(r *Recurring, schedule string, period time.Time) (*DbWithdrawalObj, error) {
+	now := uint64(time.Now().Unix())
+	obj := &DbWithdrawalObj{Address: r.Address, Token: r.Token, Amount: r.Amount, Chain: w.chain, Created: now, Modified: now}
+	b := &PayoutBatch{
+		Token:    r.Token,
+		Total:    r.Amount,
+		Leftover: big.NewInt(0),
+		Schedule: schedule,
+		Period:   uint64(period.Unix()),
+		Created:  now,
+	}
+	return obj, w.InsertBatch(b, []*DbWithdrawalObj{obj})
+}
+
+// Vesting releases Total to an address linearly from Start over Duration, in steps of Period.
+// Nothing is released before the cliff, Start plus Cliff, when what vested until then is
+// released at once. A vesting without Duration releases Total at the cliff.
+type Vesting struct {
+	Name     string    `json:"name"`
+	Chain    string    `json:"chain,omitempty"`
+	Address  string    `json:"address"`
+	Token    string    `json:"token,omitempty"` // empty for ether
+	Total    *big.Int  `json:"total"`
+	Start    time.Time `json:"start"`
+	Cliff    Duration  `json:"cliff"`
+	Duration Duration  `json:"duration"`
+	Period   Duration  `json:"period"`
+}
+
+func (v *Vesting) Validate() error {
+	if err := checkPayee(v.Name, v.Address, v.Token); err != nil {
+		return err
+	}
+	switch {
+	case v.Total == nil || v.Total.Sign() <= 0:
+		return fmt.Errorf("vesting %q: invalid total", v.Name)
+	case v.Start.IsZero():
+		return fmt.Errorf("vesting %q: no start", v.Name)
+	case v.Cliff.Duration < 0 || v.Duration.Duration < 0 || v.Cliff.Duration > v.Duration.Duration && v.Duration.Duration > 0:
+		return fmt.Errorf("vesting %q: invalid cliff or duration", v.Name)
+	case v.Duration.Duration > 0 && v.Period.Duration <= 0:
+		// releasing continuously would pay a withdrawal on every check
+		return fmt.Errorf("vesting %q: no period", v.Name)
+	}
+	return nil
+}
+
+// Vested returns the amount vested at t.
+func (v *Vesting) Vested(t time.Time) *big.Int {
+	elapsed := t.Sub(v.Start)
+	switch {
+	case elapsed < v.Cliff.Duration:
+		return big.NewInt(0)
+	case elapsed >= v.Duration.Duration:
+		return big.NewInt(0).Set(v.Total)
+	}
+
+	elapsed -= elapsed % v.Period.Duration
+	vested := big.NewInt(0).Mul(v.Total, big.NewInt(int64(elapsed)))
+	return vested.Div(vested, big.NewInt(int64(v.Duration.Duration)))
+}
+
+// NextRelease returns the first time after t the vested amount grows, zero once fully vested.
+func (v *Vesting) NextRelease(t time.Time) time.Time {
+	elapsed := t.Sub(v.Start)
+	switch {
+	case elapsed < v.Cliff.Duration:
+		return v.Start.Add(v.Cliff.Duration)
+	case elapsed >= v.Duration.Duration:
+		return time.Time{}
+	}
+
+	next := elapsed - elapsed%v.Period.Duration + v.Period.Duration
+	if next < v.Cliff.Duration {
+		next = v.Cliff.Duration
+	}
+	if next > v.Duration.Duration {
+		next = v.Duration.Duration
+	}
+	return v.Start.Add(next)
+}
+
+func (w *WdDB) vestedKey(name string) []byte {
+	return w.prefixed([]byte("kv-vested-" + name))
+}
+
+// GetReleased returns the amount of vesting name released to withdrawals so far, less the
+// releases ReleaseVested found done without paying.
+func (w *WdDB) GetReleased(name string) (*big.Int, error) {
+	v, err := w.getOptional(w.vestedKey(name))
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(0).SetBytes(v), nil
+}
+
+// ReleaseVested records a withdrawal of what v vested by t and was not paid yet, nil if
+// nothing is due. What is paid is kept in the db along with the withdrawal, and owed
+// again once the withdrawal is done without paying, like a rejected or failed one.
+func (w *WdDB) ReleaseVested(v *Vesting, t time.Time) (*DbWithdrawalObj, error) {
+	tx, err := w.db.OpenTransaction()
+	if err != nil {
+		return nil, err
+	}
+
+	key := w.vestedKey(v.Name)
+	released := big.NewInt(0)
+	if raw, err := tx.Get(key, nil); err == nil {
+		released.SetBytes(raw)
+	} else if !errors.Is(err, leveldb.ErrNotFound) {
+		tx.Discard()
+		return nil, err
+	}
+
+	paid := "vestpaid-" + v.Name + "/"
+	err = w.settlePayouts(tx, paid, func(id uint64, amount *big.Int) error {
+		released.Sub(released, amount)
+		return nil
+	})
+	if err != nil {
+		tx.Discard()
+		return nil, err
+	}
+	if err := tx.Put(key, released.Bytes(), nil); err != nil {
+		tx.Discard()
+		return nil, err
+	}
+
+	vested := v.Vested(t)
+	due := big.NewInt(0).Sub(vested, released)
+	if due.Sign() <= 0 {
+		return nil, tx.Commit()
+	}
+
+	now := uint64(time.Now().Unix())
+	obj := &DbWithdrawalObj{Address: v.Address, Token: v.Token, Amount: due, Chain: w.chain, Created: now, Modified: now}
+	b := &PayoutBatch{Token: v.Token, Total: due, Leftover: big.NewInt(0), Created: now}
+	if _, err := w.insertBatch(tx, b, []*DbWithdrawalObj{obj}); err != nil {
+		tx.Discard()
+		return nil, err
+	}
+	if err := tx.Put(key, vested.Bytes(), nil); err != nil {
+		tx.Discard()
+		return nil, err
+	}
+	if err := tx.Put(w.key(paid, obj.Id), due.Bytes(), nil); err != nil {
+		tx.Discard()
+		return nil, err
+	}
+	return obj, tx.Commit()
+}
+
+// PendingReleases returns the number of withdrawals released by vesting name not yet known
+// to have paid or to be done without paying.
+func (w *WdDB) PendingReleases(name string) (int, error) {
+	itr := w.db.NewIterator(util.BytesPrefix(w.prefixed([]byte("vestpaid-"+name+"/"))), nil)
+	defer itr.Release()
+
+	n := 0
+	for itr.Next() {
+		n++
+	}
+	return n, itr.Error()
+}
+
+func checkPayee(name, address, token string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid name: %q", name)
+	}
+	if !common.IsHexAddress(address) {
+		return fmt.Errorf("%s: invalid address: %s", name, address)
+	}
+	if token != "" && !common.IsHexAddress(token) {
+		return fmt.Errorf("%s: invalid token: %s", name, token)
+	}
+	return nil
+}
+
+// PayoutSchedules are the recurring payouts and vestings a worker pays.
+type PayoutSchedules struct {
+	Recurring []*Recurring `json:"recurring"`
+	Vesting   []*Vesting   `json:"vesting"`
+}
+
+// LoadPayoutSchedules reads PayoutSchedules from a JSON file at path and checks them.
+func LoadPayoutSchedules(path string) (*PayoutSchedules, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s PayoutSchedules
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range s.Recurring {
+		if _, err := r.Parse(); err != nil {
+			return nil, err
+		}
+		key := "recurring/" + r.Chain + "/" + r.Name
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate recurring payout %q", r.Name)
+		}
+		seen[key] = true
+	}
+	for _, v := range s.Vesting {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+		key := "vesting/" + v.Chain + "/" + v.Name
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate vesting %q", v.Name)
+		}
+		seen[key] = true
+	}
+	return &s, nil
+}
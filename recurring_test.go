@@ -0,0 +1,177 @@
+package eth_multi_transactions
+
+import (
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVesting(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	v := &Vesting{
+		Name:     "team",
+		Address:  "0x000000000000000000000000000000000000a001",
+		Total:    big.NewInt(1000),
+		Start:    start,
+		Cliff:    Duration{30 * day},
+		Duration: Duration{100 * day},
+		Period:   Duration{10 * day},
+	}
+	require.NoError(t, v.Validate())
+
+	for _, c := range []struct {
+		at   time.Duration
+		want string
+		next time.Duration
+	}{
+		{-day, "0", 30 * day},
+		{29 * day, "0", 30 * day},
+		{30 * day, "300", 40 * day},
+		{45 * day, "400", 50 * day},
+		{99 * day, "900", 100 * day},
+		{100 * day, "1000", -1},
+	} {
+		assert.Equal(t, c.want, v.Vested(start.Add(c.at)).String(), "at %v", c.at)
+		want := time.Time{}
+		if c.next >= 0 {
+			want = start.Add(c.next)
+		}
+		assert.Equal(t, want, v.NextRelease(start.Add(c.at)), "at %v", c.at)
+	}
+
+	// a cliff only vesting pays everything at once
+	cliff := *v
+	cliff.Duration, cliff.Period = Duration{}, Duration{}
+	require.NoError(t, cliff.Validate())
+	assert.Equal(t, "0", cliff.Vested(start.Add(29*day)).String())
+	assert.Equal(t, "1000", cliff.Vested(start.Add(30*day)).String())
+
+	invalid := *v
+	invalid.Period = Duration{}
+	assert.Error(t, invalid.Validate())
+}
+
+func TestWdDB_ReleaseVested(t *testing.T) {
+	db := newTestDB(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := &Vesting{
+		Name:     "team",
+		Address:  "0x000000000000000000000000000000000000a001",
+		Total:    big.NewInt(1000),
+		Start:    start,
+		Duration: Duration{10 * time.Hour},
+		Period:   Duration{time.Hour},
+	}
+
+	obj, err := db.ReleaseVested(v, start.Add(150*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "200", obj.Amount.String())
+
+	// only the unpaid difference is released, once
+	obj, err = db.ReleaseVested(v, start.Add(150*time.Minute))
+	require.NoError(t, err)
+	assert.Nil(t, obj)
+
+	obj, err = db.ReleaseVested(v, start.Add(20*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, "800", obj.Amount.String())
+
+	stored, err := db.GetWdObjById(obj.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "800", stored.Amount.String())
+
+	released, err := db.GetReleased("team")
+	require.NoError(t, err)
+	assert.Equal(t, "1000", released.String())
+}
+
+func TestWdDB_ReleaseVestedUnpaid(t *testing.T) {
+	db := newTestDB(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := &Vesting{
+		Name:    "team",
+		Address: "0x000000000000000000000000000000000000a001",
+		Total:   big.NewInt(1000),
+		Start:   start,
+	}
+
+	first, err := db.ReleaseVested(v, start)
+	require.NoError(t, err)
+	require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(first.Id), StatusInit, StatusExpired))
+
+	// the expired release is owed again
+	second, err := db.ReleaseVested(v, start)
+	require.NoError(t, err)
+	require.NotNil(t, second)
+	assert.Equal(t, "1000", second.Amount.String())
+
+	pending, err := db.PendingReleases("team")
+	require.NoError(t, err)
+	assert.Equal(t, 1, pending)
+
+	// a confirmed one is not
+	require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(second.Id), StatusInit, StatusConfirmed))
+	obj, err := db.ReleaseVested(v, start)
+	require.NoError(t, err)
+	assert.Nil(t, obj)
+	pending, err = db.PendingReleases("team")
+	require.NoError(t, err)
+	assert.Zero(t, pending)
+
+	released, err := db.GetReleased("team")
+	require.NoError(t, err)
+	assert.Equal(t, "1000", released.String())
+}
+
+func TestWdDB_InsertRecurring(t *testing.T) {
+	db := newTestDB(t)
+	r := &Recurring{
+		Name:     "rent",
+		Address:  "0x000000000000000000000000000000000000a001",
+		Amount:   big.NewInt(5),
+		Schedule: "0 9 * * 1",
+	}
+	schedule, err := r.Parse()
+	require.NoError(t, err)
+	assert.Equal(t, CatchUpAll, schedule.CatchUp)
+
+	monday := time.Date(2026, 1, 5, 9, 0, 0, 0, time.Local)
+	obj, err := db.InsertRecurring(r, schedule.Name, monday)
+	require.NoError(t, err)
+	assert.Equal(t, "5", obj.Amount.String())
+
+	_, err = db.InsertRecurring(r, schedule.Name, monday)
+	assert.True(t, errors.Is(err, ErrPeriodGenerated))
+
+	_, err = db.InsertRecurring(r, schedule.Name, monday.AddDate(0, 0, 7))
+	require.NoError(t, err)
+}
+
+func TestLoadPayoutSchedules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"recurring": [{"name": "rent", "address": "0x000000000000000000000000000000000000a001", "amount": 500000000000000000, "schedule": "0 9 * * 1"}],
+		"vesting": [{"name": "team", "address": "0x000000000000000000000000000000000000a002", "total": 1000,
+			"start": "2026-01-01T00:00:00Z", "cliff": "720h", "duration": "8760h", "period": "720h"}]
+	}`), 0644))
+
+	s, err := LoadPayoutSchedules(path)
+	require.NoError(t, err)
+	require.Len(t, s.Recurring, 1)
+	require.Len(t, s.Vesting, 1)
+	assert.Equal(t, 30*24*time.Hour, s.Vesting[0].Cliff.Duration)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"recurring": [
+		{"name": "rent", "address": "0x000000000000000000000000000000000000a001", "amount": 1, "schedule": "@daily"},
+		{"name": "rent", "address": "0x000000000000000000000000000000000000a001", "amount": 1, "schedule": "@daily"}
+	]}`), 0644))
+	_, err = LoadPayoutSchedules(path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,113 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ReservePolicy decides how much of the balance is kept back to pay network fees before
+// the rest is split among recipients.
+type ReservePolicy struct {
+	Kind    string   `json:"kind"`              // fixed, percent or estimate
+	Amount  *big.Int `json:"amount,omitempty"`  // fixed: wei kept
+	Percent float64  `json:"percent,omitempty"` // percent: of the balance kept
+	Safety  float64  `json:"safety,omitempty"`  // estimate: factor applied to the fees of the payouts
+}
+
+// DefaultReserve keeps one ether.
+var DefaultReserve = ReservePolicy{Kind: "fixed", Amount: Ether}
+
+// ParseReservePolicy reads a policy written as kind:value, for example fixed:1000000000000000000,
+// percent:2.5 or estimate:1.5.
+func ParseReservePolicy(s string) (ReservePolicy, error) {
+	kind, value := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, value = s[:i], s[i+1:]
+	}
+
+	p := ReservePolicy{Kind: kind}
+	switch kind {
+	case "fixed":
+		amount, ok := big.NewInt(0).SetString(value, 10)
+		if !ok {
+			return p, fmt.Errorf("invalid reserve amount: %q", value)
+		}
+		p.Amount = amount
+	case "percent", "estimate":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid reserve %s: %q", kind, value)
+		}
+		if kind == "percent" {
+			p.Percent = f
+		} else {
+			p.Safety = f
+		}
+	default:
+		return p, fmt.Errorf("unknown reserve policy: %s", s)
+	}
+	return p, p.validate()
+}
+
+func (p ReservePolicy) validate() error {
+	switch p.Kind {
+	case "fixed":
+		if p.Amount == nil || p.Amount.Sign() < 0 {
+			return fmt.Errorf("invalid reserve amount: %v", p.Amount)
+		}
+	case "percent":
+		if p.Percent < 0 || p.Percent > 100 {
+			return fmt.Errorf("reserve percent out of range: %v", p.Percent)
+		}
+	case "estimate":
+		if p.Safety < 1 {
+			return fmt.Errorf("reserve safety factor below 1: %v", p.Safety)
+		}
+	default:
+		return fmt.Errorf("unknown reserve policy: %s", p.Kind)
+	}
+	return nil
+}
+
+// Reserve returns the part of balance to keep for the fees of payouts taking gas in total,
+// see Worker.PayoutGas, estimates taking the gas price they would be signed with now
+// under policy.
+func (p ReservePolicy) Reserve(ctx context.Context, c ChainClient, policy TxPolicy, balance *big.Int, gas uint64) (*big.Int, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	switch p.Kind {
+	case "fixed":
+		return big.NewInt(0).Set(p.Amount), nil
+	case "percent":
+		return mulFloat(balance, p.Percent/100), nil
+	}
+
+	suggested, err := c.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	maxFee, err := policy.Fee.Apply(suggested)
+	if err != nil {
+		return nil, err
+	}
+	fees := big.NewInt(0).Mul(maxFee, big.NewInt(0).SetUint64(gas))
+	return mulFloat(fees, p.Safety), nil
+}
+
+// mulFloat returns x * f rounded up, so a reserve never falls short by a wei. f is taken
+// as the decimal it was written as, 2.5 percent of 10 ether being exactly 0.25 ether.
+func mulFloat(x *big.Int, f float64) *big.Int {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'f', -1, 64))
+	r.Mul(r, new(big.Rat).SetInt(x))
+
+	ans, rem := big.NewInt(0).QuoRem(r.Num(), r.Denom(), big.NewInt(0))
+	if rem.Sign() > 0 {
+		ans.Add(ans, big.NewInt(1))
+	}
+	return ans
+}
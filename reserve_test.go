@@ -0,0 +1,84 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReservePolicy(t *testing.T) {
+	p, err := ParseReservePolicy("fixed:1000")
+	require.NoError(t, err)
+	assert.Equal(t, "1000", p.Amount.String())
+
+	p, err = ParseReservePolicy("percent:2.5")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, p.Percent)
+
+	p, err = ParseReservePolicy("estimate:1.5")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, p.Safety)
+
+	for _, s := range []string{"", "fixed", "fixed:-1", "percent:101", "estimate:0.5", "half:1"} {
+		_, err := ParseReservePolicy(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestReservePolicy_Reserve(t *testing.T) {
+	sim, _, _ := newTestBackend(t)
+	client := NewSimulatedClient(sim)
+	ctx := context.Background()
+	balance := big.NewInt(0).Mul(big.NewInt(10), Ether)
+
+	reserve, err := DefaultReserve.Reserve(ctx, client, DefaultTxPolicy, balance, 3*params.TxGas)
+	require.NoError(t, err)
+	assert.Equal(t, Ether.String(), reserve.String())
+
+	reserve, err = ReservePolicy{Kind: "percent", Percent: 2.5}.Reserve(ctx, client, DefaultTxPolicy, balance, 3*params.TxGas)
+	require.NoError(t, err)
+	assert.Equal(t, "250000000000000000", reserve.String())
+
+	suggested, err := client.SuggestGasPrice(ctx)
+	require.NoError(t, err)
+	maxFee, err := DefaultFee.Apply(suggested)
+	require.NoError(t, err)
+
+	// three transfers, twice their fees
+	want := big.NewInt(0).Mul(maxFee, big.NewInt(int64(params.TxGas)*3*2))
+	reserve, err = ReservePolicy{Kind: "estimate", Safety: 2}.Reserve(ctx, client, DefaultTxPolicy, balance, 3*params.TxGas)
+	require.NoError(t, err)
+	assert.Equal(t, want.String(), reserve.String())
+}
+
+func TestWorker_PayoutGas(t *testing.T) {
+	w, _, _ := newTestWorker(t)
+	w.Policy.Gas = GasLimitPolicy{Multiplier: 1}
+
+	gas, err := w.PayoutGas("", 3)
+	require.NoError(t, err)
+	assert.Equal(t, 3*params.TxGas, gas)
+	gas, err = w.PayoutGas("0x000000000000000000000000000000000000b001", 3)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3*tokenTransferGas), gas)
+
+	// one disperse call per batch, a token approved first
+	contract := common.HexToAddress("0x000000000000000000000000000000000000b002")
+	w.Disperse, w.BatchSize = &contract, 2
+	gas, err = w.PayoutGas("", 3)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2*disperseCallGas+3*disperseEtherGas), gas)
+	gas, err = w.PayoutGas("0x000000000000000000000000000000000000b001", 3)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(approveGas+2*disperseCallGas+3*disperseTokenGas), gas)
+
+	// a batch above the ceiling could never be sent
+	w.Policy.Gas.Ceiling, w.BatchSize = 100000, 100
+	_, err = w.PayoutGas("0x000000000000000000000000000000000000b001", 3)
+	assert.Error(t, err)
+}
@@ -0,0 +1,225 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+var ErrPeriodGenerated = errors.New("period already generated")
+
+// CatchUp decides which periods missed while no worker was running are generated at startup.
+type CatchUp int
+
+const (
+	// CatchUpLatest generates the latest missed period only
+	CatchUpLatest CatchUp = iota
+	// CatchUpSkip generates none, waiting for the next period
+	CatchUpSkip
+	// CatchUpAll generates every missed period in order, for generations not splitting
+	// the live balance
+	CatchUpAll
+)
+
+func ParseCatchUp(s string) (CatchUp, error) {
+	switch s {
+	case "latest":
+		return CatchUpLatest, nil
+	case "skip":
+		return CatchUpSkip, nil
+	case "all":
+		return CatchUpAll, nil
+	}
+	return 0, fmt.Errorf("unknown catch-up rule: %s", s)
+}
+
+// Schedule generates batches on a cron schedule, at most one per period across restarts. A
+// period starts at a time of the schedule and ends at the next one.
+type Schedule struct {
+	Name    string // key of the state of the schedule in the db
+	CatchUp CatchUp
+	Retry   time.Duration // between attempts at a period whose generation failed, a minute if 0
+
+	spec cron.Schedule
+}
+
+// ParseSchedule parses a cron expression of five fields or a descriptor like @daily, read in
+// loc unless it starts with CRON_TZ=.
+func ParseSchedule(name, spec string, loc *time.Location, catchUp CatchUp) (*Schedule, error) {
+	if loc != nil && !strings.HasPrefix(spec, "CRON_TZ=") && !strings.HasPrefix(spec, "TZ=") {
+		spec = "CRON_TZ=" + loc.String() + " " + spec
+	}
+
+	parsed, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+	}
+	return &Schedule{Name: name, CatchUp: catchUp, spec: parsed}, nil
+}
+
+// Missed returns the periods started after last and by now, oldest first, that the catch-up
+// rule generates.
+func (s *Schedule) Missed(last, now time.Time) []time.Time {
+	var periods []time.Time
+	for t := s.spec.Next(last); !t.After(now); t = s.spec.Next(t) {
+		periods = append(periods, t)
+	}
+
+	switch {
+	case len(periods) == 0 || s.CatchUp == CatchUpSkip:
+		return nil
+	case s.CatchUp == CatchUpLatest:
+		return periods[len(periods)-1:]
+	}
+	return periods
+}
+
+// Run calls generate with the start of each period of the schedule until ctx is done. A new
+// schedule starts with the next period, a known one catches up on the periods missed since
+// the last generated in db. A failed generation is retried until the next period starts,
+// the period being recorded as missed in db if it never succeeded.
+func (s *Schedule) Run(ctx context.Context, db *WdDB, generate func(ctx context.Context, period time.Time) error) {
+	period, _, err := db.LastGeneration(s.Name)
+	if err != nil {
+		logger.Error("failed to read last generation", "schedule", s.Name, "err", err)
+		return
+	}
+
+	now := time.Now()
+	cursor := now
+	if period != 0 {
+		last := time.Unix(int64(period), 0)
+		for _, t := range s.Missed(last, now) {
+			logger.Info("catching up", "schedule", s.Name, "period", t)
+			s.runPeriod(ctx, db, t, generate)
+		}
+		// periods of a constant delay count from the last one
+		if s.spec.Next(last).After(now) {
+			cursor = last
+		}
+	}
+
+	for {
+		next := s.spec.Next(cursor)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.runPeriod(ctx, db, next, generate)
+		cursor = next
+	}
+}
+
+// runPeriod calls generate for period until it succeeds or claims an already generated
+// period, retrying every Retry until the next period starts.
+func (s *Schedule) runPeriod(ctx context.Context, db *WdDB, period time.Time, generate func(ctx context.Context, period time.Time) error) {
+	retry := s.Retry
+	if retry <= 0 {
+		retry = time.Minute
+	}
+	end := s.spec.Next(period)
+
+	for {
+		err := generate(ctx, period)
+		if err == nil || errors.Is(err, ErrPeriodGenerated) {
+			return
+		}
+		logger.Error("failed to generate period", "schedule", s.Name, "period", period, "err", err)
+
+		if time.Now().Add(retry).After(end) {
+			break
+		}
+		timer := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			// left to the catch-up of the next start
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+
+	logger.Error("period missed", "schedule", s.Name, "period", period)
+	if err := db.RecordMissed(s.Name, period); err != nil {
+		logger.Error("failed to record missed period", "schedule", s.Name, "period", period, "err", err)
+	}
+}
+
+// RecordMissed records that schedule never generated a batch for the period starting at
+// period.
+func (w *WdDB) RecordMissed(schedule string, period time.Time) error {
+	key := append(w.prefixed([]byte("kv-genmissed-"+schedule+"/")), ToBigEndianBytes(uint64(period.Unix()))...)
+	return w.db.Put(key, ToBigEndianBytes(uint64(time.Now().Unix())), nil)
+}
+
+// MissedPeriods returns the periods recorded by RecordMissed for schedule, oldest first.
+func (w *WdDB) MissedPeriods(schedule string) ([]time.Time, error) {
+	prefix := w.prefixed([]byte("kv-genmissed-" + schedule + "/"))
+	itr := w.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer itr.Release()
+
+	var ans []time.Time
+	for itr.Next() {
+		period, err := FromBigEndianBytes(itr.Key()[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		ans = append(ans, time.Unix(int64(period), 0))
+	}
+	return ans, itr.Error()
+}
+
+func (w *WdDB) generationKeys(schedule string) (period, at []byte) {
+	return w.prefixed([]byte("kv-genperiod-" + schedule)), w.prefixed([]byte("kv-gentime-" + schedule))
+}
+
+// LastGeneration returns the start of the last period schedule generated a batch for and the
+// time it did, zero if it never did.
+func (w *WdDB) LastGeneration(schedule string) (period, at uint64, err error) {
+	periodKey, atKey := w.generationKeys(schedule)
+
+	v, err := w.getOptional(periodKey)
+	if err != nil || v == nil {
+		return 0, 0, err
+	}
+	period, _ = FromBigEndianBytes(v)
+
+	if v, err = w.getOptional(atKey); err != nil {
+		return 0, 0, err
+	} else if v != nil {
+		at, _ = FromBigEndianBytes(v)
+	}
+	return period, at, nil
+}
+
+// claimPeriod records within tx that b is the batch of its period, failing with
+// ErrPeriodGenerated if its schedule already generated this period or a later one.
+func (w *WdDB) claimPeriod(tx *leveldb.Transaction, b *PayoutBatch) error {
+	periodKey, atKey := w.generationKeys(b.Schedule)
+
+	v, err := tx.Get(periodKey, nil)
+	if err == nil {
+		if last, _ := FromBigEndianBytes(v); b.Period <= last {
+			return fmt.Errorf("%w, schedule: %s period: %v", ErrPeriodGenerated, b.Schedule, b.Period)
+		}
+	} else if !errors.Is(err, leveldb.ErrNotFound) {
+		return err
+	}
+
+	if err := tx.Put(periodKey, ToBigEndianBytes(b.Period), nil); err != nil {
+		return err
+	}
+	return tx.Put(atKey, ToBigEndianBytes(b.Created), nil)
+}
@@ -0,0 +1,120 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+func TestSchedule_Missed(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	require.NoError(t, err)
+
+	s, err := ParseSchedule("test", "0 8 * * *", loc, CatchUpAll)
+	require.NoError(t, err)
+
+	last := time.Date(2026, 1, 1, 8, 0, 0, 0, loc)
+	now := time.Date(2026, 1, 4, 9, 0, 0, 0, loc)
+	assert.Equal(t, []time.Time{
+		time.Date(2026, 1, 2, 8, 0, 0, 0, loc),
+		time.Date(2026, 1, 3, 8, 0, 0, 0, loc),
+		time.Date(2026, 1, 4, 8, 0, 0, 0, loc),
+	}, s.Missed(last, now))
+
+	s.CatchUp = CatchUpLatest
+	assert.Equal(t, []time.Time{time.Date(2026, 1, 4, 8, 0, 0, 0, loc)}, s.Missed(last, now))
+
+	s.CatchUp = CatchUpSkip
+	assert.Empty(t, s.Missed(last, now))
+
+	// the time zone is the schedule's, not the one of the times compared
+	s.CatchUp = CatchUpLatest
+	assert.Empty(t, s.Missed(last, time.Date(2026, 1, 2, 7, 59, 0, 0, loc).UTC()))
+
+	_, err = ParseSchedule("test", "every day", nil, CatchUpAll)
+	assert.Error(t, err)
+	_, err = ParseCatchUp("never")
+	assert.Error(t, err)
+}
+
+func TestWdDB_ClaimPeriod(t *testing.T) {
+	db := newTestDB(t)
+
+	insert := func(period uint64) error {
+		b := &PayoutBatch{Total: big.NewInt(1), Leftover: big.NewInt(1), Schedule: "daily", Period: period, Created: period + 5}
+		return db.InsertBatch(b, nil)
+	}
+
+	period, at, err := db.LastGeneration("daily")
+	require.NoError(t, err)
+	assert.Zero(t, period)
+	assert.Zero(t, at)
+
+	require.NoError(t, insert(100))
+	assert.True(t, errors.Is(insert(100), ErrPeriodGenerated))
+	assert.True(t, errors.Is(insert(50), ErrPeriodGenerated))
+	require.NoError(t, insert(200))
+
+	period, at, err = db.LastGeneration("daily")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(200), period)
+	assert.Equal(t, uint64(205), at)
+
+	// the refused batches took no id
+	b, err := db.GetBatch(2)
+	require.NoError(t, err)
+	assert.Equal(t, "daily", b.Schedule)
+	assert.Equal(t, uint64(200), b.Period)
+
+	// other schedules and batches by hand are not limited
+	require.NoError(t, db.InsertBatch(&PayoutBatch{Total: big.NewInt(0), Leftover: big.NewInt(0)}, nil))
+	require.NoError(t, db.InsertBatch(&PayoutBatch{Total: big.NewInt(0), Leftover: big.NewInt(0), Schedule: "weekly", Period: 100}, nil))
+}
+
+func TestSchedule_RunPeriod(t *testing.T) {
+	logger.Init(logger.DebugLevel)
+	db := newTestDB(t)
+	s, err := ParseSchedule("test", "@daily", time.UTC, CatchUpLatest)
+	require.NoError(t, err)
+	s.Retry = time.Millisecond
+
+	// a failed generation is retried within its period
+	calls := 0
+	period := time.Now().UTC().Truncate(24 * time.Hour)
+	s.runPeriod(context.Background(), db, period, func(context.Context, time.Time) error {
+		if calls++; calls < 3 {
+			return errors.New("node unavailable")
+		}
+		return nil
+	})
+	assert.Equal(t, 3, calls)
+
+	// a period claimed meanwhile is done
+	calls = 0
+	s.runPeriod(context.Background(), db, period, func(context.Context, time.Time) error {
+		calls++
+		return ErrPeriodGenerated
+	})
+	assert.Equal(t, 1, calls)
+
+	missed, err := db.MissedPeriods("test")
+	require.NoError(t, err)
+	assert.Empty(t, missed)
+
+	// one still failing when the next period starts is recorded as missed
+	old := period.Add(-48 * time.Hour)
+	s.runPeriod(context.Background(), db, old, func(context.Context, time.Time) error {
+		return errors.New("node unavailable")
+	})
+	missed, err = db.MissedPeriods("test")
+	require.NoError(t, err)
+	require.Len(t, missed, 1)
+	assert.True(t, old.Equal(missed[0]))
+}
@@ -0,0 +1,77 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const erc20ABI = `[
+	{"inputs":[{"name":"owner","type":"address"}],"name":"balanceOf","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+	{"inputs":[{"name":"owner","type":"address"},{"name":"spender","type":"address"}],"name":"allowance","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+	{"inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"name":"transfer","outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable","type":"function"},
+	{"inputs":[{"name":"spender","type":"address"},{"name":"value","type":"uint256"}],"name":"approve","outputs":[{"name":"","type":"bool"}],"stateMutability":"nonpayable","type":"function"}
+]`
+
+var erc20 = mustParseABI(erc20ABI)
+
+func mustParseABI(raw string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(raw))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func TokenBalance(ctx context.Context, c ChainClient, token, owner common.Address) (*big.Int, error) {
+	return callUint256(ctx, c, token, "balanceOf", owner)
+}
+
+func TokenAllowance(ctx context.Context, c ChainClient, token, owner, spender common.Address) (*big.Int, error) {
+	return callUint256(ctx, c, token, "allowance", owner, spender)
+}
+
+func callUint256(ctx context.Context, c ChainClient, token common.Address, method string, args ...interface{}) (*big.Int, error) {
+	data, err := erc20.Pack(method, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := c.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := erc20.Unpack(method, out)
+	if err != nil {
+		return nil, err
+	}
+	return abi.ConvertType(res[0], new(big.Int)).(*big.Int), nil
+}
+
+// checkTokenResult fails a transfer or approve call whose simulation returned false,
+// which is how some tokens report failure instead of reverting.
+func checkTokenResult(data []byte, out []byte) error {
+	if len(data) < 4 {
+		return nil
+	}
+
+	method, err := erc20.MethodById(data[:4])
+	if err != nil || (method.Name != "transfer" && method.Name != "approve") {
+		return nil
+	}
+
+	// tokens predating the standard return nothing
+	res, err := method.Outputs.Unpack(out)
+	if err != nil || len(res) != 1 {
+		return nil
+	}
+	if ok, _ := res[0].(bool); !ok {
+		return &RevertError{Reason: method.Name + " returned false"}
+	}
+	return nil
+}
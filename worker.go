@@ -0,0 +1,975 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/haihongs/eth-multi-transactions/common/logger"
+)
+
+// Worker broadcasts pending withdrawals with consecutive nonces and tracks every
+// in-flight transaction until it is confirmed.
+type Worker struct {
+	db       *WdDB
+	ethc     ChainClient
+	fromAddr common.Address
+	prvKey   *ecdsa.PrivateKey
+	chainID  *big.Int
+
+	MaxInFlight   int           // max withdrawals broadcast but not yet confirmed
+	Confirmations uint64        // blocks, the including one counted, before a payout is final
+	RecheckDepth  uint64        // blocks within which final payouts are rechecked for reorgs
+	Timeout       time.Duration // warn about transactions unconfirmed for longer
+
+	// gas limit and gas price of the transactions it signs
+	Policy TxPolicy
+
+	// what to do when the pending queue exceeds the balance of the sender
+	BalancePolicy BalancePolicy
+
+	// pay withdrawals in batches through a disperse contract when set
+	Disperse  *common.Address
+	BatchSize int // max withdrawals per disperse call
+
+	// hold the lease as Owner while processing withdrawals when LeaseTTL is set, in
+	// LeaseStore or the db if nil
+	Owner      string
+	LeaseTTL   time.Duration
+	LeaseStore LeaseStore
+
+	mu        sync.Mutex // serializes dispatching and tracking
+	tracked   map[uint64]time.Time
+	approvals map[string]common.Hash // token => pending approve transaction
+
+	blocksIndexed bool // withdrawals recorded in a block before the index existed are indexed
+}
+
+func NewWorker(
+	db *WdDB,
+	ethc ChainClient,
+	fromAddr common.Address,
+	prvKey *ecdsa.PrivateKey,
+	chainID *big.Int,
+	maxInFlight int,
+) *Worker {
+	return &Worker{
+		db:            db,
+		ethc:          ethc,
+		fromAddr:      fromAddr,
+		prvKey:        prvKey,
+		chainID:       chainID,
+		MaxInFlight:   maxInFlight,
+		Confirmations: 3,
+		RecheckDepth:  64,
+		Timeout:       60 * time.Minute,
+		BatchSize:     100,
+		Policy:        DefaultTxPolicy,
+		tracked:       make(map[uint64]time.Time),
+		approvals:     make(map[string]common.Hash),
+	}
+}
+
+// Dispatch broadcasts pending withdrawals until MaxInFlight transactions are in flight.
+// It stops at the first failure so that no nonce is skipped.
+func (w *Worker) Dispatch(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.renewLease(); err != nil {
+		return err
+	}
+
+	// withdrawals not due yet wait, those past their expiry are never paid
+	ids, expired, err := w.db.GetDueRecordsId(time.Now())
+	if err != nil {
+		return err
+	}
+	if err := w.expire(expired); err != nil {
+		return err
+	}
+
+	inFlight, err := w.db.GetRecordsIdByStatus(StatusProcessing)
+	if err != nil {
+		return err
+	}
+
+	slots := w.MaxInFlight - len(inFlight)
+	if slots <= 0 {
+		logger.Info("too many withdrawals in flight", "inflight", len(inFlight))
+		return nil
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := w.checkChain(ctx); err != nil {
+		return err
+	}
+
+	if ids, err = w.checkBalance(ctx, ids); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if len(ids) > slots {
+		ids = ids[:slots]
+	}
+
+	nonce, err := w.ethc.PendingNonceAt(ctx, w.fromAddr)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("start dispatching", "chain", w.db.Chain(), "count", len(ids), "nonce", nonce)
+	if w.Disperse != nil {
+		return w.dispatchBatches(ctx, ids, nonce)
+	}
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := w.send(ctx, id, nonce); isRevert(err) {
+			// nothing was broadcast, the nonce is still free
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to send withdrawal %v: %w", id, err)
+		}
+		nonce++
+	}
+	logger.Info("finish dispatching")
+	return nil
+}
+
+// expire moves withdrawals that missed their window from StatusInit to StatusExpired.
+func (w *Worker) expire(ids []uint64) error {
+	for _, id := range ids {
+		if err := w.db.CompareAndSwapStatus(w.db.StatusKey(id), StatusInit, StatusExpired); err != nil {
+			return err
+		}
+		if err := w.db.SetReason(id, "expired before being paid"); err != nil {
+			return err
+		}
+		logger.Warn("withdrawal expired", "chain", w.db.Chain(), "id", id)
+	}
+	return nil
+}
+
+func (w *Worker) send(ctx context.Context, id uint64, nonce uint64) error {
+	// a long dispatch may outlive the lease taken at its start
+	if err := w.renewLease(); err != nil {
+		return err
+	}
+
+	key := w.db.StatusKey(id)
+	if err := w.db.CompareAndSwapStatus(key, StatusInit, StatusProcessing); err != nil {
+		return err
+	}
+
+	// hand the withdrawal back to the queue if it never reached the node
+	revert := func() {
+		if err := w.db.UpdateTransaction(id, 0, "", nil); err != nil {
+			logger.Error("failed to reset transaction", "err", err, "id", id)
+		}
+		if err := w.db.CompareAndSwapStatus(key, StatusProcessing, StatusInit); err != nil {
+			logger.Error("failed to CAS status", "err", err, "id", id)
+		}
+	}
+
+	obj, err := w.db.GetWdObjById(id)
+	if err != nil {
+		revert()
+		return err
+	}
+
+	tx, err := SignEthTransaction(ctx, obj, w.ethc, nonce, w.fromAddr, w.prvKey, w.chainID, w.Policy)
+	if isRevert(err) {
+		w.failPrecheck(id, err)
+		return err
+	}
+	if err != nil {
+		revert()
+		return err
+	}
+
+	// persist before broadcasting so a crash never loses track of a sent transaction
+	txId := tx.Hash().Hex()
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		revert()
+		return err
+	}
+	if err := w.db.UpdateTransaction(id, nonce, txId, raw); err != nil {
+		revert()
+		return err
+	}
+
+	if err := w.broadcast(tx); err != nil {
+		if rejected(ctx, w.ethc, tx, err) {
+			revert()
+			return err
+		}
+		// the node may hold it anyway, the tracker confirms or rebroadcasts it
+		logger.Warn("broadcast outcome unknown, tracking the transaction", "id", id, "nonce", nonce, "txid", txId, "err", err)
+		return err
+	}
+	logger.Info("broadcast succeed", "id", id, "nonce", nonce, "txid", txId)
+	return nil
+}
+
+func (w *Worker) dispatchBatches(ctx context.Context, ids []uint64, nonce uint64) error {
+	// group by token, keeping queue order within each group
+	var tokens []string
+	groups := make(map[string][]*DbWithdrawalObj)
+	for _, id := range ids {
+		obj, err := w.db.GetWdObjById(id)
+		if err != nil {
+			return err
+		}
+		if _, ok := groups[obj.Token]; !ok {
+			tokens = append(tokens, obj.Token)
+		}
+		groups[obj.Token] = append(groups[obj.Token], obj)
+	}
+
+	for _, token := range tokens {
+		// token batches are paid while the allowance of the disperse contract covers them
+		var allowance *big.Int
+		if token != "" {
+			var err error
+			if allowance, err = w.allowance(ctx, token); err != nil {
+				return err
+			}
+		}
+
+		objs := groups[token]
+		for len(objs) > 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n := len(objs)
+			if w.BatchSize > 0 && n > w.BatchSize {
+				n = w.BatchSize
+			}
+			if allowance != nil && allowance.Cmp(sumAmounts(objs[:n])) < 0 {
+				break
+			}
+			used, sent, err := w.sendSplit(ctx, objs[:n], nonce)
+			objs = objs[n:]
+			nonce += used
+			if err != nil {
+				return fmt.Errorf("failed to send batch of %v: %w", n, err)
+			}
+			// withdrawals that failed precheck spend nothing of the allowance
+			if allowance != nil {
+				allowance.Sub(allowance, sumAmounts(sent))
+			}
+		}
+
+		// approve what is left, paid once the approval is mined
+		if len(objs) > 0 && allowance != nil {
+			if _, ok := w.approvals[token]; ok {
+				continue
+			}
+			if err := w.approve(ctx, token, sumAmounts(objs), nonce); err != nil {
+				return err
+			}
+			nonce++
+		}
+	}
+	logger.Info("finish dispatching")
+	return nil
+}
+
+func sumAmounts(objs []*DbWithdrawalObj) *big.Int {
+	total := big.NewInt(0)
+	for _, o := range objs {
+		total.Add(total, o.Amount)
+	}
+	return total
+}
+
+// allowance returns what the disperse contract may spend of token, zero while an approval
+// of the worker is pending.
+func (w *Worker) allowance(ctx context.Context, token string) (*big.Int, error) {
+	if hash, ok := w.approvals[token]; ok {
+		if _, err := w.ethc.TransactionReceipt(ctx, hash); errors.Is(err, ethereum.NotFound) {
+			logger.Info("waiting for approval", "token", token, "txid", hash.Hex())
+			return big.NewInt(0), nil
+		} else if err != nil {
+			return nil, err
+		}
+		delete(w.approvals, token)
+	}
+	return TokenAllowance(ctx, w.ethc, common.HexToAddress(token), w.fromAddr, *w.Disperse)
+}
+
+// approve broadcasts an approval of amount of token for the disperse contract at nonce,
+// replacing its allowance once mined.
+func (w *Worker) approve(ctx context.Context, token string, amount *big.Int, nonce uint64) error {
+	if err := w.renewLease(); err != nil {
+		return err
+	}
+
+	tx, err := SignApproveTransaction(ctx, w.ethc, common.HexToAddress(token), *w.Disperse, amount, nonce, w.fromAddr, w.prvKey, w.chainID, w.Policy)
+	if err != nil {
+		return err
+	}
+	if err := w.broadcast(tx); err != nil && rejected(ctx, w.ethc, tx, err) {
+		return err
+	} else if err != nil {
+		logger.Warn("broadcast outcome unknown, waiting for the approval", "token", token, "txid", tx.Hash().Hex(), "err", err)
+	}
+	w.approvals[token] = tx.Hash()
+	if _, err := w.db.PutOverhead(OverheadApprove, token, tx.Hash().Hex()); err != nil {
+		logger.Error("failed to record approval", "err", err, "token", token, "txid", tx.Hash().Hex())
+	}
+	logger.Info("approval broadcast", "token", token, "amount", amount, "txid", tx.Hash().Hex())
+	return nil
+}
+
+// sendSplit pays objs with one disperse call, halving a batch whose simulation reverts
+// until only the reverting withdrawals are left to fail precheck. It returns the number
+// of nonces used and the withdrawals broadcast.
+func (w *Worker) sendSplit(ctx context.Context, objs []*DbWithdrawalObj, nonce uint64) (uint64, []*DbWithdrawalObj, error) {
+	err := w.sendBatch(ctx, objs, nonce)
+	if err == nil {
+		return 1, objs, nil
+	}
+	if !isRevert(err) {
+		return 0, nil, err
+	}
+	if len(objs) == 1 {
+		return 0, nil, nil
+	}
+
+	half := len(objs) / 2
+	logger.Warn("batch reverted, splitting it", "count", len(objs), "err", err)
+	used, sent, err := w.sendSplit(ctx, objs[:half], nonce)
+	if err != nil {
+		return used, sent, err
+	}
+	more, rest, err := w.sendSplit(ctx, objs[half:], nonce+used)
+	return used + more, append(sent, rest...), err
+}
+
+// sendBatch pays objs with one disperse call, all of them share its nonce and hash. A
+// batch that reverts in simulation is handed back to the queue, a lone withdrawal fails
+// precheck.
+func (w *Worker) sendBatch(ctx context.Context, objs []*DbWithdrawalObj, nonce uint64) error {
+	if err := w.renewLease(); err != nil {
+		return err
+	}
+
+	var claimed []*DbWithdrawalObj
+	revert := func() {
+		for _, o := range claimed {
+			key := w.db.StatusKey(o.Id)
+			if err := w.db.UpdateTransaction(o.Id, 0, "", nil); err != nil {
+				logger.Error("failed to reset transaction", "err", err, "id", o.Id)
+			}
+			if err := w.db.CompareAndSwapStatus(key, StatusProcessing, StatusInit); err != nil {
+				logger.Error("failed to CAS status", "err", err, "id", o.Id)
+			}
+		}
+	}
+
+	for _, o := range objs {
+		key := w.db.StatusKey(o.Id)
+		if err := w.db.CompareAndSwapStatus(key, StatusInit, StatusProcessing); err != nil {
+			revert()
+			return err
+		}
+		claimed = append(claimed, o)
+	}
+
+	tx, err := SignDisperseTransaction(ctx, objs, w.ethc, *w.Disperse, nonce, w.fromAddr, w.prvKey, w.chainID, w.Policy)
+	if isRevert(err) {
+		if len(objs) > 1 {
+			revert()
+		} else {
+			w.failPrecheck(objs[0].Id, err)
+		}
+		return err
+	}
+	if err != nil {
+		revert()
+		return err
+	}
+
+	txId := tx.Hash().Hex()
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		revert()
+		return err
+	}
+	ids := make([]uint64, 0, len(objs))
+	for _, o := range objs {
+		if err := w.db.UpdateTransaction(o.Id, nonce, txId, raw); err != nil {
+			revert()
+			return err
+		}
+		ids = append(ids, o.Id)
+	}
+	if err := w.db.SetPaidTogether(txId, ids); err != nil {
+		revert()
+		return err
+	}
+
+	if err := w.broadcast(tx); err != nil {
+		if rejected(ctx, w.ethc, tx, err) {
+			revert()
+			return err
+		}
+		// the node may hold it anyway, the tracker confirms or rebroadcasts it
+		logger.Warn("broadcast outcome unknown, tracking the batch", "count", len(objs), "nonce", nonce, "txid", txId, "err", err)
+		return err
+	}
+	logger.Info("batch broadcast succeed", "count", len(objs), "nonce", nonce, "txid", txId)
+	return nil
+}
+
+// failPrecheck parks a claimed withdrawal whose simulation reverted, with the reason.
+func (w *Worker) failPrecheck(id uint64, cause error) {
+	logger.Error("withdrawal failed precheck", "err", cause, "id", id)
+
+	reason := cause.Error()
+	var revertErr *RevertError
+	if errors.As(cause, &revertErr) && revertErr.Reason != "" {
+		reason = revertErr.Reason
+	}
+	if err := w.db.SetReason(id, reason); err != nil {
+		logger.Error("failed to save reason", "err", err, "id", id)
+	}
+
+	key := w.db.StatusKey(id)
+	if err := w.db.CompareAndSwapStatus(key, StatusProcessing, StatusFailedPrecheck); err != nil {
+		logger.Error("failed to CAS status", "err", err, "id", id)
+	}
+}
+
+func isRevert(err error) bool {
+	var revertErr *RevertError
+	return errors.As(err, &revertErr)
+}
+
+// broadcast sends tx regardless of cancellation: a broadcast abandoned half way would leave
+// no way to tell whether the node got the transaction. Call deadlines still bound it.
+func (w *Worker) broadcast(tx *types.Transaction) error {
+	return broadcast(context.Background(), w.ethc, tx)
+}
+
+// broadcast sends tx to the node, one already holding it counting as a success.
+func broadcast(ctx context.Context, ethc ChainClient, tx *types.Transaction) error {
+	if err := ethc.SendTransaction(ctx, tx); err != nil && !isKnownTransaction(err) {
+		return err
+	}
+	return nil
+}
+
+func isKnownTransaction(err error) bool {
+	return strings.Contains(err.Error(), "already known")
+}
+
+// rejections are errors of a node refusing a transaction outright, as opposed to timeouts
+// and transport errors after which it may hold the transaction all the same
+var rejections = []string{
+	"nonce too low",
+	"nonce too high",
+	"underpriced",
+	"insufficient funds",
+	"intrinsic gas too low",
+	"exceeds block gas limit",
+	"fee cap less than block base fee",
+	"exceeds the configured cap",
+	"invalid sender",
+	"oversized data",
+}
+
+func isRejection(err error) bool {
+	for _, r := range rejections {
+		if strings.Contains(err.Error(), r) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejected reports whether the node surely does not hold tx after broadcasting it failed
+// with err, so that its withdrawals can go back to the queue without being paid twice.
+func rejected(ctx context.Context, ethc ChainClient, tx *types.Transaction, err error) bool {
+	if !isRejection(err) {
+		return false
+	}
+	// a nonce too low may be tx itself, accepted by an earlier attempt and mined since
+	_, _, err = ethc.TransactionByHash(ctx, tx.Hash())
+	return errors.Is(err, ethereum.NotFound)
+}
+
+// Track runs the confirmation tracker every interval until ctx is done.
+func (w *Worker) Track(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.TrackOnce(ctx); err != nil {
+				logger.Error("failed to track transactions", "err", err)
+			}
+		}
+	}
+}
+
+// TrackOnce checks every in-flight and cancelling withdrawal once, and rechecks those
+// recently made final.
+func (w *Worker) TrackOnce(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.renewLease(); err != nil {
+		return err
+	}
+
+	header, err := w.ethc.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	head := header.Number.Uint64()
+
+	if err := w.recheck(ctx, head); err != nil {
+		return err
+	}
+
+	cancelling, err := w.db.GetRecordsIdByStatus(StatusCancelling)
+	if err != nil {
+		return err
+	}
+
+	watching := make(map[uint64]bool, len(cancelling))
+	for _, id := range cancelling {
+		status, err := ResolveCancellation(ctx, w.db, w.ethc, id)
+		if err != nil {
+			logger.Error("failed to resolve cancellation", "err", err, "id", id)
+			continue
+		}
+		switch status {
+		case StatusCancelled:
+			logger.Info("withdrawal cancelled", "id", id)
+		case StatusCancelling:
+			watching[id] = true
+			if err := w.checkCancellation(ctx, id); err != nil {
+				logger.Error("failed to follow cancellation", "err", err, "id", id)
+			}
+		}
+	}
+
+	inFlight, err := w.db.GetRecordsIdByStatus(StatusProcessing)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range inFlight {
+		watching[id] = true
+		obj, err := w.db.GetWdObjById(id)
+		if err != nil {
+			logger.Error("failed to read withdrawal", "err", err, "id", id)
+			continue
+		}
+		if err := w.check(ctx, obj, head); err != nil {
+			logger.Error("failed to confirm eth transaction", "err", err, "id", id)
+		}
+	}
+
+	if err := w.settleOverheads(ctx); err != nil {
+		logger.Error("failed to record overhead fees", "err", err)
+	}
+
+	// forget withdrawals that are no longer in flight or being cancelled
+	for id := range w.tracked {
+		if !watching[id] {
+			delete(w.tracked, id)
+		}
+	}
+	return nil
+}
+
+// check follows the transaction of obj until it is Confirmations blocks deep.
+func (w *Worker) check(ctx context.Context, obj *DbWithdrawalObj, head uint64) error {
+	id := obj.Id
+	if obj.Hash == "" {
+		return fmt.Errorf("in-flight withdrawal without transaction")
+	}
+
+	since, ok := w.tracked[id]
+	if !ok {
+		since = time.Now()
+		w.tracked[id] = since
+	}
+
+	receipt, err := w.ethc.TransactionReceipt(ctx, common.HexToHash(obj.Hash))
+	if errors.Is(err, ethereum.NotFound) {
+		return w.checkPending(ctx, obj, since)
+	}
+	if err != nil {
+		return err
+	}
+
+	if hash := receipt.BlockHash.Hex(); hash != obj.BlockHash {
+		if obj.BlockHash != "" {
+			logger.Warn("transaction moved to another block", "id", id, "txid", obj.Hash, "from", obj.BlockHash, "to", hash)
+		}
+		if err := w.db.SetBlock(id, receipt.BlockNumber.Uint64(), hash); err != nil {
+			return err
+		}
+	}
+
+	if confirmations(head, receipt.BlockNumber.Uint64()) < w.Confirmations {
+		return nil
+	}
+
+	gasPrice, err := effectiveGasPrice(ctx, w.ethc, obj.Hash, receipt)
+	if err != nil {
+		return err
+	}
+	// a disperse call is shared by every withdrawal it pays, whatever their status now
+	batch, err := w.db.PaidTogether(obj.Hash)
+	if err != nil {
+		return err
+	}
+	if len(batch) == 0 {
+		batch = []uint64{id}
+	}
+	fee := feeShare(big.NewInt(0).Mul(gasPrice, big.NewInt(0).SetUint64(receipt.GasUsed)), batch, id)
+	if err := w.db.SetFee(id, receipt.GasUsed, gasPrice, fee); err != nil {
+		return err
+	}
+
+	key := w.db.StatusKey(id)
+	delete(w.tracked, id)
+	if receipt.Status == types.ReceiptStatusFailed {
+		logger.Error("transaction reverted", "id", id, "txid", obj.Hash)
+		if err := w.db.SetReason(id, "reverted on chain"); err != nil {
+			logger.Error("failed to save reason", "err", err, "id", id)
+		}
+		return w.db.CompareAndSwapStatus(key, StatusProcessing, StatusFailed)
+	}
+
+	if err := w.db.CompareAndSwapStatus(key, StatusProcessing, StatusConfirmed); err != nil {
+		return err
+	}
+	logger.Info("withdrawal confirmed", "id", id, "txid", obj.Hash, "block", receipt.BlockNumber, "fee", fee)
+	return nil
+}
+
+// effectiveGasPrice returns the price per gas paid by the transaction of receipt, which
+// for a dynamic fee transaction depends on the base fee of its block.
+func effectiveGasPrice(ctx context.Context, ethc ChainClient, txid string, receipt *types.Receipt) (*big.Int, error) {
+	tx, _, err := ethc.TransactionByHash(ctx, common.HexToHash(txid))
+	if err != nil {
+		return nil, err
+	}
+	if tx.Type() != types.DynamicFeeTxType {
+		return tx.GasPrice(), nil
+	}
+
+	header, err := ethc.HeaderByNumber(ctx, receipt.BlockNumber)
+	if err != nil {
+		return nil, err
+	}
+	price := big.NewInt(0).Add(header.BaseFee, tx.GasTipCap())
+	if price.Cmp(tx.GasFeeCap()) > 0 {
+		price.Set(tx.GasFeeCap())
+	}
+	return price, nil
+}
+
+// feeShare splits the fee of a transaction evenly among the withdrawals of batch, the
+// first one bearing the remainder so that the shares add up to the fee.
+func feeShare(fee *big.Int, batch []uint64, id uint64) *big.Int {
+	if len(batch) <= 1 {
+		return fee
+	}
+
+	share, rem := big.NewInt(0).DivMod(fee, big.NewInt(int64(len(batch))), big.NewInt(0))
+	if batch[0] == id {
+		share.Add(share, rem)
+	}
+	return share
+}
+
+// settleOverheads records the fee of the overhead transactions mined since they were
+// broadcast, and a zero fee for those never mined within Timeout.
+func (w *Worker) settleOverheads(ctx context.Context) error {
+	overheads, err := w.db.Overheads()
+	if err != nil {
+		return err
+	}
+
+	for _, o := range overheads {
+		if o.Fee != nil {
+			continue
+		}
+
+		receipt, err := minedReceipt(ctx, w.ethc, o.Hash)
+		if err != nil {
+			return err
+		}
+		if receipt == nil {
+			if time.Since(time.Unix(int64(o.Time), 0)) > w.Timeout {
+				logger.Warn("overhead transaction never mined", "kind", o.Kind, "token", o.Token, "txid", o.Hash)
+				if err := w.db.SetOverheadFee(o.Id, 0, big.NewInt(0), big.NewInt(0)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		gasPrice, err := effectiveGasPrice(ctx, w.ethc, o.Hash, receipt)
+		if err != nil {
+			return err
+		}
+		fee := big.NewInt(0).Mul(gasPrice, big.NewInt(0).SetUint64(receipt.GasUsed))
+		if err := w.db.SetOverheadFee(o.Id, receipt.GasUsed, gasPrice, fee); err != nil {
+			return err
+		}
+		logger.Info("overhead transaction mined", "kind", o.Kind, "token", o.Token, "txid", o.Hash, "fee", fee)
+	}
+	return nil
+}
+
+// checkPending follows a transaction without receipt, still pending or un-mined by a reorg.
+func (w *Worker) checkPending(ctx context.Context, obj *DbWithdrawalObj, since time.Time) error {
+	if obj.BlockHash != "" {
+		logger.Warn("transaction left its block", "id", obj.Id, "txid", obj.Hash, "block", obj.BlockHash)
+		if err := w.db.SetBlock(obj.Id, 0, ""); err != nil {
+			return err
+		}
+	}
+
+	_, _, err := w.ethc.TransactionByHash(ctx, common.HexToHash(obj.Hash))
+	if errors.Is(err, ethereum.NotFound) {
+		return w.rebroadcast(ctx, obj, since)
+	}
+	if err != nil {
+		return err
+	}
+
+	if time.Since(since) > w.Timeout {
+		logger.Warn("transaction still pending", "id", obj.Id, "txid", obj.Hash, "since", since)
+	}
+	return nil
+}
+
+// rebroadcast sends the stored transaction of obj again after the node dropped it, so that
+// its nonce does not stall every later payout. A nonce taken by another transaction for
+// longer than Timeout fails the withdrawal, its transaction never being mined.
+func (w *Worker) rebroadcast(ctx context.Context, obj *DbWithdrawalObj, since time.Time) error {
+	raw, err := w.db.GetRawTransaction(obj.Id)
+	if err != nil {
+		return err
+	}
+	return w.resend(obj.Id, obj.Hash, raw, StatusProcessing, since)
+}
+
+// checkCancellation sends the cancellation of withdrawal id again once the node dropped
+// it, for as long as neither it nor the original transaction is mined.
+func (w *Worker) checkCancellation(ctx context.Context, id uint64) error {
+	obj, err := w.db.GetWdObjById(id)
+	if err != nil {
+		return err
+	}
+
+	since, ok := w.tracked[id]
+	if !ok {
+		since = time.Now()
+		w.tracked[id] = since
+	}
+
+	_, _, err = w.ethc.TransactionByHash(ctx, common.HexToHash(obj.CancelHash))
+	if !errors.Is(err, ethereum.NotFound) {
+		return err
+	}
+	raw, err := w.db.GetCancelTransaction(id)
+	if err != nil {
+		return err
+	}
+	return w.resend(id, obj.CancelHash, raw, StatusCancelling, since)
+}
+
+// resend broadcasts raw, the dropped transaction txid of withdrawal id, again. Its nonce
+// taken by another transaction for longer than Timeout fails the withdrawal from status.
+func (w *Worker) resend(id uint64, txid string, raw []byte, status uint64, since time.Time) error {
+	if raw == nil {
+		// broadcast by an older version
+		logger.Warn("transaction not found", "id", id, "txid", txid)
+		return nil
+	}
+
+	var tx types.Transaction
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		return err
+	}
+	err := w.broadcast(&tx)
+	switch {
+	case err == nil:
+		logger.Warn("transaction dropped, broadcast again", "id", id, "nonce", tx.Nonce(), "txid", txid)
+		return nil
+	case !strings.Contains(err.Error(), "nonce too low"):
+		return err
+	case time.Since(since) <= w.Timeout:
+		logger.Warn("nonce of dropped transaction taken", "id", id, "nonce", tx.Nonce(), "txid", txid)
+		return nil
+	}
+
+	logger.Error("nonce taken by another transaction", "id", id, "nonce", tx.Nonce(), "txid", txid)
+	delete(w.tracked, id)
+	if err := w.db.SetReason(id, "nonce taken by another transaction"); err != nil {
+		return err
+	}
+	return w.db.CompareAndSwapStatus(w.db.StatusKey(id), status, StatusFailed)
+}
+
+// recheck hands payouts and cancellations made final within RecheckDepth blocks back to
+// the tracker when their block is no longer canonical, so that they are settled again on
+// the new chain.
+func (w *Worker) recheck(ctx context.Context, head uint64) error {
+	if !w.blocksIndexed {
+		if err := w.db.IndexBlocks(); err != nil {
+			return err
+		}
+		w.blocksIndexed = true
+	}
+
+	since := uint64(0)
+	if head > w.RecheckDepth {
+		since = head - w.RecheckDepth
+	}
+	// what withdrawals done in earlier blocks owed is settled, see settlePayouts
+	if err := w.db.SetRecheckSince(since); err != nil {
+		return err
+	}
+	ids, err := w.db.GetRecordsIdSinceBlock(since)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		obj, err := w.db.GetWdObjById(id)
+		if err != nil {
+			return err
+		}
+		var back uint64
+		switch obj.Status {
+		case StatusConfirmed, StatusFailed:
+			back = StatusProcessing
+		case StatusCancelled:
+			back = StatusCancelling
+		default:
+			// in flight ones are followed by the tracker itself
+			continue
+		}
+
+		header, err := w.ethc.HeaderByNumber(ctx, new(big.Int).SetUint64(obj.BlockNumber))
+		if err != nil && !errors.Is(err, ethereum.NotFound) {
+			logger.Error("failed to recheck block", "err", err, "id", id, "block", obj.BlockNumber)
+			continue
+		}
+		if header != nil && header.Hash().Hex() == obj.BlockHash {
+			continue
+		}
+
+		logger.Warn("block reorged out, tracking withdrawal again", "id", id, "block", obj.BlockNumber, "hash", obj.BlockHash)
+		if err := w.db.SetBlock(id, 0, ""); err != nil {
+			return err
+		}
+		if err := w.db.SetFee(id, 0, nil, nil); err != nil {
+			return err
+		}
+		if obj.Status == StatusFailed {
+			if err := w.db.SetReason(id, ""); err != nil {
+				return err
+			}
+		}
+		if err := w.db.CompareAndSwapStatus(w.db.StatusKey(id), obj.Status, back); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// confirmations returns how many blocks, the including one counted, are on top of number.
+func confirmations(head, number uint64) uint64 {
+	if head < number {
+		return 0
+	}
+	return head - number + 1
+}
+
+// Cancel broadcasts a cancellation for the in-flight withdrawal id, cancelling along every
+// withdrawal paid by the same disperse call.
+func (w *Worker) Cancel(ctx context.Context, id uint64) (*types.Transaction, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.renewLease(); err != nil {
+		return nil, err
+	}
+	if err := w.checkChain(ctx); err != nil {
+		return nil, err
+	}
+	return CancelWithdrawal(ctx, w.db, w.ethc, id, w.fromAddr, w.prvKey, w.chainID, w.Policy.Fee)
+}
+
+// checkChain refuses to sign for a node on another chain than the worker's, which
+// could happen after a failover to a misconfigured endpoint.
+func (w *Worker) checkChain(ctx context.Context) error {
+	id, err := DetectChainID(ctx, w.ethc)
+	if err != nil {
+		return err
+	}
+	if id.Cmp(w.chainID) != 0 {
+		return fmt.Errorf("%w, node: %v worker: %v", ErrChainMismatch, id, w.chainID)
+	}
+	return nil
+}
+
+// renewLease takes or extends the lease, refusing to go on if another worker holds it.
+func (w *Worker) renewLease() error {
+	if w.LeaseTTL <= 0 {
+		return nil
+	}
+	if _, err := w.leases().AcquireLease(w.Owner, w.LeaseTTL); err != nil {
+		return fmt.Errorf("not processing withdrawals without the lease: %w", err)
+	}
+	return nil
+}
+
+// ReleaseLease gives up the lease held by the worker, if any.
+func (w *Worker) ReleaseLease() error {
+	if w.LeaseTTL <= 0 {
+		return nil
+	}
+	return w.leases().ReleaseLease(w.Owner)
+}
+
+func (w *Worker) leases() LeaseStore {
+	if w.LeaseStore != nil {
+		return w.LeaseStore
+	}
+	return w.db
+}
@@ -0,0 +1,485 @@
+package eth_multi_transactions
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func newTestDB(t *testing.T) *WdDB {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	wdDB := NewWithdrawalDB(db)
+	require.NoError(t, wdDB.GetOrSet([]byte("kv-id"), ToBigEndianBytes(1)))
+	return wdDB
+}
+
+func newTestWorker(t *testing.T) (*Worker, *WdDB, *SimulatedClient) {
+	sim, key, from := newTestBackend(t)
+	db := newTestDB(t)
+	client := NewSimulatedClient(sim)
+
+	w := NewWorker(db, client, from, key, simChainID, 16)
+	w.Confirmations = 1
+	return w, db, client
+}
+
+// trackUntilSettled mines the pending block and runs the tracker until nothing is in flight.
+func trackUntilSettled(t *testing.T, w *Worker, client *SimulatedClient) {
+	for i := 0; i < 10; i++ {
+		client.Commit()
+		require.NoError(t, w.TrackOnce(context.Background()))
+
+		inFlight, err := w.db.GetRecordsIdByStatus(StatusProcessing)
+		require.NoError(t, err)
+		if len(inFlight) == 0 {
+			return
+		}
+	}
+	t.Fatal("withdrawals still in flight")
+}
+
+func insertTestWithdrawals(t *testing.T, db *WdDB, objs ...*DbWithdrawalObj) []uint64 {
+	now := uint64(time.Now().Unix())
+	for _, o := range objs {
+		o.Created, o.Modified = now, now
+	}
+	require.NoError(t, db.BatchInsert(objs))
+
+	ids, err := db.GetUnhandledRecordsId()
+	require.NoError(t, err)
+	require.Len(t, ids, len(objs))
+	return ids
+}
+
+func TestWorker_SendAndConfirm(t *testing.T) {
+	w, db, client := newTestWorker(t)
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001001", Amount: big.NewInt(1000)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001002", Amount: big.NewInt(2000)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001003", Amount: Ether},
+	)
+
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	// every withdrawal is broadcast up front with consecutive nonces
+	for i, id := range ids {
+		obj, err := db.GetWdObjById(id)
+		require.NoError(t, err)
+		assert.Equal(t, StatusProcessing, obj.Status)
+		assert.Equal(t, uint64(i), obj.Nonce)
+		assert.NotEmpty(t, obj.Hash)
+	}
+
+	trackUntilSettled(t, w, client)
+
+	for _, id := range ids {
+		obj, err := db.GetWdObjById(id)
+		require.NoError(t, err)
+		assert.Equal(t, StatusConfirmed, obj.Status)
+
+		balance, err := client.BalanceAt(context.Background(), common.HexToAddress(obj.Address), nil)
+		require.NoError(t, err)
+		assert.Equal(t, obj.Amount.String(), balance.String())
+	}
+}
+
+func TestWorker_MaxInFlight(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	w.MaxInFlight = 2
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000002001", Amount: big.NewInt(1)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000002002", Amount: big.NewInt(1)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000002003", Amount: big.NewInt(1)},
+	)
+
+	require.NoError(t, w.Dispatch(context.Background()))
+	pending, err := db.GetUnhandledRecordsId()
+	require.NoError(t, err)
+	assert.Equal(t, ids[2:], pending)
+
+	trackUntilSettled(t, w, client)
+	require.NoError(t, w.Dispatch(context.Background()))
+	trackUntilSettled(t, w, client)
+
+	confirmed, err := db.GetRecordsIdByStatus(StatusConfirmed)
+	require.NoError(t, err)
+	assert.Equal(t, ids, confirmed)
+}
+
+func TestWorker_FailedPrecheck(t *testing.T) {
+	w, db, client := newTestWorker(t)
+
+	// a contract without a payable fallback rejects plain transfers
+	contract := deployTestContract(t, client.SimulatedBackend, w.prvKey, "Disperse")
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: contract.Hex(), Amount: big.NewInt(1)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000003001", Amount: big.NewInt(1)},
+	)
+
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	failed, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusFailedPrecheck, failed.Status)
+	assert.NotEmpty(t, failed.Reason)
+	assert.Empty(t, failed.Hash)
+
+	// the skipped withdrawal did not burn a nonce
+	sent, err := db.GetWdObjById(ids[1])
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessing, sent.Status)
+	assert.Equal(t, uint64(1), sent.Nonce)
+
+	trackUntilSettled(t, w, client)
+}
+
+// flakyClient fails broadcasts with err, handing the transaction to the chain first if
+// deliver is set, like a node timing out after accepting it.
+type flakyClient struct {
+	*SimulatedClient
+	err     error
+	deliver bool
+}
+
+func (c *flakyClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if c.err == nil || c.deliver {
+		if err := c.SimulatedClient.SendTransaction(ctx, tx); err != nil {
+			return err
+		}
+	}
+	return c.err
+}
+
+func TestWorker_BroadcastOutcome(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	flaky := &flakyClient{SimulatedClient: client, err: context.DeadlineExceeded, deliver: true}
+	w.ethc = flaky
+
+	// a timeout may come after the node accepted the transaction, it is tracked, not resent
+	ids := insertTestWithdrawals(t, db, &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000004001", Amount: big.NewInt(1000)})
+	assert.Error(t, w.Dispatch(context.Background()))
+	obj, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessing, obj.Status)
+	assert.NotEmpty(t, obj.Hash)
+
+	flaky.err = nil
+	require.NoError(t, w.Dispatch(context.Background()))
+	trackUntilSettled(t, w, client)
+	obj, err = db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusConfirmed, obj.Status)
+	balance, err := client.BalanceAt(context.Background(), common.HexToAddress(obj.Address), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1000", balance.String())
+
+	// a rejected transaction is surely not held, the withdrawal goes back to the queue
+	flaky.err, flaky.deliver = errors.New("replacement transaction underpriced"), false
+	pending, err := db.GetUnhandledRecordsId()
+	require.NoError(t, err)
+	require.Empty(t, pending)
+	require.NoError(t, db.BatchInsert([]*DbWithdrawalObj{{Address: "0x0000000000000000000000000000000000004002", Amount: big.NewInt(1)}}))
+	assert.Error(t, w.Dispatch(context.Background()))
+	pending, err = db.GetUnhandledRecordsId()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	obj, err = db.GetWdObjById(pending[0])
+	require.NoError(t, err)
+	assert.Empty(t, obj.Hash)
+}
+
+func TestWorker_Rebroadcast(t *testing.T) {
+	w, db, client := newTestWorker(t)
+
+	ids := insertTestWithdrawals(t, db, &DbWithdrawalObj{Address: "0x0000000000000000000000000000000000005001", Amount: big.NewInt(1000)})
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	// the node drops the transaction, the tracker sends the stored one again
+	client.Rollback()
+	obj, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	_, _, err = client.TransactionByHash(context.Background(), common.HexToHash(obj.Hash))
+	require.True(t, errors.Is(err, ethereum.NotFound))
+	require.NoError(t, w.TrackOnce(context.Background()))
+
+	trackUntilSettled(t, w, client)
+	obj, err = db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusConfirmed, obj.Status)
+}
+
+func TestWorker_NotBeforeAndExpiry(t *testing.T) {
+	w, db, _ := newTestWorker(t)
+
+	now := uint64(time.Now().Unix())
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001001", Amount: big.NewInt(1), NotBefore: now + 3600},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001002", Amount: big.NewInt(2), Expiry: now - 1},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000001003", Amount: big.NewInt(3), NotBefore: now - 60, Expiry: now + 3600},
+	)
+
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	deferred, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusInit, deferred.Status)
+	assert.Equal(t, now+3600, deferred.NotBefore)
+
+	expired, err := db.GetWdObjById(ids[1])
+	require.NoError(t, err)
+	assert.Equal(t, StatusExpired, expired.Status)
+	assert.NotEmpty(t, expired.Reason)
+
+	due, err := db.GetWdObjById(ids[2])
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessing, due.Status)
+
+	// the deferred withdrawal is paid once its time comes
+	pending, _, err := db.GetDueRecordsId(time.Unix(int64(now+3600), 0))
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{ids[0]}, pending)
+}
+
+func TestWorker_Disperse(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	contract := deployTestContract(t, client.SimulatedBackend, w.prvKey, "Disperse")
+	w.Disperse = &contract
+	w.BatchSize = 2
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000004001", Amount: big.NewInt(10)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000004002", Amount: big.NewInt(20)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000004003", Amount: big.NewInt(30)},
+	)
+
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	var hashes []string
+	for _, id := range ids {
+		obj, err := db.GetWdObjById(id)
+		require.NoError(t, err)
+		hashes = append(hashes, obj.Hash)
+	}
+	assert.Equal(t, hashes[0], hashes[1])
+	assert.NotEqual(t, hashes[1], hashes[2])
+
+	trackUntilSettled(t, w, client)
+
+	for _, id := range ids {
+		obj, err := db.GetWdObjById(id)
+		require.NoError(t, err)
+		assert.Equal(t, StatusConfirmed, obj.Status)
+
+		balance, err := client.BalanceAt(context.Background(), common.HexToAddress(obj.Address), nil)
+		require.NoError(t, err)
+		assert.Equal(t, obj.Amount.String(), balance.String())
+	}
+}
+
+func TestWorker_DisperseSplit(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	contract := deployTestContract(t, client.SimulatedBackend, w.prvKey, "Disperse")
+	w.Disperse = &contract
+	w.BatchSize = 4
+
+	// the disperse contract itself refuses plain transfers and reverts any batch paying it
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000004201", Amount: big.NewInt(10)},
+		&DbWithdrawalObj{Address: contract.Hex(), Amount: big.NewInt(20)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000004203", Amount: big.NewInt(30)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000004204", Amount: big.NewInt(40)},
+	)
+
+	require.NoError(t, w.Dispatch(context.Background()))
+	trackUntilSettled(t, w, client)
+
+	for i, id := range ids {
+		obj, err := db.GetWdObjById(id)
+		require.NoError(t, err)
+		if i == 1 {
+			assert.Equal(t, StatusFailedPrecheck, obj.Status)
+			assert.Empty(t, obj.Hash)
+			continue
+		}
+		assert.Equal(t, StatusConfirmed, obj.Status)
+
+		balance, err := client.BalanceAt(context.Background(), common.HexToAddress(obj.Address), nil)
+		require.NoError(t, err)
+		assert.Equal(t, obj.Amount.String(), balance.String())
+	}
+}
+
+func TestWorker_DisperseToken(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	contract := deployTestContract(t, client.SimulatedBackend, w.prvKey, "Disperse")
+	token := deployTestContract(t, client.SimulatedBackend, w.prvKey, "TestToken", big.NewInt(1000000))
+	w.Disperse = &contract
+	w.BatchSize = 2
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000004101", Token: token.Hex(), Amount: big.NewInt(100)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000004102", Token: token.Hex(), Amount: big.NewInt(200)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000004103", Token: token.Hex(), Amount: big.NewInt(300)},
+	)
+
+	// the queue waits for an approval of its total, not of an unlimited amount
+	require.NoError(t, w.Dispatch(context.Background()))
+	pending, err := db.GetUnhandledRecordsId()
+	require.NoError(t, err)
+	assert.Equal(t, ids, pending)
+	require.NoError(t, w.Dispatch(context.Background()))
+	client.Commit()
+
+	allowance, err := TokenAllowance(context.Background(), client, token, w.fromAddr, contract)
+	require.NoError(t, err)
+	assert.Equal(t, "600", allowance.String())
+
+	require.NoError(t, w.Dispatch(context.Background()))
+	trackUntilSettled(t, w, client)
+
+	for _, id := range ids {
+		obj, err := db.GetWdObjById(id)
+		require.NoError(t, err)
+		assert.Equal(t, StatusConfirmed, obj.Status)
+
+		balance, err := TokenBalance(context.Background(), client, token, common.HexToAddress(obj.Address))
+		require.NoError(t, err)
+		assert.Equal(t, obj.Amount.String(), balance.String())
+	}
+
+	allowance, err = TokenAllowance(context.Background(), client, token, w.fromAddr, contract)
+	require.NoError(t, err)
+	assert.Zero(t, allowance.Sign())
+
+	// the approval is paid for by no withdrawal, its fee is kept apart
+	overheads, err := db.Overheads()
+	require.NoError(t, err)
+	require.Len(t, overheads, 1)
+	assert.Equal(t, OverheadApprove, overheads[0].Kind)
+	assert.Equal(t, token.Hex(), overheads[0].Token)
+	require.NotNil(t, overheads[0].Fee)
+	assert.Positive(t, overheads[0].Fee.Sign())
+}
+
+func TestWorker_Reorg(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000008001", Amount: big.NewInt(1)},
+	)
+
+	parent := client.Blockchain().CurrentBlock().Hash()
+	require.NoError(t, w.Dispatch(context.Background()))
+	trackUntilSettled(t, w, client)
+
+	obj, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusConfirmed, obj.Status)
+	assert.Equal(t, parent, client.Blockchain().GetHeaderByNumber(obj.BlockNumber-1).Hash())
+
+	// a longer side chain without the transaction becomes canonical
+	require.NoError(t, client.Fork(context.Background(), parent))
+	client.Commit()
+	client.Commit()
+	require.NoError(t, w.TrackOnce(context.Background()))
+
+	obj, err = db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessing, obj.Status)
+	assert.Empty(t, obj.BlockHash)
+}
+
+func TestWorker_Confirmations(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	w.Confirmations = 3
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000008101", Amount: big.NewInt(1)},
+	)
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	// the including block and two on top of it
+	for i := 0; i < 3; i++ {
+		client.Commit()
+		require.NoError(t, w.TrackOnce(context.Background()))
+
+		obj, err := db.GetWdObjById(ids[0])
+		require.NoError(t, err)
+		assert.NotEmpty(t, obj.BlockHash)
+		if i < 2 {
+			assert.Equal(t, StatusProcessing, obj.Status)
+		} else {
+			assert.Equal(t, StatusConfirmed, obj.Status)
+		}
+	}
+}
+
+func TestWorker_Fee(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	contract := deployTestContract(t, client.SimulatedBackend, w.prvKey, "Disperse")
+	w.Disperse = &contract
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000009001", Amount: big.NewInt(10)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000009002", Amount: big.NewInt(20)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000009003", Amount: big.NewInt(30)},
+	)
+	require.NoError(t, w.Dispatch(context.Background()))
+	trackUntilSettled(t, w, client)
+
+	first, err := db.GetWdObjById(ids[0])
+	require.NoError(t, err)
+	receipt, err := client.TransactionReceipt(context.Background(), common.HexToHash(first.Hash))
+	require.NoError(t, err)
+
+	// the shares of the batch add up to the fee of its transaction
+	total := big.NewInt(0)
+	for _, id := range ids {
+		obj, err := db.GetWdObjById(id)
+		require.NoError(t, err)
+		assert.Equal(t, receipt.GasUsed, obj.GasUsed)
+		assert.Equal(t, receipt.BlockHash.Hex(), obj.BlockHash)
+		require.NotNil(t, obj.Fee)
+		total.Add(total, obj.Fee)
+	}
+	expected := big.NewInt(0).Mul(first.GasPrice, big.NewInt(0).SetUint64(receipt.GasUsed))
+	assert.Equal(t, expected.String(), total.String())
+}
+
+func TestWorker_FeeWholeBatch(t *testing.T) {
+	w, db, client := newTestWorker(t)
+	contract := deployTestContract(t, client.SimulatedBackend, w.prvKey, "Disperse")
+	w.Disperse = &contract
+
+	ids := insertTestWithdrawals(t, db,
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000009101", Amount: big.NewInt(10)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000009102", Amount: big.NewInt(20)},
+		&DbWithdrawalObj{Address: "0x0000000000000000000000000000000000009103", Amount: big.NewInt(30)},
+	)
+	require.NoError(t, w.Dispatch(context.Background()))
+
+	// a withdrawal of the batch settled otherwise still takes its share
+	require.NoError(t, db.CompareAndSwapStatus(db.StatusKey(ids[2]), StatusProcessing, StatusFailed))
+	trackUntilSettled(t, w, client)
+
+	obj, err := db.GetWdObjById(ids[1])
+	require.NoError(t, err)
+	require.NotNil(t, obj.Fee)
+	expected := big.NewInt(0).Mul(obj.GasPrice, big.NewInt(0).SetUint64(obj.GasUsed))
+	expected.Div(expected, big.NewInt(3))
+	assert.Equal(t, expected.String(), obj.Fee.String())
+}